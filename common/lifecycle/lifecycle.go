@@ -0,0 +1,219 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lifecycle starts and stops the observer and executor plugin grpc
+// servers.
+package lifecycle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+)
+
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// SetupSignalContext returns a context which is canceled on SIGTERM or SIGINT.
+// If a second signal is caught, the program is terminated with exit code 1.
+func SetupSignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, shutdownSignals...)
+	go func() {
+		s := <-c
+		klog.Infof("Got signal %s, shutting down...\n", s)
+		cancel()
+		s = <-c
+		klog.Errorf("Got signal %s again, exit immediately\n", s)
+		klog.Flush()
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// ListenConfig is where the server listens, a unix socket by default or a tcp
+// address with mutual tls for servers shared by several arbiter components.
+type ListenConfig struct {
+	// Endpoint is the unix socket, it's used when Address is empty.
+	Endpoint string
+	// Address is the tcp address, such as :9443.
+	Address string
+	// CertFile and KeyFile are the server certificate, ClientCAFile is the CA
+	// that must sign the client certificates. They're required by Address.
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+func (c *ListenConfig) Validate() error {
+	if c.Address == "" {
+		if c.Endpoint == "" {
+			return fmt.Errorf("either a unix socket or a tcp address is required")
+		}
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" || c.ClientCAFile == "" {
+		return fmt.Errorf("listening on tcp address %s requires the server certificate, key and client CA files", c.Address)
+	}
+	return nil
+}
+
+// Listen listens on the tcp address, or on the unix socket when the address is
+// empty. The socket left by a previous run is removed first.
+func (c *ListenConfig) Listen() (net.Listener, error) {
+	if c.Address != "" {
+		return net.Listen("tcp", c.Address)
+	}
+	if err := os.Remove(c.Endpoint); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", c.Endpoint)
+}
+
+// ServerOptions returns the tls credentials requiring client certificates when
+// listening on tcp.
+func (c *ListenConfig) ServerOptions() ([]grpc.ServerOption, error) {
+	if c.Address == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate error: %w", err)
+	}
+	clientCAs, err := loadCertPool(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}))}, nil
+}
+
+// Dial connects to the server of this process, it's used by the exec probes.
+// On tcp the server certificate is also presented as client certificate, so it
+// must be signed by the client CA and allow client auth. The server isn't
+// verified since the probe connects to the local process, on the host of the
+// listen address or on the loopback when it listens on all addresses.
+func (c *ListenConfig) Dial(ctx context.Context) (*grpc.ClientConn, error) {
+	if c.Address == "" {
+		return grpc.DialContext(ctx, "unix:"+c.Endpoint,
+			grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	}
+
+	address, err := dialAddress(c.Address)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client certificate error: %w", err)
+	}
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	return grpc.DialContext(ctx, address, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+}
+
+// dialAddress returns the address to dial the server listening on address, the
+// loopback when the host is empty or unspecified, such as 0.0.0.0 or ::.
+func dialAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// String describes where the server listens, for logging.
+func (c *ListenConfig) String() string {
+	if c.Address != "" {
+		return "tcp " + c.Address
+	}
+	return "unix " + c.Endpoint
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// Serve serves the grpc server on the listener until ctx is done. The server
+// then stops accepting connections and waits up to drainTimeout for the
+// requests in flight, the requests still running after that are stopped and
+// their context is canceled. Serve returns nil after a normal shutdown.
+func Serve(ctx context.Context, server *grpc.Server, listener net.Listener, drainTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		klog.Infof("All requests in flight are finished\n")
+	case <-time.After(drainTimeout):
+		klog.Warningf("Requests in flight aren't finished in %s, stop them\n", drainTimeout)
+		server.Stop()
+		<-stopped
+	}
+
+	if err := <-errCh; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	if addr, ok := listener.Addr().(*net.UnixAddr); ok {
+		if err := os.Remove(addr.Name); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("Remove socket %s error: %s\n", addr.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lifecycle
+
+import "testing"
+
+func TestDialAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "all addresses",
+			address: ":8443",
+			want:    "localhost:8443",
+		},
+		{
+			name:    "unspecified ipv4",
+			address: "0.0.0.0:8443",
+			want:    "localhost:8443",
+		},
+		{
+			name:    "unspecified ipv6",
+			address: "[::]:8443",
+			want:    "localhost:8443",
+		},
+		{
+			name:    "pod ip",
+			address: "10.1.2.3:8443",
+			want:    "10.1.2.3:8443",
+		},
+		{
+			name:    "ipv6",
+			address: "[fd00::3]:8443",
+			want:    "[fd00::3]:8443",
+		},
+		{
+			name:    "host name",
+			address: "observer.local:8443",
+			want:    "observer.local:8443",
+		},
+		{
+			name:    "missing port",
+			address: "10.1.2.3",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := dialAddress(test.address)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("dialAddress() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("dialAddress() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rpcerrors
+
+import (
+	"context"
+	"runtime/debug"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// ReasonPanic is the reason of the errors converted from a panic.
+const ReasonPanic = "PANIC"
+
+// Recover converts a panic of the calling goroutine into an Internal error
+// stored in err, it must be deferred directly:
+//
+//	defer rpcerrors.Recover("probe", &err)
+func Recover(name string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	klog.Errorf("rpcerrors/Recover %s panic: %v\n%s", name, r, debug.Stack())
+	*err = withDetails(status.Newf(codes.Internal, "%s panic: %v", name, r), &errdetails.ErrorInfo{
+		Reason: ReasonPanic,
+		Domain: Domain,
+	})
+}
+
+// UnaryServerRecoveryInterceptor returns an Internal error instead of crashing
+// the server when a handler panics.
+func UnaryServerRecoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer Recover(info.FullMethod, &err)
+	return handler(ctx, req)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rpcerrors
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecover(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name        string
+		run         func() error
+		want        error
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{
+			name: "no panic keeps the result",
+			run:  func() error { return nil },
+		},
+		{
+			name: "no panic keeps the error",
+			run:  func() error { return boom },
+			want: boom,
+		},
+		{
+			name:        "panic with a value",
+			run:         func() error { panic("nil map") },
+			wantCode:    codes.Internal,
+			wantMessage: "probe panic: nil map",
+		},
+		{
+			name:        "panic with an error",
+			run:         func() error { panic(boom) },
+			wantCode:    codes.Internal,
+			wantMessage: "probe panic: boom",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := func() (err error) {
+				defer Recover("probe", &err)
+				return test.run()
+			}()
+			if test.wantCode == codes.OK {
+				if err != test.want {
+					t.Errorf("Recover() error = %v, want %v", err, test.want)
+				}
+				return
+			}
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("Recover() code = %s, want %s", code, test.wantCode)
+			}
+			if message := status.Convert(err).Message(); message != test.wantMessage {
+				t.Errorf("Recover() message = %q, want %q", message, test.wantMessage)
+			}
+			if info := errorInfo(t, err); info.Reason != ReasonPanic {
+				t.Errorf("Recover() reason = %s, want %s", info.Reason, ReasonPanic)
+			}
+		})
+	}
+}
+
+func TestUnaryServerRecoveryInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/obi.v1.Server/GetMetrics"}
+	tests := []struct {
+		name      string
+		handler   grpc.UnaryHandler
+		wantResp  interface{}
+		wantCode  codes.Code
+		wantError string
+	}{
+		{
+			name:     "response",
+			handler:  func(context.Context, interface{}) (interface{}, error) { return "response", nil },
+			wantResp: "response",
+		},
+		{
+			name:      "error",
+			handler:   func(context.Context, interface{}) (interface{}, error) { return nil, Unavailable("down") },
+			wantCode:  codes.Unavailable,
+			wantError: "down",
+		},
+		{
+			name:      "panic",
+			handler:   func(context.Context, interface{}) (interface{}, error) { panic("nil map") },
+			wantCode:  codes.Internal,
+			wantError: "/obi.v1.Server/GetMetrics panic: nil map",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := UnaryServerRecoveryInterceptor(context.Background(), nil, info, test.handler)
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("UnaryServerRecoveryInterceptor() code = %s, want %s, error %v", code, test.wantCode, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("UnaryServerRecoveryInterceptor() error = %v, want %q", err, test.wantError)
+			}
+			if resp != test.wantResp {
+				t.Errorf("UnaryServerRecoveryInterceptor() response = %v, want %v", resp, test.wantResp)
+			}
+		})
+	}
+}
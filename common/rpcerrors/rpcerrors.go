@@ -0,0 +1,180 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rpcerrors builds the grpc status errors returned by the observer and
+// executor plugin servers.
+package rpcerrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Domain is the domain of the ErrorInfo details.
+const Domain = "arbiter.k8s.com"
+
+// Reasons of the ErrorInfo details.
+const (
+	ReasonInvalidRequest     = "INVALID_REQUEST"
+	ReasonNotFound           = "NOT_FOUND"
+	ReasonBackendUnavailable = "BACKEND_UNAVAILABLE"
+	ReasonBackendTimeout     = "BACKEND_TIMEOUT"
+	ReasonBackendError       = "BACKEND_ERROR"
+)
+
+// InvalidArgument returns an InvalidArgument error with a BadRequest detail
+// describing the invalid field of the request.
+func InvalidArgument(field, format string, args ...interface{}) error {
+	description := fmt.Sprintf(format, args...)
+	return withDetails(status.New(codes.InvalidArgument, description),
+		&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: field, Description: description},
+		}},
+	)
+}
+
+// NotFound returns a NotFound error with a ResourceInfo detail.
+func NotFound(resourceType, resourceName, format string, args ...interface{}) error {
+	description := fmt.Sprintf(format, args...)
+	return withDetails(status.New(codes.NotFound, description),
+		&errdetails.ResourceInfo{ResourceType: resourceType, ResourceName: resourceName, Description: description},
+	)
+}
+
+// Unavailable returns an Unavailable error for a backend which can't serve the
+// request now, the request may succeed when retried.
+func Unavailable(format string, args ...interface{}) error {
+	return withDetails(status.New(codes.Unavailable, fmt.Sprintf(format, args...)),
+		&errdetails.ErrorInfo{Reason: ReasonBackendUnavailable, Domain: Domain},
+	)
+}
+
+// ResourceExhausted returns a ResourceExhausted error with a QuotaFailure
+// detail naming the exhausted limit of the subject.
+func ResourceExhausted(subject, limit, format string, args ...interface{}) error {
+	return withDetails(status.New(codes.ResourceExhausted, fmt.Sprintf(format, args...)),
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{
+			{Subject: subject, Description: limit + " limit exceeded"},
+		}},
+	)
+}
+
+// FromHTTPStatus returns the error of a backend which answered with the http
+// status code.
+func FromHTTPStatus(statusCode int, format string, args ...interface{}) error {
+	code, reason := codes.Unknown, ReasonBackendError
+	switch {
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		code, reason = codes.DeadlineExceeded, ReasonBackendTimeout
+	case statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError:
+		code, reason = codes.Unavailable, ReasonBackendUnavailable
+	case statusCode == http.StatusBadRequest || statusCode == http.StatusUnprocessableEntity:
+		code, reason = codes.InvalidArgument, ReasonInvalidRequest
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		code = codes.PermissionDenied
+	case statusCode == http.StatusNotFound:
+		code, reason = codes.NotFound, ReasonNotFound
+	}
+	return withDetails(status.New(code, fmt.Sprintf(format, args...)),
+		&errdetails.ErrorInfo{Reason: reason, Domain: Domain, Metadata: map[string]string{"httpStatus": strconv.Itoa(statusCode)}},
+	)
+}
+
+// Wrap prefixes the message of err, the status code and details of err are
+// kept.
+func Wrap(err error, format string, args ...interface{}) error {
+	prefix := fmt.Sprintf(format, args...)
+	s, ok := status.FromError(err)
+	if !ok {
+		return fmt.Errorf("%s: %w", prefix, err)
+	}
+	p := s.Proto()
+	p.Message = prefix + ": " + p.Message
+	return status.ErrorProto(p)
+}
+
+// FromError converts the error returned by a plugin to a status error, plugin
+// is added to its ErrorInfo detail. The errors which already carry a status
+// are kept, the others are classified as:
+//
+//	context deadline, api server timeouts          DeadlineExceeded
+//	context canceled                               Canceled
+//	api server NotFound                            NotFound
+//	api server Invalid or BadRequest               InvalidArgument
+//	api server Forbidden or Unauthorized           PermissionDenied
+//	api server Conflict                            Aborted
+//	network errors, api server 429 and 5xx         Unavailable
+//	anything else                                  Unknown
+func FromError(plugin string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code, reason := classify(err)
+	return withDetails(status.New(code, err.Error()), &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   Domain,
+		Metadata: map[string]string{"plugin": plugin},
+	})
+}
+
+func classify(err error) (codes.Code, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return codes.DeadlineExceeded, ReasonBackendTimeout
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled, ReasonBackendError
+	case apierrors.IsNotFound(err):
+		return codes.NotFound, ReasonNotFound
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return codes.InvalidArgument, ReasonInvalidRequest
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return codes.PermissionDenied, ReasonBackendError
+	case apierrors.IsConflict(err):
+		return codes.Aborted, ReasonBackendError
+	case apierrors.IsTooManyRequests(err), apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err),
+		apierrors.IsUnexpectedServerError(err):
+		return codes.Unavailable, ReasonBackendUnavailable
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return codes.DeadlineExceeded, ReasonBackendTimeout
+		}
+		return codes.Unavailable, ReasonBackendUnavailable
+	}
+	return codes.Unknown, ReasonBackendError
+}
+
+func withDetails(s *status.Status, details ...proto.Message) error {
+	withDetails, err := s.WithDetails(details...)
+	if err != nil {
+		return s.Err()
+	}
+	return withDetails.Err()
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rpcerrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// errorInfo returns the ErrorInfo detail of err.
+func errorInfo(t *testing.T, err error) *errdetails.ErrorInfo {
+	t.Helper()
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	t.Fatalf("error %v has no ErrorInfo", err)
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestFromHTTPStatus(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		wantCode   codes.Code
+		wantReason string
+	}{
+		{statusCode: http.StatusBadRequest, wantCode: codes.InvalidArgument, wantReason: ReasonInvalidRequest},
+		{statusCode: http.StatusUnprocessableEntity, wantCode: codes.InvalidArgument, wantReason: ReasonInvalidRequest},
+		{statusCode: http.StatusUnauthorized, wantCode: codes.PermissionDenied, wantReason: ReasonBackendError},
+		{statusCode: http.StatusForbidden, wantCode: codes.PermissionDenied, wantReason: ReasonBackendError},
+		{statusCode: http.StatusNotFound, wantCode: codes.NotFound, wantReason: ReasonNotFound},
+		{statusCode: http.StatusRequestTimeout, wantCode: codes.DeadlineExceeded, wantReason: ReasonBackendTimeout},
+		{statusCode: http.StatusConflict, wantCode: codes.Unknown, wantReason: ReasonBackendError},
+		{statusCode: http.StatusTooManyRequests, wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{statusCode: http.StatusInternalServerError, wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{statusCode: http.StatusServiceUnavailable, wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{statusCode: http.StatusGatewayTimeout, wantCode: codes.DeadlineExceeded, wantReason: ReasonBackendTimeout},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.statusCode), func(t *testing.T) {
+			err := FromHTTPStatus(test.statusCode, "backend answered %d", test.statusCode)
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("FromHTTPStatus() code = %s, want %s", code, test.wantCode)
+			}
+			info := errorInfo(t, err)
+			if info.Reason != test.wantReason || info.Domain != Domain {
+				t.Errorf("FromHTTPStatus() reason = %s in %s, want %s in %s", info.Reason, info.Domain, test.wantReason, Domain)
+			}
+			if want := fmt.Sprint(test.statusCode); info.Metadata["httpStatus"] != want {
+				t.Errorf("FromHTTPStatus() httpStatus = %q, want %q", info.Metadata["httpStatus"], want)
+			}
+		})
+	}
+}
+
+func TestFromError(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   codes.Code
+		wantReason string
+	}{
+		{name: "context deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), wantCode: codes.DeadlineExceeded, wantReason: ReasonBackendTimeout},
+		{name: "context canceled", err: fmt.Errorf("query: %w", context.Canceled), wantCode: codes.Canceled, wantReason: ReasonBackendError},
+		{name: "api server timeout", err: apierrors.NewTimeoutError("slow", 1), wantCode: codes.DeadlineExceeded, wantReason: ReasonBackendTimeout},
+		{name: "api server server timeout", err: apierrors.NewServerTimeout(pods, "get", 1), wantCode: codes.DeadlineExceeded, wantReason: ReasonBackendTimeout},
+		{name: "api server not found", err: apierrors.NewNotFound(pods, "web-0"), wantCode: codes.NotFound, wantReason: ReasonNotFound},
+		{name: "api server invalid", err: apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, "web-0", nil), wantCode: codes.InvalidArgument, wantReason: ReasonInvalidRequest},
+		{name: "api server bad request", err: apierrors.NewBadRequest("bad"), wantCode: codes.InvalidArgument, wantReason: ReasonInvalidRequest},
+		{name: "api server forbidden", err: apierrors.NewForbidden(pods, "web-0", errors.New("rbac")), wantCode: codes.PermissionDenied, wantReason: ReasonBackendError},
+		{name: "api server unauthorized", err: apierrors.NewUnauthorized("token"), wantCode: codes.PermissionDenied, wantReason: ReasonBackendError},
+		{name: "api server conflict", err: apierrors.NewConflict(pods, "web-0", errors.New("modified")), wantCode: codes.Aborted, wantReason: ReasonBackendError},
+		{name: "api server throttled", err: apierrors.NewTooManyRequests("slow down", 1), wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{name: "api server unavailable", err: apierrors.NewServiceUnavailable("down"), wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{name: "api server internal error", err: apierrors.NewInternalError(errors.New("boom")), wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{name: "network error", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, wantCode: codes.Unavailable, wantReason: ReasonBackendUnavailable},
+		{name: "network timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, wantCode: codes.DeadlineExceeded, wantReason: ReasonBackendTimeout},
+		{name: "anything else", err: errors.New("boom"), wantCode: codes.Unknown, wantReason: ReasonBackendError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := FromError("prometheus", test.err)
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("FromError() code = %s, want %s", code, test.wantCode)
+			}
+			info := errorInfo(t, err)
+			if info.Reason != test.wantReason || info.Metadata["plugin"] != "prometheus" {
+				t.Errorf("FromError() reason = %s of %s, want %s of prometheus", info.Reason, info.Metadata["plugin"], test.wantReason)
+			}
+			if message := status.Convert(err).Message(); message != test.err.Error() {
+				t.Errorf("FromError() message = %q, want %q", message, test.err.Error())
+			}
+		})
+	}
+}
+
+func TestFromErrorKeepsStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "nil"},
+		{name: "status error", err: NotFound("source", "thanos", "source thanos isn't registered")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := FromError("prometheus", test.err); got != test.err {
+				t.Errorf("FromError() = %v, want %v", got, test.err)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{
+			name:        "status error keeps its code and details",
+			err:         Unavailable("connection refused"),
+			wantCode:    codes.Unavailable,
+			wantMessage: "operand rate: connection refused",
+		},
+		{
+			name:        "plain error",
+			err:         errors.New("boom"),
+			wantCode:    codes.Unknown,
+			wantMessage: "operand rate: boom",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Wrap(test.err, "operand %s", "rate")
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("Wrap() code = %s, want %s", code, test.wantCode)
+			}
+			if message := status.Convert(err).Message(); message != test.wantMessage {
+				t.Errorf("Wrap() message = %q, want %q", message, test.wantMessage)
+			}
+			if len(status.Convert(test.err).Details()) != len(status.Convert(err).Details()) {
+				t.Errorf("Wrap() details = %v, want %v", status.Convert(err).Details(), status.Convert(test.err).Details())
+			}
+		})
+	}
+}
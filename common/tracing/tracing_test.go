@@ -0,0 +1,221 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID      = "00f067aa0ba902b7"
+	traceparent = "00-" + traceID + "-" + spanID + "-01"
+)
+
+// record installs a tracer provider recording the ended spans and the
+// propagator of Setup for the test.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	if _, err := Setup(context.Background(), Config{ServiceName: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+}
+
+func TestSetup(t *testing.T) {
+	record(t)
+	shutdown, err := Setup(context.Background(), Config{ServiceName: "test"})
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	// without endpoint nothing is exported, but the trace context is
+	// propagated
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+	fields := map[string]bool{}
+	for _, field := range otel.GetTextMapPropagator().Fields() {
+		fields[field] = true
+	}
+	if !fields["traceparent"] || !fields["baggage"] {
+		t.Errorf("propagator fields = %v, want traceparent and baggage", otel.GetTextMapPropagator().Fields())
+	}
+}
+
+func TestStartEnd(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		wantStatus      codes.Code
+		wantDescription string
+		wantEvents      int
+	}{
+		{name: "succeeded", wantStatus: codes.Unset},
+		{name: "failed", err: errors.New("connection refused"), wantStatus: codes.Error, wantDescription: "connection refused", wantEvents: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record(t)
+			_, span := Start(context.Background(), "prometheus.Query", attribute.String("arbiter.source", "prometheus"))
+			End(span, test.err)
+
+			spans := recorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("%d spans ended, want 1", len(spans))
+			}
+			got := spans[0]
+			if got.Name() != "prometheus.Query" || got.SpanKind() != trace.SpanKindClient {
+				t.Errorf("span = %s of kind %s, want prometheus.Query of kind client", got.Name(), got.SpanKind())
+			}
+			if attrs := got.Attributes(); len(attrs) != 1 || attrs[0] != attribute.String("arbiter.source", "prometheus") {
+				t.Errorf("span attributes = %v, want arbiter.source=prometheus", attrs)
+			}
+			if got.Status().Code != test.wantStatus || got.Status().Description != test.wantDescription {
+				t.Errorf("span status = %v, want %s %q", got.Status(), test.wantStatus, test.wantDescription)
+			}
+			if len(got.Events()) != test.wantEvents {
+				t.Errorf("span events = %v, want %d", got.Events(), test.wantEvents)
+			}
+		})
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantStatus codes.Code
+	}{
+		{name: "ok", statusCode: http.StatusOK, wantStatus: codes.Unset},
+		{name: "server error", statusCode: http.StatusServiceUnavailable, wantStatus: codes.Error},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record(t)
+			var header string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Get("traceparent")
+				w.WriteHeader(test.statusCode)
+			}))
+			defer server.Close()
+
+			ctx, parent := Start(context.Background(), "parent")
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/query", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := (&http.Client{Transport: RoundTripper(http.DefaultTransport)}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			parent.End()
+
+			spans := recorder.Ended()
+			if len(spans) != 2 {
+				t.Fatalf("%d spans ended, want 2", len(spans))
+			}
+			got := spans[0]
+			if got.Name() != "HTTP GET /api/v1/query" {
+				t.Errorf("span name = %s, want HTTP GET /api/v1/query", got.Name())
+			}
+			if got.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("span parent = %s, want %s", got.Parent().SpanID(), parent.SpanContext().SpanID())
+			}
+			if want := "00-" + got.SpanContext().TraceID().String() + "-" + got.SpanContext().SpanID().String() + "-01"; header != want {
+				t.Errorf("traceparent header = %q, want %q", header, want)
+			}
+			if got.Status().Code != test.wantStatus {
+				t.Errorf("span status = %v, want %s", got.Status(), test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name        string
+		md          metadata.MD
+		wantTraceID string
+		wantParent  string
+	}{
+		{
+			name:        "the trace of the caller is continued",
+			md:          metadata.Pairs("traceparent", traceparent),
+			wantTraceID: traceID,
+			wantParent:  spanID,
+		},
+		{
+			name: "a trace is started without caller trace",
+			md:   metadata.MD{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record(t)
+			ctx := metadata.NewIncomingContext(context.Background(), test.md)
+			var handlerSpan trace.SpanContext
+			_, err := UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/obi.v1.Server/GetMetrics"},
+				func(ctx context.Context, _ interface{}) (interface{}, error) {
+					handlerSpan = trace.SpanContextFromContext(ctx)
+					return nil, nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			spans := recorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("%d spans ended, want 1", len(spans))
+			}
+			got := spans[0]
+			if got.SpanKind() != trace.SpanKindServer || got.SpanContext().SpanID() != handlerSpan.SpanID() {
+				t.Errorf("span %s of kind %s, want the server span of the handler %s", got.SpanContext().SpanID(), got.SpanKind(), handlerSpan.SpanID())
+			}
+			if test.wantTraceID == "" {
+				if got.Parent().IsValid() {
+					t.Errorf("span parent = %s, want none", got.Parent().SpanID())
+				}
+				return
+			}
+			if got.SpanContext().TraceID().String() != test.wantTraceID || got.Parent().SpanID().String() != test.wantParent {
+				t.Errorf("span of trace %s with parent %s, want trace %s with parent %s",
+					got.SpanContext().TraceID(), got.Parent().SpanID(), test.wantTraceID, test.wantParent)
+			}
+		})
+	}
+}
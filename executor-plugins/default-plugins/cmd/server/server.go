@@ -18,48 +18,20 @@ package main
 
 import (
 	"flag"
-	"log"
-	"net"
-	"os"
 
-	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 
-	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
-	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/sdk"
 
 	_ "github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/plugins/update_resource"
 )
 
-const (
-	protocol = "unix"
-	sockAddr = "/plugins/resourcetagger.sock"
-)
+var options = sdk.NewOptions("executor-default-plugins")
 
 func main() {
 	// Load flags from command line
 	klog.InitFlags(nil)
+	options.AddFlags(flag.CommandLine)
 	flag.Parse()
-	cleanup := func() {
-		if _, err := os.Stat(sockAddr); err == nil {
-			if err := os.RemoveAll(sockAddr); err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
-
-	cleanup()
-
-	listener, err := net.Listen(protocol, sockAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	server := grpc.NewServer()
-	execute := wrapper.NewExecuteService()
-
-	pb.RegisterExecuteServer(server, execute)
-
-	klog.Infoln("executor-default-plugins started...")
-	klog.Fatalln(server.Serve(listener))
+	sdk.Main(options)
 }
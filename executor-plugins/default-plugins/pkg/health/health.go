@@ -0,0 +1,112 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
+)
+
+// Checker serves grpc.health.v1 with one service per registered executor. The
+// executors, and the whole server with the empty service name, are SERVING
+// when the api server answers, the executors implementing wrapper.Prober are
+// checked by their own probe as well.
+type Checker struct {
+	server   *health.Server
+	config   *rest.Config
+	client   kubernetes.Interface
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// NewChecker creates a checker probing the api server of config.
+func NewChecker(config *rest.Config, interval, timeout time.Duration) (*Checker, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	server := health.NewServer()
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return &Checker{
+		server:   server,
+		config:   config,
+		client:   client,
+		interval: interval,
+		timeout:  timeout,
+	}, nil
+}
+
+// Register registers the health service on the grpc server.
+func (c *Checker) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, c.server)
+}
+
+// Run checks the executors every interval until ctx is done, then reports
+// every service as NOT_SERVING.
+func (c *Checker) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, c.Check, c.interval)
+	c.server.Shutdown()
+}
+
+// probe calls the probe of an executor, a panic of the probe is returned as an
+// error.
+func (c *Checker) probe(ctx context.Context, prober wrapper.Prober) (err error) {
+	defer rpcerrors.Recover("probe", &err)
+	return prober.Probe(ctx, c.config)
+}
+
+// Check probes the api server, then the registered executors implementing
+// wrapper.Prober.
+func (c *Checker) Check(ctx context.Context) {
+	method := "Checker/Check"
+	probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	err := c.client.Discovery().RESTClient().Get().AbsPath("/version").Do(probeCtx).Error()
+	if err != nil {
+		klog.Warningf("%s probe api server error: %s\n", method, err)
+		c.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+		for _, name := range wrapper.Executors() {
+			c.server.SetServingStatus(name, healthpb.HealthCheckResponse_NOT_SERVING)
+		}
+		return
+	}
+
+	c.server.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	for _, name := range wrapper.Executors() {
+		status := healthpb.HealthCheckResponse_SERVING
+		instance, _ := wrapper.GetExecutor(name)
+		if prober, ok := instance.(wrapper.Prober); ok {
+			if err := c.probe(probeCtx, prober); err != nil {
+				klog.Warningf("%s probe executor [%s] error: %s\n", method, name, err)
+				status = healthpb.HealthCheckResponse_NOT_SERVING
+			}
+		}
+		c.server.SetServingStatus(name, status)
+	}
+}
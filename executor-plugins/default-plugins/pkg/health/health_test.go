@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+type fakeExecutor struct {
+	name string
+}
+
+func (f *fakeExecutor) Name() string { return f.name }
+
+func (f *fakeExecutor) Execute(context.Context, *rest.Config, *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	return &pb.ExecuteResponse{}, nil
+}
+
+// proberExecutor fails its probe with err, or panics when panics is set.
+type proberExecutor struct {
+	fakeExecutor
+	err    error
+	panics bool
+}
+
+func (p *proberExecutor) Probe(context.Context, *rest.Config) error {
+	if p.panics {
+		panic("probe of " + p.name)
+	}
+	return p.err
+}
+
+func init() {
+	wrapper.Register("test-plain", &fakeExecutor{name: "test-plain"})
+	wrapper.Register("test-ready", &proberExecutor{fakeExecutor: fakeExecutor{name: "test-ready"}})
+	wrapper.Register("test-down", &proberExecutor{fakeExecutor: fakeExecutor{name: "test-down"}, err: errors.New("connection refused")})
+	wrapper.Register("test-panic", &proberExecutor{fakeExecutor: fakeExecutor{name: "test-panic"}, panics: true})
+}
+
+func TestCheck(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major": "1", "minor": "24"}`))
+	}))
+	defer apiServer.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name string
+		host string
+		want map[string]healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{
+			// a panic of a probe is recovered as a failure of the executor
+			name: "the executors are checked by their probe",
+			host: apiServer.URL,
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":           healthpb.HealthCheckResponse_SERVING,
+				"test-plain": healthpb.HealthCheckResponse_SERVING,
+				"test-ready": healthpb.HealthCheckResponse_SERVING,
+				"test-down":  healthpb.HealthCheckResponse_NOT_SERVING,
+				"test-panic": healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+		},
+		{
+			name: "nothing is serving without the api server",
+			host: down.URL,
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":           healthpb.HealthCheckResponse_NOT_SERVING,
+				"test-plain": healthpb.HealthCheckResponse_NOT_SERVING,
+				"test-ready": healthpb.HealthCheckResponse_NOT_SERVING,
+				"test-down":  healthpb.HealthCheckResponse_NOT_SERVING,
+				"test-panic": healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker, err := NewChecker(&rest.Config{Host: test.host}, time.Minute, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker.Check(context.Background())
+			for service, want := range test.want {
+				response, err := checker.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil {
+					t.Fatalf("Check(%q) error = %v", service, err)
+				}
+				if response.Status != want {
+					t.Errorf("Check(%q) = %s, want %s", service, response.Status, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "arbiter_executor"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of grpc requests by method.",
+	}, []string{"method"})
+
+	requestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_errors_total",
+		Help:      "Number of failed grpc requests by method and grpc code.",
+	}, []string{"method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of grpc requests by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	executionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "executions_total",
+		Help:      "Number of executions by executor.",
+	}, []string{"executor"})
+
+	executionErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "execution_errors_total",
+		Help:      "Number of failed executions by executor and grpc code.",
+	}, []string{"executor", "code"})
+
+	executionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "execution_duration_seconds",
+		Help:      "Latency of executions by executor.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"executor"})
+
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of the api server requests sent by the executors, by executor and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"executor", "code"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestErrorsTotal,
+		requestDuration,
+		executionsTotal,
+		executionErrorsTotal,
+		executionDuration,
+		backendRequestDuration,
+	)
+}
+
+// UnaryServerInterceptor records the count, errors and latency of the grpc
+// requests.
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	requestsTotal.WithLabelValues(method).Inc()
+	if err != nil {
+		requestErrorsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+	return resp, err
+}
+
+// ObserveExecution records an execution of the executor which started at start.
+func ObserveExecution(executor string, start time.Time, err error) {
+	executionDuration.WithLabelValues(executor).Observe(time.Since(start).Seconds())
+	executionsTotal.WithLabelValues(executor).Inc()
+	if err != nil {
+		executionErrorsTotal.WithLabelValues(executor, status.Code(err).String()).Inc()
+	}
+}
+
+// InstrumentRoundTripper returns a wrapper recording the latency of the api
+// server requests sent by the executor, it can be used as the WrapTransport of
+// client-go configs.
+func InstrumentRoundTripper(executor string) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := rt.RoundTrip(req)
+			code := "error"
+			if err == nil {
+				code = strconv.Itoa(resp.StatusCode)
+			}
+			backendRequestDuration.WithLabelValues(executor, code).Observe(time.Since(start).Seconds())
+			return resp, err
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
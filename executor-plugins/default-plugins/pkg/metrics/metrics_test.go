@@ -0,0 +1,161 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sampleCount returns the number of observations of a histogram.
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.Histogram.GetSampleCount()
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "succeeded"},
+		{name: "status error", err: status.Error(codes.NotFound, "pod web-0 not found")},
+		{name: "plain error", err: errors.New("boom")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const method = "Execute"
+			code := status.Code(test.err).String()
+			requests := testutil.ToFloat64(requestsTotal.WithLabelValues(method))
+			failures := testutil.ToFloat64(requestErrorsTotal.WithLabelValues(method, code))
+			observations := sampleCount(t, requestDuration.WithLabelValues(method))
+
+			_, err := UnaryServerInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/executor.v1.Execute/" + method},
+				func(context.Context, interface{}) (interface{}, error) { return nil, test.err })
+			if err != test.err {
+				t.Fatalf("UnaryServerInterceptor() error = %v, want %v", err, test.err)
+			}
+
+			wantFailures := 0.0
+			if test.err != nil {
+				wantFailures = 1
+			}
+			if got := testutil.ToFloat64(requestsTotal.WithLabelValues(method)) - requests; got != 1 {
+				t.Errorf("requests_total increased by %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(requestErrorsTotal.WithLabelValues(method, code)) - failures; got != wantFailures {
+				t.Errorf("request_errors_total{code=%q} increased by %v, want %v", code, got, wantFailures)
+			}
+			if got := sampleCount(t, requestDuration.WithLabelValues(method)) - observations; got != 1 {
+				t.Errorf("request_duration_seconds observed %d requests, want 1", got)
+			}
+		})
+	}
+}
+
+func TestObserveExecution(t *testing.T) {
+	tests := []struct {
+		name     string
+		executor string
+		err      error
+	}{
+		{name: "succeeded", executor: "metrics-test-ok"},
+		{name: "failed", executor: "metrics-test-failed", err: status.Error(codes.PermissionDenied, "forbidden")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ObserveExecution(test.executor, time.Now(), test.err)
+			wantFailures := 0.0
+			if test.err != nil {
+				wantFailures = 1
+			}
+			if got := testutil.ToFloat64(executionsTotal.WithLabelValues(test.executor)); got != 1 {
+				t.Errorf("executions_total = %v, want 1", got)
+			}
+			code := status.Code(test.err).String()
+			if got := testutil.ToFloat64(executionErrorsTotal.WithLabelValues(test.executor, code)); got != wantFailures {
+				t.Errorf("execution_errors_total{code=%q} = %v, want %v", code, got, wantFailures)
+			}
+			if got := sampleCount(t, executionDuration.WithLabelValues(test.executor)); got != 1 {
+				t.Errorf("execution_duration_seconds observed %d executions, want 1", got)
+			}
+		})
+	}
+}
+
+func TestInstrumentRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode string
+	}{
+		{name: "ok", url: server.URL + "/api", wantCode: "200"},
+		{name: "client error", url: server.URL + "/forbidden", wantCode: "403"},
+		{name: "transport error", url: closed.URL, wantCode: "error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			observer := backendRequestDuration.WithLabelValues("metrics-test", test.wantCode)
+			before := sampleCount(t, observer)
+			client := &http.Client{Transport: InstrumentRoundTripper("metrics-test")(nil)}
+			if response, err := client.Get(test.url); err == nil {
+				response.Body.Close()
+			}
+			if got := sampleCount(t, observer) - before; got != 1 {
+				t.Errorf("backend_request_duration_seconds{code=%q} observed %d requests, want 1", test.wantCode, got)
+			}
+		})
+	}
+}
+
+func TestLint(t *testing.T) {
+	problems, err := testutil.GatherAndLint(Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the go collector isn't ours
+	for _, problem := range problems {
+		if strings.HasPrefix(problem.Metric, namespace+"_") {
+			t.Errorf("metric %s: %s", problem.Metric, problem.Text)
+		}
+	}
+}
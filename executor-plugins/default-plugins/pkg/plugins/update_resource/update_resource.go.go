@@ -18,24 +18,40 @@ package plugins
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
 	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
 )
 
+// Data of the Execute response, telling an update from a no-op.
+const (
+	Updated   = "updated"
+	Unchanged = "unchanged"
+)
+
 type ResourceUpdateExecutor struct {
 	name string
 }
 
+var (
+	_ wrapper.Planner    = (*ResourceUpdateExecutor)(nil)
+	_ wrapper.Rollbacker = (*ResourceUpdateExecutor)(nil)
+)
+
 func (l *ResourceUpdateExecutor) Name() string {
 	return l.name
 }
@@ -51,10 +67,13 @@ func UpdateResource(resouceToUpdate *unstructured.Unstructured, message *pb.Exec
 	resourceName := fmt.Sprintf("%s/%s", resouceToUpdate.GetKind(), resouceToUpdate.GetName())
 	klog.Infof("start processing resource %s", resourceName)
 
+	if message.ActionData == nil {
+		return rpcerrors.InvalidArgument("action_data", "action data with the labels is required")
+	}
 	metaObj := metav1.ObjectMeta{}
 	if err = json.Unmarshal(message.ActionData.Raw, &metaObj); err != nil {
 		klog.Errorf("Failed to unmarshal the raw message %s with error %s", message.ActionData.Raw, err)
-		return err
+		return rpcerrors.InvalidArgument("action_data", "invalid action data: %s", err)
 	}
 	labels := resouceToUpdate.GetLabels()
 	if message.CondVal {
@@ -77,50 +96,251 @@ func UpdateResource(resouceToUpdate *unstructured.Unstructured, message *pb.Exec
 }
 
 func (l *ResourceUpdateExecutor) Execute(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	response, _, _, err := l.apply(ctx, cfg, message, false)
+	return response, err
+}
+
+// LabelDiff is the plan of a dry run, the labels of the resource before and
+// after the update, and the changes between them.
+type LabelDiff struct {
+	Resource string                 `json:"resource"`
+	Before   map[string]string      `json:"before"`
+	After    map[string]string      `json:"after"`
+	Added    map[string]string      `json:"added,omitempty"`
+	Removed  map[string]string      `json:"removed,omitempty"`
+	Changed  map[string]LabelChange `json:"changed,omitempty"`
+	// Unchanged is set when the labels already match, no update is sent.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+type LabelChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Plan sends the update with a server-side dry run, so that it's validated and
+// defaulted by the api server without being persisted, and returns the diff of
+// the labels as json data.
+func (l *ResourceUpdateExecutor) Plan(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	response, before, after, err := l.apply(ctx, cfg, message, true)
+	if err != nil {
+		return response, err
+	}
+	diff := diffLabels(before.GetLabels(), after.GetLabels())
+	diff.Unchanged = response.Data == Unchanged
+	diff.Resource = fmt.Sprintf("%s/%s/%s:%s", message.Group, message.Version, message.Resources, message.ResourceName)
+	if message.Namespace != "" {
+		diff.Resource = fmt.Sprintf("%s/%s/%s:%s/%s", message.Group, message.Version, message.Resources, message.Namespace, message.ResourceName)
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return response, err
+	}
+	response.Data = string(data)
+	return response, nil
+}
+
+// apply gets the resource of the message and updates its labels, a dry run
+// isn't persisted. It returns the resource before the update and the one
+// returned by the api server. When the labels already match no update is sent,
+// so that the resourceVersion isn't bumped and the watchers aren't woken up,
+// and the data of the response is Unchanged.
+func (l *ResourceUpdateExecutor) apply(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage, dryRun bool) (response *pb.ExecuteResponse, before, after *unstructured.Unstructured, err error) {
 	resourceBaseFormat := fmt.Sprintf("%s/%s/%s:%s", message.Group, message.Version, message.Resources, message.ResourceName)
 
-	dynamicClient, err := dynamic.NewForConfig(cfg)
+	resourceInterface, gvr, err := resourceOf(ctx, cfg, message)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
 	}
 
-	var resouceToUpdate *unstructured.Unstructured
-	response := &pb.ExecuteResponse{
+	response = &pb.ExecuteResponse{
 		Data: "",
 	}
-	namespaceableInterface := dynamicClient.Resource(
-		schema.GroupVersionResource{Group: message.Group, Version: message.Version, Resource: message.Resources})
-	if message.Namespace != "" {
-		resouceToUpdate, err = namespaceableInterface.Namespace(message.Namespace).Get(context.Background(), message.ResourceName, metav1.GetOptions{})
-	} else {
-		resouceToUpdate, err = namespaceableInterface.Get(context.Background(), message.ResourceName, metav1.GetOptions{})
-	}
+	before, err = get(ctx, resourceInterface, gvr, message)
 	if err != nil {
-		klog.Errorf("get resource %s (in namespace %s) error: %s\n", resourceBaseFormat, message.Namespace, err)
 		if errors.IsNotFound(err) {
-			response.Data = fmt.Sprintf("Resource %s not found in namespace %s", resourceBaseFormat, message.Namespace)
-			return response, nil
+			return nil, nil, nil, rpcerrors.NotFound(message.Resources, message.ResourceName,
+				"resource %s not found in namespace '%s'", resourceBaseFormat, message.Namespace)
 		}
 		response.Data = fmt.Sprintf("get resource %s error: %s", resourceBaseFormat, err)
-		return response, err
+		return response, nil, nil, err
 	}
 
+	resouceToUpdate := before.DeepCopy()
 	err = UpdateResource(resouceToUpdate, message)
 	if err != nil {
 		response.Data = err.Error()
-		return response, err
+		return response, nil, nil, err
 	}
-	if message.Namespace != "" {
-		_, err = namespaceableInterface.Namespace(message.Namespace).Update(context.Background(), resouceToUpdate, metav1.UpdateOptions{})
-	} else {
-		_, err = namespaceableInterface.Update(context.Background(), resouceToUpdate, metav1.UpdateOptions{})
+	if labelsEqual(before.GetLabels(), resouceToUpdate.GetLabels()) {
+		klog.V(4).Infof("labels of resource %s (in namespace %s) already match, skip the update\n", resourceBaseFormat, message.Namespace)
+		response.Data = Unchanged
+		return response, before, before, nil
+	}
+	opts := metav1.UpdateOptions{}
+	if dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
 	}
+	updateCtx, span := startSpan(ctx, "dynamic.Update", gvr, message)
+	span.SetAttributes(attribute.Bool("k8s.dry_run", dryRun))
+	after, err = resourceInterface.Update(updateCtx, resouceToUpdate, opts)
+	tracing.End(span, err)
 	if err != nil {
 		response.Data = fmt.Sprintf("update resource %s error: %s", resourceBaseFormat, err)
-		return response, err
+		return response, nil, nil, err
 	}
 
-	return response, nil
+	response.Data = Updated
+	return response, before, after, nil
+}
+
+// resourceOf returns the dynamic client of the resource of the message.
+func resourceOf(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (dynamic.ResourceInterface, schema.GroupVersionResource, error) {
+	gvr := schema.GroupVersionResource{Group: message.Group, Version: message.Version, Resource: message.Resources}
+	dynamicClient, err := wrapper.DynamicClient(ctx, cfg)
+	if err != nil {
+		klog.Errorf("create dynamic client for %s error: %s\n", gvr, err)
+		return nil, gvr, err
+	}
+	if message.Namespace != "" {
+		return dynamicClient.Resource(gvr).Namespace(message.Namespace), gvr, nil
+	}
+	return dynamicClient.Resource(gvr), gvr, nil
+}
+
+// get returns the resource of the message in a span.
+func get(ctx context.Context, resourceInterface dynamic.ResourceInterface, gvr schema.GroupVersionResource, message *pb.ExecuteMessage) (*unstructured.Unstructured, error) {
+	getCtx, span := startSpan(ctx, "dynamic.Get", gvr, message)
+	object, err := resourceInterface.Get(getCtx, message.ResourceName, metav1.GetOptions{})
+	tracing.End(span, err)
+	if err != nil {
+		klog.Errorf("get resource %s:%s (in namespace %s) error: %s\n", gvr, message.ResourceName, message.Namespace, err)
+	}
+	return object, err
+}
+
+// labelsEqual compares labels, nil and empty labels are equal.
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// diffLabels compares the labels before and after an update.
+func diffLabels(before, after map[string]string) LabelDiff {
+	diff := LabelDiff{Before: map[string]string{}, After: map[string]string{}}
+	for key, value := range before {
+		diff.Before[key] = value
+		to, ok := after[key]
+		switch {
+		case !ok:
+			if diff.Removed == nil {
+				diff.Removed = map[string]string{}
+			}
+			diff.Removed[key] = value
+		case to != value:
+			if diff.Changed == nil {
+				diff.Changed = map[string]LabelChange{}
+			}
+			diff.Changed[key] = LabelChange{From: value, To: to}
+		}
+	}
+	for key, value := range after {
+		diff.After[key] = value
+		if _, ok := before[key]; !ok {
+			if diff.Added == nil {
+				diff.Added = map[string]string{}
+			}
+			diff.Added[key] = value
+		}
+	}
+	return diff
+}
+
+// ExecuteWithUndo runs Execute and returns the values of the labels it changed
+// before the update, a label the resource didn't have is null. It returns no
+// undo state when the labels already matched.
+func (l *ResourceUpdateExecutor) ExecuteWithUndo(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, json.RawMessage, error) {
+	response, before, after, err := l.apply(ctx, cfg, message, false)
+	if err != nil || response.Data == Unchanged {
+		return response, nil, err
+	}
+	undo, err := json.Marshal(previousLabels(before.GetLabels(), after.GetLabels()))
+	if err != nil {
+		return response, nil, err
+	}
+	return response, undo, nil
+}
+
+// previousLabels returns the value before the update of every label changed by
+// the update, nil for the labels which were added.
+func previousLabels(before, after map[string]string) map[string]*string {
+	previous := map[string]*string{}
+	for key, value := range before {
+		if to, ok := after[key]; !ok || to != value {
+			value := value
+			previous[key] = &value
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			previous[key] = nil
+		}
+	}
+	return previous
+}
+
+// Rollback restores the labels changed by ExecuteWithUndo to the values of
+// undo, the labels it didn't change are left as they are now.
+func (l *ResourceUpdateExecutor) Rollback(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage, undo json.RawMessage) error {
+	previous := map[string]*string{}
+	if err := json.Unmarshal(undo, &previous); err != nil {
+		return fmt.Errorf("invalid undo state %s: %w", undo, err)
+	}
+	resourceInterface, gvr, err := resourceOf(ctx, cfg, message)
+	if err != nil {
+		return err
+	}
+	current, err := get(ctx, resourceInterface, gvr, message)
+	if err != nil {
+		return err
+	}
+	restored := current.DeepCopy()
+	labels := restored.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for key, value := range previous {
+		if value == nil {
+			delete(labels, key)
+			continue
+		}
+		labels[key] = *value
+	}
+	if labelsEqual(current.GetLabels(), labels) {
+		return nil
+	}
+	restored.SetLabels(labels)
+	updateCtx, span := startSpan(ctx, "dynamic.Update", gvr, message)
+	_, err = resourceInterface.Update(updateCtx, restored, metav1.UpdateOptions{})
+	tracing.End(span, err)
+	return err
+}
+
+// startSpan starts the span of a dynamic client call on the resource of the
+// message.
+func startSpan(ctx context.Context, name string, gvr schema.GroupVersionResource, message *pb.ExecuteMessage) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name,
+		attribute.String("k8s.resource", gvr.String()),
+		attribute.String("k8s.namespace.name", message.Namespace),
+		attribute.String("k8s.name", message.ResourceName),
+	)
 }
 
 func NewResourceUpdateExecutor(name string) *ResourceUpdateExecutor {
@@ -0,0 +1,283 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/sdk/conformance"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+var podsResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// newPodClient returns a fake client holding the web-0 pod with labels.
+func newPodClient(labels map[string]string) *dynamicfake.FakeDynamicClient {
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("web-0")
+	pod.SetLabels(labels)
+	listKinds := map[schema.GroupVersionResource]string{podsResource: "PodList"}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, pod)
+}
+
+func podMessage(condVal bool, actionData string) *pb.ExecuteMessage {
+	return &pb.ExecuteMessage{
+		ResourceName: "web-0",
+		Namespace:    "default",
+		CondVal:      condVal,
+		Version:      "v1",
+		Resources:    "pods",
+		ActionData:   &runtime.RawExtension{Raw: []byte(actionData)},
+	}
+}
+
+func podLabels(t *testing.T, client *dynamicfake.FakeDynamicClient) map[string]string {
+	t.Helper()
+	pod, err := client.Resource(podsResource).Namespace("default").Get(context.Background(), "web-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get pod: %s", err)
+	}
+	return pod.GetLabels()
+}
+
+// updates returns the number of updates sent with client.
+func updates(client *dynamicfake.FakeDynamicClient) int {
+	count := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestConformance(t *testing.T) {
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("web-0")
+	conformance.Suite{
+		Executor:   NewResourceUpdateExecutor("resourceUpdater"),
+		Object:     pod,
+		Resource:   "pods",
+		ActionData: &runtime.RawExtension{Raw: []byte(`{"labels": {"hot": "true"}}`)},
+	}.Run(t)
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		condVal     bool
+		wantData    string
+		wantLabels  map[string]string
+		wantUpdates int
+	}{
+		{
+			name:        "labels",
+			labels:      map[string]string{"app": "web"},
+			condVal:     true,
+			wantData:    Updated,
+			wantLabels:  map[string]string{"app": "web", "hot": "true"},
+			wantUpdates: 1,
+		},
+		{
+			name:        "un-labels",
+			labels:      map[string]string{"app": "web", "hot": "true"},
+			wantData:    Updated,
+			wantLabels:  map[string]string{"app": "web"},
+			wantUpdates: 1,
+		},
+		{
+			name:       "unchanged labels aren't updated",
+			labels:     map[string]string{"app": "web", "hot": "true"},
+			condVal:    true,
+			wantData:   Unchanged,
+			wantLabels: map[string]string{"app": "web", "hot": "true"},
+		},
+		{
+			name:       "missing labels aren't updated",
+			labels:     map[string]string{"app": "web"},
+			wantData:   Unchanged,
+			wantLabels: map[string]string{"app": "web"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newPodClient(test.labels)
+			ctx := wrapper.WithDynamicClient(context.Background(), client)
+			response, err := NewResourceUpdateExecutor("resourceUpdater").Execute(ctx, &rest.Config{}, podMessage(test.condVal, `{"labels": {"hot": "true"}}`))
+			if err != nil {
+				t.Fatalf("Execute() error = %s", err)
+			}
+			if response.Data != test.wantData {
+				t.Errorf("Execute() data = %q, want %q", response.Data, test.wantData)
+			}
+			if labels := podLabels(t, client); !reflect.DeepEqual(labels, test.wantLabels) {
+				t.Errorf("labels = %v, want %v", labels, test.wantLabels)
+			}
+			if got := updates(client); got != test.wantUpdates {
+				t.Errorf("Execute() sent %d updates, want %d", got, test.wantUpdates)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		condVal  bool
+		wantDiff LabelDiff
+	}{
+		{
+			name:    "adds and changes",
+			labels:  map[string]string{"app": "web", "tier": "cold"},
+			condVal: true,
+			wantDiff: LabelDiff{
+				Resource: "/v1/pods:default/web-0",
+				Before:   map[string]string{"app": "web", "tier": "cold"},
+				After:    map[string]string{"app": "web", "hot": "true", "tier": "hot"},
+				Added:    map[string]string{"hot": "true"},
+				Changed:  map[string]LabelChange{"tier": {From: "cold", To: "hot"}},
+			},
+		},
+		{
+			name:   "removes",
+			labels: map[string]string{"app": "web", "hot": "true"},
+			wantDiff: LabelDiff{
+				Resource: "/v1/pods:default/web-0",
+				Before:   map[string]string{"app": "web", "hot": "true"},
+				After:    map[string]string{"app": "web"},
+				Removed:  map[string]string{"hot": "true"},
+			},
+		},
+		{
+			name:    "unchanged",
+			labels:  map[string]string{"hot": "true", "tier": "hot"},
+			condVal: true,
+			wantDiff: LabelDiff{
+				Resource:  "/v1/pods:default/web-0",
+				Before:    map[string]string{"hot": "true", "tier": "hot"},
+				After:     map[string]string{"hot": "true", "tier": "hot"},
+				Unchanged: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newPodClient(test.labels)
+			ctx := wrapper.WithDynamicClient(context.Background(), client)
+			response, err := NewResourceUpdateExecutor("resourceUpdater").Plan(ctx, &rest.Config{}, podMessage(test.condVal, `{"labels": {"hot": "true", "tier": "hot"}}`))
+			if err != nil {
+				t.Fatalf("Plan() error = %s", err)
+			}
+			diff := LabelDiff{}
+			if err := json.Unmarshal([]byte(response.Data), &diff); err != nil {
+				t.Fatalf("Plan() data %q: %s", response.Data, err)
+			}
+			if !reflect.DeepEqual(diff, test.wantDiff) {
+				t.Errorf("Plan() diff = %+v, want %+v", diff, test.wantDiff)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		condVal    bool
+		wantUndo   bool
+		changed    map[string]string
+		wantLabels map[string]string
+	}{
+		{
+			name:     "restores the changed labels only",
+			labels:   map[string]string{"app": "web", "tier": "cold"},
+			condVal:  true,
+			wantUndo: true,
+			// a label changed by someone else after the executor keeps its value
+			changed:    map[string]string{"app": "api", "tier": "hot", "hot": "true", "owner": "ops"},
+			wantLabels: map[string]string{"app": "api", "tier": "cold", "owner": "ops"},
+		},
+		{
+			name:       "restores the removed labels",
+			labels:     map[string]string{"app": "web", "hot": "false"},
+			wantUndo:   true,
+			changed:    map[string]string{"app": "web"},
+			wantLabels: map[string]string{"app": "web", "hot": "false"},
+		},
+		{
+			name:       "unchanged has no undo state",
+			labels:     map[string]string{"hot": "true", "tier": "hot"},
+			condVal:    true,
+			wantLabels: map[string]string{"hot": "true", "tier": "hot"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newPodClient(test.labels)
+			ctx := wrapper.WithDynamicClient(context.Background(), client)
+			executor := NewResourceUpdateExecutor("resourceUpdater")
+			message := podMessage(test.condVal, `{"labels": {"hot": "true", "tier": "hot"}}`)
+			_, undo, err := executor.ExecuteWithUndo(ctx, &rest.Config{}, message)
+			if err != nil {
+				t.Fatalf("ExecuteWithUndo() error = %s", err)
+			}
+			if (undo != nil) != test.wantUndo {
+				t.Fatalf("ExecuteWithUndo() undo = %s, want undo %t", undo, test.wantUndo)
+			}
+			if !test.wantUndo {
+				if got := updates(client); got != 0 {
+					t.Errorf("ExecuteWithUndo() sent %d updates, want none", got)
+				}
+				return
+			}
+			resource := client.Resource(podsResource).Namespace("default")
+			pod, err := resource.Get(ctx, "web-0", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get pod: %s", err)
+			}
+			pod.SetLabels(test.changed)
+			if _, err := resource.Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+				t.Fatalf("update pod: %s", err)
+			}
+			if err := executor.Rollback(ctx, &rest.Config{}, message, undo); err != nil {
+				t.Fatalf("Rollback() error = %s", err)
+			}
+			if labels := podLabels(t, client); !reflect.DeepEqual(labels, test.wantLabels) {
+				t.Errorf("labels = %v, want %v", labels, test.wantLabels)
+			}
+		})
+	}
+}
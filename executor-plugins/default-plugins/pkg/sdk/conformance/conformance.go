@@ -0,0 +1,250 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conformance checks that an executor behaves like the arbiter
+// expects, a plugin runs it from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		pod := &unstructured.Unstructured{}
+//		pod.SetAPIVersion("v1")
+//		pod.SetKind("Pod")
+//		pod.SetNamespace("default")
+//		pod.SetName("web-0")
+//		conformance.Suite{
+//			Executor:   NewMyExecutor("myExecutor"),
+//			Object:     pod,
+//			Resource:   "pods",
+//			ActionData: &runtime.RawExtension{Raw: []byte(`{"labels": {"hot": "true"}}`)},
+//		}.Run(t)
+//	}
+//
+// The executor runs against a fake dynamic client holding Object, it must get
+// its client with wrapper.DynamicClient.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+// DefaultTimeout bounds every call of the suite when Suite.Timeout is zero.
+const DefaultTimeout = 10 * time.Second
+
+// Suite is the conformance suite of an executor.
+type Suite struct {
+	// Executor is the instance under test.
+	Executor wrapper.Executor
+	// Object is the resource the executor acts on, in the state expected when
+	// the condition is false, it must have its apiVersion, kind and name.
+	Object *unstructured.Unstructured
+	// Resource is the plural resource of Object, such as pods.
+	Resource string
+	// ActionData is sent in the messages, as the arbiter sends the action data
+	// of the policy.
+	ActionData *runtime.RawExtension
+	// ExprVal is sent in the messages.
+	ExprVal float64
+	// Timeout bounds every call, it defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Run runs every check of the suite as a subtest of t.
+func (s Suite) Run(t *testing.T) {
+	t.Helper()
+	if s.Executor == nil || s.Object == nil || s.Resource == "" {
+		t.Fatal("conformance suite requires the executor, the object and its resource")
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+	t.Run("Name", s.testName)
+	t.Run("Idempotent", s.testIdempotent)
+	t.Run("CondValSymmetry", s.testCondValSymmetry)
+	t.Run("NotFound", s.testNotFound)
+	t.Run("GetError", s.testGetError)
+	t.Run("UpdateError", s.testUpdateError)
+}
+
+func (s Suite) testName(t *testing.T) {
+	if s.Executor.Name() == "" {
+		t.Error("executor has no name")
+	}
+}
+
+// testIdempotent checks that running the same message twice leaves the object
+// as the first run did.
+func (s Suite) testIdempotent(t *testing.T) {
+	for _, condVal := range []bool{true, false} {
+		condVal := condVal
+		t.Run(fmt.Sprintf("CondVal=%t", condVal), func(t *testing.T) {
+			client := s.newClient()
+			if _, err := s.execute(client, s.message(condVal)); err != nil {
+				t.Fatalf("first run: %s", err)
+			}
+			first := s.get(t, client)
+			if _, err := s.execute(client, s.message(condVal)); err != nil {
+				t.Fatalf("second run: %s", err)
+			}
+			if second := s.get(t, client); !equality.Semantic.DeepEqual(first, second) {
+				t.Errorf("second run changed the object\nfirst:  %v\nsecond: %v", first, second)
+			}
+		})
+	}
+}
+
+// testCondValSymmetry checks that a true condition changes the object, and
+// that a false condition afterwards reverts it.
+func (s Suite) testCondValSymmetry(t *testing.T) {
+	client := s.newClient()
+	original := s.get(t, client)
+	if _, err := s.execute(client, s.message(true)); err != nil {
+		t.Fatalf("CondVal=true: %s", err)
+	}
+	if applied := s.get(t, client); equality.Semantic.DeepEqual(original, applied) {
+		t.Errorf("CondVal=true didn't change the object %v", applied)
+	}
+	if _, err := s.execute(client, s.message(false)); err != nil {
+		t.Fatalf("CondVal=false: %s", err)
+	}
+	if reverted := s.get(t, client); !equality.Semantic.DeepEqual(original, reverted) {
+		t.Errorf("CondVal=false didn't revert CondVal=true\noriginal: %v\nreverted: %v", original, reverted)
+	}
+}
+
+// testNotFound checks that a missing object is reported as NotFound.
+func (s Suite) testNotFound(t *testing.T) {
+	message := s.message(true)
+	message.ResourceName = "conformance-missing-" + s.Object.GetName()
+	_, err := s.execute(s.newClient(), message)
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("missing object error code %s, want %s: %v", code, codes.NotFound, err)
+	}
+}
+
+// testGetError checks that a failure to read the object is returned with the
+// code of the api error.
+func (s Suite) testGetError(t *testing.T) {
+	client := s.newClient()
+	client.PrependReactor("get", s.Resource, func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("conformance")
+	})
+	_, err := s.execute(client, s.message(true))
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("get error code %s, want %s: %v", code, codes.Unavailable, err)
+	}
+}
+
+// testUpdateError checks that a failure to write the object is returned with
+// the code of the api error.
+func (s Suite) testUpdateError(t *testing.T) {
+	client := s.newClient()
+	conflict := func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(s.gvr().GroupResource(), s.Object.GetName(), fmt.Errorf("conformance"))
+	}
+	client.PrependReactor("update", s.Resource, conflict)
+	client.PrependReactor("patch", s.Resource, conflict)
+	_, err := s.execute(client, s.message(true))
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("update error code %s, want %s: %v", code, codes.Aborted, err)
+	}
+}
+
+func (s Suite) gvr() schema.GroupVersionResource {
+	return s.Object.GroupVersionKind().GroupVersion().WithResource(s.Resource)
+}
+
+func (s Suite) newClient() *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{s.gvr(): s.Object.GetKind() + "List"}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, s.Object.DeepCopy())
+}
+
+func (s Suite) message(condVal bool) *pb.ExecuteMessage {
+	gvr := s.gvr()
+	message := &pb.ExecuteMessage{
+		ResourceName: s.Object.GetName(),
+		Namespace:    s.Object.GetNamespace(),
+		ExprVal:      s.ExprVal,
+		CondVal:      condVal,
+		Group:        gvr.Group,
+		Version:      gvr.Version,
+		Resources:    gvr.Resource,
+		Executors:    []string{s.Executor.Name()},
+	}
+	if s.ActionData != nil {
+		message.ActionData = s.ActionData.DeepCopy()
+	}
+	return message
+}
+
+// execute runs the executor with client as the wrapper does, the error is
+// converted to a grpc status and a panic is reported as an Internal error.
+func (s Suite) execute(client *dynamicfake.FakeDynamicClient, message *pb.ExecuteMessage) (response *pb.ExecuteResponse, err error) {
+	name := s.Executor.Name()
+	defer rpcerrors.Recover(name, &err)
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	ctx = wrapper.WithDynamicClient(ctx, client)
+	// the executors must not reach a real api server
+	cfg := &rest.Config{Host: "http://127.0.0.1:1", Timeout: s.Timeout}
+	response, err = s.Executor.Execute(ctx, cfg, proto.Clone(message).(*pb.ExecuteMessage))
+	return response, rpcerrors.FromError(name, err)
+}
+
+// get returns the object of the fake client without the fields the api server
+// maintains, empty labels and annotations are dropped as the api server does.
+func (s Suite) get(t *testing.T, client *dynamicfake.FakeDynamicClient) *unstructured.Unstructured {
+	t.Helper()
+	resource := client.Resource(s.gvr())
+	var object *unstructured.Unstructured
+	var err error
+	if s.Object.GetNamespace() != "" {
+		object, err = resource.Namespace(s.Object.GetNamespace()).Get(context.Background(), s.Object.GetName(), metav1.GetOptions{})
+	} else {
+		object, err = resource.Get(context.Background(), s.Object.GetName(), metav1.GetOptions{})
+	}
+	if err != nil {
+		t.Fatalf("get %s %s: %s", s.gvr(), s.Object.GetName(), err)
+	}
+	object.SetResourceVersion("")
+	object.SetManagedFields(nil)
+	object.SetGeneration(0)
+	if len(object.GetLabels()) == 0 {
+		object.SetLabels(nil)
+	}
+	if len(object.GetAnnotations()) == 0 {
+		object.SetAnnotations(nil)
+	}
+	return object
+}
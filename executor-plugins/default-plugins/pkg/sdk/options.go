@@ -0,0 +1,106 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sdk builds the grpc server of executor plugins. A plugin registers
+// its wrapper.Executor instances, then Main serves them over grpc with the
+// health service, prometheus metrics, OpenTelemetry tracing, panic recovery
+// and graceful shutdown:
+//
+//	func main() {
+//		opts := sdk.NewOptions("my-executor")
+//		opts.AddFlags(flag.CommandLine)
+//		flag.Parse()
+//		sdk.Register("myExecutor", myexecutor.New())
+//		sdk.Main(opts)
+//	}
+//
+// The conformance package checks that an executor follows the conventions
+// expected by the server.
+package sdk
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/lifecycle"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
+)
+
+// Options configure the server.
+type Options struct {
+	// Name of the server in the logs and the traces.
+	Name   string
+	Listen lifecycle.ListenConfig
+	// DrainTimeout is the time to wait for the requests in flight on shutdown.
+	DrainTimeout        time.Duration
+	HealthCheckInterval time.Duration
+	// ProbeTimeout bounds each probe of the api server, and the probe of the
+	// running server with Probe.
+	ProbeTimeout time.Duration
+	// Probe checks the health of ProbeService on the running server and exits
+	// instead of serving.
+	Probe          bool
+	ProbeService   string
+	MetricsAddress string
+	Tracing        tracing.Config
+	// ChainMode decides how the executors of a message run when one fails,
+	// the arbiter-chain-mode metadata overrides it for a request.
+	ChainMode wrapper.ChainMode
+	// DryRun plans the executors instead of running them, the
+	// arbiter-dry-run metadata enables it for a request.
+	DryRun bool
+}
+
+// NewOptions returns the default options of a server.
+func NewOptions(name string) *Options {
+	return &Options{
+		Name:                name,
+		Listen:              lifecycle.ListenConfig{Endpoint: "/plugins/resourcetagger.sock"},
+		DrainTimeout:        20 * time.Second,
+		HealthCheckInterval: 30 * time.Second,
+		ProbeTimeout:        10 * time.Second,
+		Tracing:             tracing.Config{ServiceName: name, SampleRatio: 1},
+		ChainMode:           wrapper.StopOnError,
+	}
+}
+
+// AddFlags binds the options to the flags of fs, the current values are the
+// defaults.
+func (o *Options) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Listen.Endpoint, "endpoint", o.Listen.Endpoint, "unix socket domain for current server")
+	fs.StringVar(&o.Listen.Address, "listen-address", o.Listen.Address, "tcp address to listen on instead of --endpoint, such as :9443, requires the --tls-* flags")
+	fs.StringVar(&o.Listen.CertFile, "tls-cert-file", o.Listen.CertFile, "server certificate used on --listen-address")
+	fs.StringVar(&o.Listen.KeyFile, "tls-key-file", o.Listen.KeyFile, "server private key used on --listen-address")
+	fs.StringVar(&o.Listen.ClientCAFile, "tls-client-ca-file", o.Listen.ClientCAFile, "CA which must sign the client certificates on --listen-address")
+	fs.DurationVar(&o.DrainTimeout, "drain-timeout", o.DrainTimeout, "time to wait for the requests in flight on shutdown before they're canceled")
+	fs.DurationVar(&o.HealthCheckInterval, "health-check-interval", o.HealthCheckInterval, "interval to probe the api server for the grpc health service")
+	fs.BoolVar(&o.Probe, "probe", o.Probe, "check the health of the running server and exit, for exec readiness probes")
+	fs.StringVar(&o.ProbeService, "probe-service", o.ProbeService, "service checked by --probe, an executor name or empty for the whole server")
+	fs.DurationVar(&o.ProbeTimeout, "probe-timeout", o.ProbeTimeout, "timeout of a health probe")
+	fs.StringVar(&o.MetricsAddress, "metrics-address", o.MetricsAddress, "address to serve the prometheus metrics of the server on, such as :8080, disabled when empty")
+	fs.StringVar(&o.Tracing.Endpoint, "otlp-endpoint", o.Tracing.Endpoint, "host:port of the OTLP grpc receiver to export traces to, such as localhost:4317, disabled when empty")
+	fs.BoolVar(&o.Tracing.Insecure, "otlp-insecure", o.Tracing.Insecure, "connect to --otlp-endpoint without tls")
+	fs.Float64Var(&o.Tracing.SampleRatio, "trace-sample-ratio", o.Tracing.SampleRatio, "ratio of the traces started by the server that are sampled, the traces of the callers keep their decision")
+	fs.Func("chain-mode", fmt.Sprintf("how the executors of a message run when one fails: %s, %s or %s (default %s)",
+		wrapper.StopOnError, wrapper.ContinueOnError, wrapper.AllOrNothing, o.ChainMode), func(value string) error {
+		mode, err := wrapper.ParseChainMode(value)
+		o.ChainMode = mode
+		return err
+	})
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "plan the executors instead of running them, nothing is changed, the arbiter-dry-run grpc metadata enables it per request")
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk
+
+import (
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/wrapper"
+)
+
+// Executor is implemented by the plugins, every instance is run under the name
+// it's registered with, which the ExecuteMessage lists in its executors.
+type Executor = wrapper.Executor
+
+// Prober is implemented by the executors which depend on more than the api
+// server, the health service reports their result.
+type Prober = wrapper.Prober
+
+// Register adds an executor under name, a name registered twice keeps the
+// first executor.
+func Register(name string, instance Executor) {
+	wrapper.Register(name, instance)
+}
+
+// Executors returns the names of the registered executors in order.
+func Executors() []string {
+	return wrapper.Executors()
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/sdk"
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+// panicService is a service registered next to the executors whose handler
+// panics, the executors recover their own panics.
+var panicService = grpc.ServiceDesc{
+	ServiceName: "test.Panic",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Panic",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := &emptypb.Empty{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Panic/Panic"},
+				func(context.Context, interface{}) (interface{}, error) { panic("nil map") })
+		},
+	}},
+}
+
+// setKubeconfig points --kubeconfig to an api server at host for the test.
+func setKubeconfig(t *testing.T, host string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`, host)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := flag.Lookup("kubeconfig").Value
+	saved := kubeconfig.String()
+	t.Cleanup(func() { _ = kubeconfig.Set(saved) })
+	if err := kubeconfig.Set(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errorCount returns the request errors of method with code.
+func errorCount(t *testing.T, method string, code codes.Code) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "arbiter_executor_request_errors_total" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["method"] == method && labels["code"] == code.String() {
+				return metric.Counter.GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// TestNewServerInterceptors checks the order of the interceptors: the
+// recovery turns a panic into an error before it's measured and recorded
+// on the span of the request.
+func TestNewServerInterceptors(t *testing.T) {
+	provider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(provider)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	setKubeconfig(t, "https://127.0.0.1:6443")
+
+	server, err := sdk.NewServer(sdk.NewOptions("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.GRPCServer().RegisterService(&panicService, struct{}{})
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.GRPCServer().Serve(listener) }()
+	defer server.GRPCServer().Stop()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewExecuteClient(conn)
+
+	tests := []struct {
+		name       string
+		call       func(ctx context.Context) error
+		wantMethod string
+		wantSpan   string
+		wantCode   codes.Code
+		wantStatus otelcodes.Code
+	}{
+		{
+			name: "succeeded",
+			call: func(ctx context.Context) error {
+				_, err := client.Execute(ctx, &pb.ExecuteMessage{ResourceName: "web-0", Version: "v1", Resources: "pods"})
+				return err
+			},
+			wantMethod: "Execute",
+			wantSpan:   "execute.Execute/Execute",
+			wantStatus: otelcodes.Unset,
+		},
+		{
+			name: "failed",
+			call: func(ctx context.Context) error {
+				_, err := client.Execute(ctx, &pb.ExecuteMessage{ResourceName: "web-0", Version: "v1", Resources: "pods", Executors: []string{"missing"}})
+				return err
+			},
+			wantMethod: "Execute",
+			wantSpan:   "execute.Execute/Execute",
+			wantCode:   codes.NotFound,
+			wantStatus: otelcodes.Error,
+		},
+		{
+			name: "panicked",
+			call: func(ctx context.Context) error {
+				return conn.Invoke(ctx, "/test.Panic/Panic", &emptypb.Empty{}, &emptypb.Empty{})
+			},
+			wantMethod: "Panic",
+			wantSpan:   "test.Panic/Panic",
+			wantCode:   codes.Internal,
+			wantStatus: otelcodes.Error,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := errorCount(t, test.wantMethod, test.wantCode)
+			if code := status.Code(test.call(context.Background())); code != test.wantCode {
+				t.Fatalf("call code = %s, want %s", code, test.wantCode)
+			}
+
+			wantErrors := errors
+			if test.wantCode != codes.OK {
+				wantErrors++
+			}
+			if got := errorCount(t, test.wantMethod, test.wantCode); got != wantErrors {
+				t.Errorf("request errors = %v, want %v", got, wantErrors)
+			}
+			spans := recorder.Ended()
+			if len(spans) == 0 {
+				t.Fatal("no span ended")
+			}
+			if got := spans[len(spans)-1]; got.Name() != test.wantSpan || got.Status().Code != test.wantStatus {
+				t.Errorf("span %s status = %v, want %s with %s", got.Name(), got.Status(), test.wantSpan, test.wantStatus)
+			}
+		})
+	}
+}
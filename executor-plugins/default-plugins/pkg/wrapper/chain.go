@@ -0,0 +1,211 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+// ChainMode decides how the executors of a message run when one of them fails.
+type ChainMode string
+
+const (
+	// StopOnError skips the executors after the first failure.
+	StopOnError ChainMode = "stop-on-error"
+	// ContinueOnError runs every executor whatever the failures.
+	ContinueOnError ChainMode = "continue-on-error"
+	// AllOrNothing skips the executors after the first failure and rolls back
+	// the ones which succeeded, every executor must be a Rollbacker.
+	AllOrNothing ChainMode = "all-or-nothing"
+)
+
+const (
+	// ChainModeHeader is the grpc metadata key overriding --chain-mode for a
+	// request.
+	ChainModeHeader = "arbiter-chain-mode"
+	// ChainResultTrailer is the grpc trailer carrying the json ChainResult
+	// when the request fails.
+	ChainResultTrailer = "arbiter-chain-result"
+)
+
+// rollbackTimeout bounds the rollback of a chain, which doesn't run on the
+// request context: the request most often fails because its deadline passed or
+// it was canceled, and the rollback must still run then.
+var rollbackTimeout = 30 * time.Second
+
+// Outcome is the result of an executor in a chain.
+type Outcome string
+
+const (
+	OutcomeSucceeded      Outcome = "succeeded"
+	OutcomePlanned        Outcome = "planned"
+	OutcomeFailed         Outcome = "failed"
+	OutcomeSkipped        Outcome = "skipped"
+	OutcomeRolledBack     Outcome = "rolled-back"
+	OutcomeRollbackFailed Outcome = "rollback-failed"
+)
+
+// Rollbacker is implemented by executors which can undo a successful Execute
+// of the message, they're required by AllOrNothing. ExecuteWithUndo runs
+// Execute and returns the state it replaced, nil when it changed nothing.
+// Rollback restores that state, and only that state, so that the changes made
+// by others in between are kept.
+type Rollbacker interface {
+	ExecuteWithUndo(context.Context, *rest.Config, *pb.ExecuteMessage) (*pb.ExecuteResponse, json.RawMessage, error)
+	Rollback(context.Context, *rest.Config, *pb.ExecuteMessage, json.RawMessage) error
+}
+
+// ExecutorResult is the outcome of an executor, Data is the data of its
+// response.
+type ExecutorResult struct {
+	Executor string  `json:"executor"`
+	Outcome  Outcome `json:"outcome"`
+	Data     string  `json:"data,omitempty"`
+	Code     string  `json:"code,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	// undo is the state replaced by the executor, restored by a rollback.
+	undo json.RawMessage
+}
+
+// ChainResult is the json data of the Execute response, with the outcome of
+// every executor in the order of the message. In a dry run the data of the
+// executors are their plans.
+type ChainResult struct {
+	Mode    ChainMode        `json:"mode"`
+	DryRun  bool             `json:"dryRun,omitempty"`
+	Results []ExecutorResult `json:"results"`
+}
+
+// ParseChainMode validates a chain mode.
+func ParseChainMode(mode string) (ChainMode, error) {
+	switch ChainMode(mode) {
+	case StopOnError, ContinueOnError, AllOrNothing:
+		return ChainMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown chain mode %q, it must be %s, %s or %s", mode, StopOnError, ContinueOnError, AllOrNothing)
+}
+
+// chainModeOf returns the chain mode of the request, the ChainModeHeader
+// overrides the mode of the service.
+func chainModeOf(ctx context.Context, mode ChainMode) (ChainMode, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(ChainModeHeader)
+	if len(values) == 0 {
+		return mode, nil
+	}
+	mode, err := ParseChainMode(values[0])
+	if err != nil {
+		return "", rpcerrors.InvalidArgument(ChainModeHeader, "%s", err)
+	}
+	return mode, nil
+}
+
+// add appends the outcome of executor, undo is the state it replaced and err
+// is the status error it returned.
+func (c *ChainResult) add(executor string, response *pb.ExecuteResponse, undo json.RawMessage, err error) *ExecutorResult {
+	result := ExecutorResult{Executor: executor, Outcome: OutcomeSucceeded, undo: undo}
+	if c.DryRun {
+		result.Outcome = OutcomePlanned
+	}
+	if response != nil {
+		result.Data = response.Data
+	}
+	if err != nil {
+		result.Outcome = OutcomeFailed
+		result.Code = status.Code(err).String()
+		result.Error = status.Convert(err).Message()
+	}
+	c.Results = append(c.Results, result)
+	return &c.Results[len(c.Results)-1]
+}
+
+// failed returns the number of failed executors.
+func (c *ChainResult) failed() int {
+	count := 0
+	for _, result := range c.Results {
+		if result.Outcome == OutcomeFailed {
+			count++
+		}
+	}
+	return count
+}
+
+// rollback undoes the succeeded executors in reverse order, the executors which
+// changed nothing are left as they are. It runs within rollbackTimeout of a
+// context detached from the request, in the span of the request.
+func (c *ChainResult) rollback(ctx context.Context, message *pb.ExecuteMessage, clientsOf func(string) (*Clients, error)) {
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), rollbackTimeout)
+	defer cancel()
+	for idx := len(c.Results) - 1; idx >= 0; idx-- {
+		result := &c.Results[idx]
+		if result.Outcome != OutcomeSucceeded || result.undo == nil {
+			continue
+		}
+		err := rollbackExecutor(ctx, result.Executor, message, result.undo, clientsOf)
+		if err != nil {
+			klog.Errorf("ChainResult/rollback %s error: %s\n", result.Executor, err)
+			result.Outcome = OutcomeRollbackFailed
+			result.Code = status.Code(err).String()
+			result.Error = status.Convert(err).Message()
+			continue
+		}
+		result.Outcome = OutcomeRolledBack
+		klog.Infof("ChainResult/rollback %s rolled back\n", result.Executor)
+	}
+}
+
+func rollbackExecutor(ctx context.Context, name string, message *pb.ExecuteMessage, undo json.RawMessage, clientsOf func(string) (*Clients, error)) (err error) {
+	defer rpcerrors.Recover("rollback "+name, &err)
+	clients, err := clientsOf(name)
+	if err != nil {
+		return rpcerrors.FromError(name, err)
+	}
+	instance, _ := GetExecutor(name)
+	return rpcerrors.FromError(name, instance.(Rollbacker).Rollback(WithClients(ctx, clients), clients.Config, message, undo))
+}
+
+// response returns the chain as the response data, or the first failure with
+// the chain in the ChainResultTrailer.
+func (c *ChainResult) response(ctx context.Context, firstErr error) (*pb.ExecuteResponse, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if firstErr == nil {
+		return &pb.ExecuteResponse{Data: string(data)}, nil
+	}
+	// the trailer can't be set outside of a grpc handler, such as in tests
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(ChainResultTrailer, string(data)))
+	if len(c.Results) == 1 {
+		return nil, firstErr
+	}
+	return nil, rpcerrors.Wrap(firstErr, "%d of %d executors failed in %s mode", c.failed(), len(c.Results), c.Mode)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wrapper
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/metrics"
+)
+
+// Clients are the api server clients of an executor, they're built once at
+// startup and shared by its requests.
+type Clients struct {
+	// Config is the config of the executor, its requests are measured and
+	// traced as the ones of the executor.
+	Config  *rest.Config
+	Dynamic dynamic.Interface
+	// Mapper maps kinds to resources, the discovery is cached and reset when a
+	// kind isn't found.
+	Mapper meta.RESTMapper
+}
+
+// NewClients builds the clients of every executor from cfg, they share the
+// same RESTMapper. The api server isn't reached until the clients are used.
+func NewClients(cfg *rest.Config, executors []string) (map[string]*Clients, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewShortcutExpander(
+		restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		discoveryClient,
+	)
+
+	clients := make(map[string]*Clients, len(executors))
+	for _, executor := range executors {
+		executorConfig := rest.CopyConfig(cfg)
+		executorConfig.Wrap(metrics.InstrumentRoundTripper(executor))
+		executorConfig.Wrap(tracing.RoundTripper)
+		dynamicClient, err := dynamic.NewForConfig(executorConfig)
+		if err != nil {
+			return nil, err
+		}
+		clients[executor] = &Clients{Config: executorConfig, Dynamic: dynamicClient, Mapper: mapper}
+	}
+	return clients, nil
+}
+
+type clientsKey struct{}
+
+// WithClients returns a context whose executors use clients instead of
+// building their own.
+func WithClients(ctx context.Context, clients *Clients) context.Context {
+	return context.WithValue(ctx, clientsKey{}, clients)
+}
+
+// ClientsFrom returns the clients set by WithClients.
+func ClientsFrom(ctx context.Context) (*Clients, bool) {
+	clients, ok := ctx.Value(clientsKey{}).(*Clients)
+	return clients, ok && clients != nil
+}
+
+// WithDynamicClient returns a context whose executors use client instead of
+// building one from their rest config, such as a fake client in tests.
+func WithDynamicClient(ctx context.Context, client dynamic.Interface) context.Context {
+	clients := &Clients{Dynamic: client}
+	if current, ok := ClientsFrom(ctx); ok {
+		copied := *current
+		copied.Dynamic = client
+		clients = &copied
+	}
+	return WithClients(ctx, clients)
+}
+
+// DynamicClient returns the client of the context, or a new client of cfg.
+func DynamicClient(ctx context.Context, cfg *rest.Config) (dynamic.Interface, error) {
+	if clients, ok := ClientsFrom(ctx); ok && clients.Dynamic != nil {
+		return clients.Dynamic, nil
+	}
+	return dynamic.NewForConfig(cfg)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wrapper
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/client-go/rest"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+// DryRunHeader is the grpc metadata key which, set to true, plans the
+// executors of a request instead of running them.
+const DryRunHeader = "arbiter-dry-run"
+
+// Planner is implemented by executors which can tell what Execute would do
+// without changing anything, they're required in dry-run mode. The data of the
+// response describes the plan.
+type Planner interface {
+	Plan(context.Context, *rest.Config, *pb.ExecuteMessage) (*pb.ExecuteResponse, error)
+}
+
+// dryRunOf tells if the request is a dry run, by the dry run of the service or
+// the DryRunHeader, which can't turn off the one of the service.
+func dryRunOf(ctx context.Context, dryRun bool) (bool, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(DryRunHeader)
+	if len(values) == 0 {
+		return dryRun, nil
+	}
+	enabled, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, rpcerrors.InvalidArgument(DryRunHeader, "invalid %s %q, it must be true or false", DryRunHeader, values[0])
+	}
+	return dryRun || enabled, nil
+}
@@ -18,18 +18,32 @@ package wrapper
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/executor-plugins/default-plugins/pkg/metrics"
 	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
 )
 
 type ExecuteServiceImpl struct {
 	pb.UnimplementedExecuteServer
+
+	config  *rest.Config
+	mode    ChainMode
+	dryRun  bool
+	lock    sync.Mutex
+	clients map[string]*Clients
 }
 
 var (
@@ -37,44 +51,158 @@ var (
 	kubeconfig                  = flag.String("kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 )
 
-func NewExecuteService() pb.ExecuteServer {
-	return new(ExecuteServiceImpl)
+// NewExecuteService creates the service of the registered executors, their
+// clients are built from config once and shared by the requests. The executors
+// of a message run in mode, and are planned instead when dryRun is set, unless
+// the metadata of a request overrides them.
+func NewExecuteService(config *rest.Config, mode ChainMode, dryRun bool) (pb.ExecuteServer, error) {
+	if _, err := ParseChainMode(string(mode)); err != nil {
+		return nil, err
+	}
+	clients, err := NewClients(config, Executors())
+	if err != nil {
+		return nil, err
+	}
+	return &ExecuteServiceImpl{config: config, mode: mode, dryRun: dryRun, clients: clients}, nil
 }
 
 func (e *ExecuteServiceImpl) Execute(ctx context.Context, message *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
-	klog.V(10).Infof("kubeconfig path: %s\n", *kubeconfig)
 	klog.V(4).Infof("ResourceName: %s, namespace: %s, exprval: %f, condval: %v, actionData: %v, executors: %v\n",
 		message.ResourceName, message.Namespace, message.ExprVal, message.CondVal, message.ActionData, message.Executors)
 	resourceBaseFormat := fmt.Sprintf("%s/%s/%s:%s", message.Group, message.Version, message.Resources, message.ResourceName)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("k8s.resource", resourceBaseFormat),
+		attribute.String("k8s.namespace.name", message.Namespace),
+		attribute.StringSlice("arbiter.executors", message.Executors),
+	)
 
 	if len(message.Executors) == 0 {
 		klog.Warningf("%s executor is empty, return..", resourceBaseFormat)
 		return &pb.ExecuteResponse{}, nil
 	}
-	var (
-		config   *rest.Config
-		err      error
-		response *pb.ExecuteResponse
+	mode, err := chainModeOf(ctx, e.mode)
+	if err != nil {
+		return nil, err
+	}
+	dryRun, err := dryRunOf(ctx, e.dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(message, mode, dryRun); err != nil {
+		klog.Warningf("%s invalid message: %s\n", resourceBaseFormat, err)
+		return nil, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("arbiter.chain_mode", string(mode)),
+		attribute.Bool("arbiter.dry_run", dryRun),
 	)
-	if *kubeconfig != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
-	} else {
-		config, err = rest.InClusterConfig()
+
+	chain := &ChainResult{Mode: mode, DryRun: dryRun, Results: make([]ExecutorResult, 0, len(message.Executors))}
+	var firstErr error
+	for _, executor := range message.Executors {
+		if firstErr != nil && mode != ContinueOnError {
+			chain.Results = append(chain.Results, ExecutorResult{Executor: executor, Outcome: OutcomeSkipped})
+			continue
+		}
+		// the state replaced by the executors is only needed to roll them back
+		withUndo := mode == AllOrNothing && !dryRun
+		response, undo, err := e.runExecutor(ctx, executor, message, dryRun, withUndo)
+		chain.add(executor, response, undo, err)
+		if err != nil {
+			klog.Errorf("%s run %s error: %s\n", resourceBaseFormat, executor, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	// a dry run changed nothing, so there is nothing to roll back
+	if firstErr != nil && mode == AllOrNothing && !dryRun {
+		chain.rollback(ctx, message, e.clientsOf)
+	}
+	return chain.response(ctx, firstErr)
+}
+
+// runExecutor runs an executor, or plans it in a dry run, with its clients in a
+// span, its error is converted to a status error and a panic is returned as an
+// Internal error. With withUndo the executor returns the state it replaced.
+func (e *ExecuteServiceImpl) runExecutor(ctx context.Context, executor string, message *pb.ExecuteMessage, dryRun, withUndo bool) (response *pb.ExecuteResponse, undo json.RawMessage, err error) {
+	instance, _ := GetExecutor(executor)
+	start := time.Now()
+	spanName := "executor.Execute"
+	if dryRun {
+		spanName = "executor.Plan"
+	}
+	ctx, span := tracing.Start(ctx, spanName, attribute.String("arbiter.executor", executor))
+	defer func() {
+		tracing.End(span, err)
+		metrics.ObserveExecution(executor, start, err)
+	}()
+	defer rpcerrors.Recover(executor, &err)
+	clients, err := e.clientsOf(executor)
+	if err != nil {
+		return nil, nil, rpcerrors.FromError(executor, err)
+	}
+	ctx = WithClients(ctx, clients)
+	switch {
+	case dryRun:
+		response, err = instance.(Planner).Plan(ctx, clients.Config, message)
+	case withUndo:
+		response, undo, err = instance.(Rollbacker).ExecuteWithUndo(ctx, clients.Config, message)
+	default:
+		response, err = instance.Execute(ctx, clients.Config, message)
+	}
+	return response, undo, rpcerrors.FromError(executor, err)
+}
+
+// clientsOf returns the clients of executor, the ones of an executor
+// registered after the service was created are built on first use.
+func (e *ExecuteServiceImpl) clientsOf(executor string) (*Clients, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if clients, ok := e.clients[executor]; ok {
+		return clients, nil
 	}
+	built, err := NewClients(e.config, []string{executor})
 	if err != nil {
-		klog.Fatalf("error when building kubeconfig: %s", err.Error())
+		return nil, fmt.Errorf("build the clients of executor %s error: %w", executor, err)
+	}
+	e.clients[executor] = built[executor]
+	return built[executor], nil
+}
+
+// validate checks the fields used by every executor, and that all executors
+// are registered, can be rolled back in AllOrNothing mode and planned in a dry
+// run, before any of them runs.
+func validate(message *pb.ExecuteMessage, mode ChainMode, dryRun bool) error {
+	if message.ResourceName == "" {
+		return rpcerrors.InvalidArgument("resource_name", "resource name is required")
+	}
+	if message.Version == "" {
+		return rpcerrors.InvalidArgument("version", "version of the resource is required")
+	}
+	if message.Resources == "" {
+		return rpcerrors.InvalidArgument("resources", "resources of the resource is required")
 	}
 	for _, executor := range message.Executors {
 		instance, ok := GetExecutor(executor)
 		if !ok {
-			klog.Warningf("%s executor is %s, don't match target 'resourceUpdater'", resourceBaseFormat, executor)
-			continue
+			return rpcerrors.NotFound("executor", executor, "executor %s isn't registered", executor)
 		}
-
-		if response, err = instance.Execute(ctx, config, message); err != nil {
-			klog.Errorf("%s run %s error: %s\n", resourceBaseFormat, executor, err)
-			break
+		if _, ok := instance.(Rollbacker); mode == AllOrNothing && !ok {
+			return rpcerrors.InvalidArgument("executors", "executor %s can't be rolled back in %s mode", executor, AllOrNothing)
 		}
+		if _, ok := instance.(Planner); dryRun && !ok {
+			return rpcerrors.InvalidArgument("executors", "executor %s can't be planned in a dry run", executor)
+		}
+	}
+	return nil
+}
+
+// RestConfig builds the config of the api server from --kubeconfig, or from the
+// service account when it's empty.
+func RestConfig() (*rest.Config, error) {
+	if *kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	}
-	return response, err
+	return rest.InClusterConfig()
 }
@@ -0,0 +1,604 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+
+	pb "github.com/kube-arbiter/arbiter/pkg/proto/lib/executor"
+)
+
+var podsResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// labeler sets the label named after it on the pod of the message, it fails
+// with an unavailable api server when failing is set, waits for the end of the
+// request when hanging is set, and fails to roll back when failingRollback is
+// set.
+type labeler struct {
+	name            string
+	failing         bool
+	hanging         bool
+	failingRollback bool
+	// rolledBack records the executors rolled back, in order.
+	rolledBack *[]string
+}
+
+func (l *labeler) Name() string {
+	return l.name
+}
+
+func (l *labeler) Execute(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	response, _, err := l.ExecuteWithUndo(ctx, cfg, message)
+	return response, err
+}
+
+func (l *labeler) Plan(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	if l.failing {
+		return nil, apierrors.NewServiceUnavailable(l.name)
+	}
+	return &pb.ExecuteResponse{Data: "set " + l.name}, nil
+}
+
+func (l *labeler) ExecuteWithUndo(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, json.RawMessage, error) {
+	if l.failing {
+		return nil, nil, apierrors.NewServiceUnavailable(l.name)
+	}
+	if l.hanging {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+	pods, pod, err := getPod(ctx, cfg, message)
+	if err != nil {
+		return nil, nil, err
+	}
+	labels := pod.GetLabels()
+	previous, ok := labels[l.name]
+	if ok && previous == "true" {
+		return &pb.ExecuteResponse{Data: "unchanged"}, nil, nil
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[l.name] = "true"
+	pod.SetLabels(labels)
+	if _, err := pods.Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		return nil, nil, err
+	}
+	undo, _ := json.Marshal(map[string]interface{}{"existed": ok, "value": previous})
+	return &pb.ExecuteResponse{Data: "updated"}, undo, nil
+}
+
+func (l *labeler) Rollback(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage, undo json.RawMessage) error {
+	*l.rolledBack = append(*l.rolledBack, l.name)
+	if l.failingRollback {
+		return apierrors.NewServiceUnavailable(l.name)
+	}
+	previous := struct {
+		Existed bool   `json:"existed"`
+		Value   string `json:"value"`
+	}{}
+	if err := json.Unmarshal(undo, &previous); err != nil {
+		return err
+	}
+	pods, pod, err := getPod(ctx, cfg, message)
+	if err != nil {
+		return err
+	}
+	labels := pod.GetLabels()
+	delete(labels, l.name)
+	if previous.Existed {
+		labels[l.name] = previous.Value
+	}
+	pod.SetLabels(labels)
+	_, err = pods.Update(ctx, pod, metav1.UpdateOptions{})
+	return err
+}
+
+func getPod(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (podsClient, *unstructured.Unstructured, error) {
+	// the fake client ignores the context, a real one fails when it's done
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	client, err := DynamicClient(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	pods := client.Resource(podsResource).Namespace(message.Namespace)
+	pod, err := pods.Get(ctx, message.ResourceName, metav1.GetOptions{})
+	return pods, pod, err
+}
+
+type podsClient interface {
+	Update(context.Context, *unstructured.Unstructured, metav1.UpdateOptions, ...string) (*unstructured.Unstructured, error)
+}
+
+// plain can't be planned nor rolled back.
+type plain struct{}
+
+func (plain) Name() string {
+	return "test-plain"
+}
+
+func (plain) Execute(context.Context, *rest.Config, *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	return &pb.ExecuteResponse{Data: "done"}, nil
+}
+
+// panicking panics in Execute.
+type panicking struct{ labeler }
+
+func (p *panicking) ExecuteWithUndo(context.Context, *rest.Config, *pb.ExecuteMessage) (*pb.ExecuteResponse, json.RawMessage, error) {
+	panic("boom")
+}
+
+func (p *panicking) Execute(ctx context.Context, cfg *rest.Config, message *pb.ExecuteMessage) (*pb.ExecuteResponse, error) {
+	response, _, err := p.ExecuteWithUndo(ctx, cfg, message)
+	return response, err
+}
+
+var (
+	registerOnce sync.Once
+	rolledBack   []string
+)
+
+// registerTestExecutors registers the executors of the tests once, the
+// registry is global.
+func registerTestExecutors() {
+	registerOnce.Do(func() {
+		Register("test-a", &labeler{name: "test-a", rolledBack: &rolledBack})
+		Register("test-b", &labeler{name: "test-b", rolledBack: &rolledBack})
+		Register("test-c", &labeler{name: "test-c", failingRollback: true, rolledBack: &rolledBack})
+		Register("test-failing", &labeler{name: "test-failing", failing: true, rolledBack: &rolledBack})
+		Register("test-hanging", &labeler{name: "test-hanging", hanging: true, rolledBack: &rolledBack})
+		Register("test-panicking", &panicking{labeler{name: "test-panicking", rolledBack: &rolledBack}})
+		Register("test-plain", plain{})
+	})
+}
+
+// newTestService returns a service whose executors share the fake client of
+// the pod web-0, which has the labels.
+func newTestService(t *testing.T, mode ChainMode, dryRun bool, labels map[string]string) (*ExecuteServiceImpl, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	registerTestExecutors()
+	rolledBack = nil
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("web-0")
+	pod.SetLabels(labels)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{podsResource: "PodList"}, pod)
+
+	clients := map[string]*Clients{}
+	for _, name := range Executors() {
+		clients[name] = &Clients{Dynamic: client}
+	}
+	// the executors must not reach a real api server
+	config := &rest.Config{Host: "http://127.0.0.1:1"}
+	return &ExecuteServiceImpl{config: config, mode: mode, dryRun: dryRun, clients: clients}, client
+}
+
+func podLabels(t *testing.T, client *dynamicfake.FakeDynamicClient) map[string]string {
+	t.Helper()
+	pod, err := client.Resource(podsResource).Namespace("default").Get(context.Background(), "web-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pod.GetLabels()
+}
+
+func message(executors ...string) *pb.ExecuteMessage {
+	return &pb.ExecuteMessage{ResourceName: "web-0", Namespace: "default", Version: "v1", Resources: "pods", CondVal: true, Executors: executors}
+}
+
+// trailerStream captures the trailer set by a handler, as the grpc server
+// does.
+type trailerStream struct {
+	trailer metadata.MD
+}
+
+func (s *trailerStream) Method() string {
+	return "/executor.Execute/Execute"
+}
+
+func (s *trailerStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *trailerStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *trailerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+// execute runs the message on the service, and returns the chain result of the
+// response, or of the trailer when it failed.
+func execute(t *testing.T, ctx context.Context, service *ExecuteServiceImpl, message *pb.ExecuteMessage) (*pb.ExecuteResponse, ChainResult, error) {
+	t.Helper()
+	stream := &trailerStream{}
+	response, err := service.Execute(grpc.NewContextWithServerTransportStream(ctx, stream), message)
+	data := ""
+	if err == nil {
+		data = response.Data
+	} else if values := stream.trailer.Get(ChainResultTrailer); len(values) > 0 {
+		data = values[0]
+	}
+	chain := ChainResult{}
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &chain); err != nil {
+			t.Fatalf("invalid chain result %q: %s", data, err)
+		}
+	}
+	return response, chain, err
+}
+
+// outcomes returns the outcome of every executor of the chain.
+func outcomes(chain ChainResult) []Outcome {
+	var got []Outcome
+	for _, result := range chain.Results {
+		got = append(got, result.Outcome)
+	}
+	return got
+}
+
+func TestExecuteChainModes(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           ChainMode
+		executors      []string
+		labels         map[string]string
+		wantCode       codes.Code
+		wantOutcomes   []Outcome
+		wantLabels     map[string]string
+		wantRolledBack []string
+	}{
+		{
+			name:         "stop on error succeeds",
+			mode:         StopOnError,
+			executors:    []string{"test-a", "test-b"},
+			wantOutcomes: []Outcome{OutcomeSucceeded, OutcomeSucceeded},
+			wantLabels:   map[string]string{"test-a": "true", "test-b": "true"},
+		},
+		{
+			name:         "stop on error skips the next executors",
+			mode:         StopOnError,
+			executors:    []string{"test-a", "test-failing", "test-b"},
+			wantCode:     codes.Unavailable,
+			wantOutcomes: []Outcome{OutcomeSucceeded, OutcomeFailed, OutcomeSkipped},
+			wantLabels:   map[string]string{"test-a": "true"},
+		},
+		{
+			name:         "continue on error runs every executor",
+			mode:         ContinueOnError,
+			executors:    []string{"test-a", "test-failing", "test-b"},
+			wantCode:     codes.Unavailable,
+			wantOutcomes: []Outcome{OutcomeSucceeded, OutcomeFailed, OutcomeSucceeded},
+			wantLabels:   map[string]string{"test-a": "true", "test-b": "true"},
+		},
+		{
+			name:           "all or nothing rolls back in reverse order",
+			mode:           AllOrNothing,
+			executors:      []string{"test-a", "test-b", "test-failing"},
+			labels:         map[string]string{"app": "web"},
+			wantCode:       codes.Unavailable,
+			wantOutcomes:   []Outcome{OutcomeRolledBack, OutcomeRolledBack, OutcomeFailed},
+			wantLabels:     map[string]string{"app": "web"},
+			wantRolledBack: []string{"test-b", "test-a"},
+		},
+		{
+			name:           "all or nothing restores the previous value",
+			mode:           AllOrNothing,
+			executors:      []string{"test-a", "test-failing"},
+			labels:         map[string]string{"test-a": "false"},
+			wantCode:       codes.Unavailable,
+			wantOutcomes:   []Outcome{OutcomeRolledBack, OutcomeFailed},
+			wantLabels:     map[string]string{"test-a": "false"},
+			wantRolledBack: []string{"test-a"},
+		},
+		{
+			name:           "all or nothing doesn't roll back unchanged executors",
+			mode:           AllOrNothing,
+			executors:      []string{"test-a", "test-b", "test-failing"},
+			labels:         map[string]string{"test-a": "true"},
+			wantCode:       codes.Unavailable,
+			wantOutcomes:   []Outcome{OutcomeSucceeded, OutcomeRolledBack, OutcomeFailed},
+			wantLabels:     map[string]string{"test-a": "true"},
+			wantRolledBack: []string{"test-b"},
+		},
+		{
+			name:           "all or nothing reports a failed rollback",
+			mode:           AllOrNothing,
+			executors:      []string{"test-a", "test-c", "test-failing"},
+			wantCode:       codes.Unavailable,
+			wantOutcomes:   []Outcome{OutcomeRolledBack, OutcomeRollbackFailed, OutcomeFailed},
+			wantLabels:     map[string]string{"test-c": "true"},
+			wantRolledBack: []string{"test-c", "test-a"},
+		},
+		{
+			name:      "all or nothing requires rollbackers",
+			mode:      AllOrNothing,
+			executors: []string{"test-a", "test-plain"},
+			wantCode:  codes.InvalidArgument,
+		},
+		{
+			name:      "unknown executor",
+			mode:      StopOnError,
+			executors: []string{"test-a", "test-missing"},
+			wantCode:  codes.NotFound,
+		},
+		{
+			name:         "a panic is an internal error",
+			mode:         StopOnError,
+			executors:    []string{"test-panicking"},
+			wantCode:     codes.Internal,
+			wantOutcomes: []Outcome{OutcomeFailed},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, client := newTestService(t, test.mode, false, test.labels)
+			_, chain, err := execute(t, context.Background(), service, message(test.executors...))
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("Execute() error = %v, want code %s", err, test.wantCode)
+			}
+			if got := outcomes(chain); !reflect.DeepEqual(got, test.wantOutcomes) {
+				t.Errorf("Execute() outcomes = %v, want %v", got, test.wantOutcomes)
+			}
+			if test.wantOutcomes != nil && chain.Mode != test.mode {
+				t.Errorf("Execute() mode = %s, want %s", chain.Mode, test.mode)
+			}
+			if labels := podLabels(t, client); !equalLabels(labels, test.wantLabels) {
+				t.Errorf("labels = %v, want %v", labels, test.wantLabels)
+			}
+			if !reflect.DeepEqual(rolledBack, test.wantRolledBack) {
+				t.Errorf("rolled back %v, want %v", rolledBack, test.wantRolledBack)
+			}
+		})
+	}
+}
+
+// equalLabels compares labels, nil and empty labels are equal.
+func equalLabels(a, b map[string]string) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+func TestExecuteRollbackAfterDeadline(t *testing.T) {
+	service, client := newTestService(t, AllOrNothing, false, map[string]string{"app": "web"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, chain, err := execute(t, ctx, service, message("test-a", "test-b", "test-hanging"))
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Fatalf("Execute() error = %v, want code %s", err, codes.DeadlineExceeded)
+	}
+	want := []Outcome{OutcomeRolledBack, OutcomeRolledBack, OutcomeFailed}
+	if got := outcomes(chain); !reflect.DeepEqual(got, want) {
+		t.Errorf("Execute() outcomes = %v, want %v", got, want)
+	}
+	if labels, want := podLabels(t, client), map[string]string{"app": "web"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+}
+
+func TestExecuteChainResult(t *testing.T) {
+	service, _ := newTestService(t, ContinueOnError, false, nil)
+	_, chain, err := execute(t, context.Background(), service, message("test-a", "test-failing", "test-b"))
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Fatalf("Execute() error = %v, want code %s", err, codes.Unavailable)
+	}
+	if want := "1 of 3 executors failed in continue-on-error mode"; !strings.Contains(status.Convert(err).Message(), want) {
+		t.Errorf("Execute() error = %v, want %q", err, want)
+	}
+	want := ChainResult{Mode: ContinueOnError, Results: []ExecutorResult{
+		{Executor: "test-a", Outcome: OutcomeSucceeded, Data: "updated"},
+		{Executor: "test-failing", Outcome: OutcomeFailed, Code: codes.Unavailable.String(), Error: chain.Results[1].Error},
+		{Executor: "test-b", Outcome: OutcomeSucceeded, Data: "updated"},
+	}}
+	if !reflect.DeepEqual(chain, want) || chain.Results[1].Error == "" {
+		t.Errorf("Execute() chain = %+v, want %+v", chain, want)
+	}
+}
+
+func TestExecuteChainModeHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         string
+		wantCode       codes.Code
+		wantRolledBack []string
+	}{
+		{
+			name:           "the header overrides the mode of the service",
+			header:         string(AllOrNothing),
+			wantCode:       codes.Unavailable,
+			wantRolledBack: []string{"test-a"},
+		},
+		{
+			name:     "invalid header",
+			header:   "best-effort",
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, _ := newTestService(t, StopOnError, false, nil)
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ChainModeHeader, test.header))
+			_, _, err := execute(t, ctx, service, message("test-a", "test-failing"))
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("Execute() error = %v, want code %s", err, test.wantCode)
+			}
+			if !reflect.DeepEqual(rolledBack, test.wantRolledBack) {
+				t.Errorf("rolled back %v, want %v", rolledBack, test.wantRolledBack)
+			}
+		})
+	}
+}
+
+func TestExecuteDryRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		dryRun       bool
+		header       string
+		executors    []string
+		wantCode     codes.Code
+		wantDryRun   bool
+		wantOutcomes []Outcome
+	}{
+		{
+			name:         "dry run of the service",
+			dryRun:       true,
+			executors:    []string{"test-a", "test-b"},
+			wantDryRun:   true,
+			wantOutcomes: []Outcome{OutcomePlanned, OutcomePlanned},
+		},
+		{
+			name:         "dry run of the request",
+			header:       "true",
+			executors:    []string{"test-a"},
+			wantDryRun:   true,
+			wantOutcomes: []Outcome{OutcomePlanned},
+		},
+		{
+			name:         "a request can't turn off the dry run of the service",
+			dryRun:       true,
+			header:       "false",
+			executors:    []string{"test-a"},
+			wantDryRun:   true,
+			wantOutcomes: []Outcome{OutcomePlanned},
+		},
+		{
+			name:      "invalid header",
+			header:    "maybe",
+			executors: []string{"test-a"},
+			wantCode:  codes.InvalidArgument,
+		},
+		{
+			name:      "executors must be planners",
+			dryRun:    true,
+			executors: []string{"test-a", "test-plain"},
+			wantCode:  codes.InvalidArgument,
+		},
+		{
+			name:         "a failed plan isn't rolled back",
+			dryRun:       true,
+			executors:    []string{"test-a", "test-failing"},
+			wantCode:     codes.Unavailable,
+			wantDryRun:   true,
+			wantOutcomes: []Outcome{OutcomePlanned, OutcomeFailed},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, client := newTestService(t, AllOrNothing, test.dryRun, nil)
+			ctx := context.Background()
+			if test.header != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(DryRunHeader, test.header))
+			}
+			_, chain, err := execute(t, ctx, service, message(test.executors...))
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("Execute() error = %v, want code %s", err, test.wantCode)
+			}
+			if got := outcomes(chain); chain.DryRun != test.wantDryRun || !reflect.DeepEqual(got, test.wantOutcomes) {
+				t.Errorf("Execute() dry run %t outcomes = %v, want %t %v", chain.DryRun, got, test.wantDryRun, test.wantOutcomes)
+			}
+			if labels := podLabels(t, client); len(labels) != 0 {
+				t.Errorf("dry run changed the labels to %v", labels)
+			}
+			if len(rolledBack) != 0 {
+				t.Errorf("dry run rolled back %v", rolledBack)
+			}
+		})
+	}
+}
+
+func TestExecuteValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *pb.ExecuteMessage
+	}{
+		{name: "resource name", message: &pb.ExecuteMessage{Version: "v1", Resources: "pods", Executors: []string{"test-a"}}},
+		{name: "version", message: &pb.ExecuteMessage{ResourceName: "web-0", Resources: "pods", Executors: []string{"test-a"}}},
+		{name: "resources", message: &pb.ExecuteMessage{ResourceName: "web-0", Version: "v1", Executors: []string{"test-a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, _ := newTestService(t, StopOnError, false, nil)
+			_, err := service.Execute(context.Background(), test.message)
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Errorf("Execute() error = %v, want code %s", err, codes.InvalidArgument)
+			}
+		})
+	}
+
+	service, _ := newTestService(t, StopOnError, false, nil)
+	response, err := service.Execute(context.Background(), message())
+	if err != nil || response.Data != "" {
+		t.Errorf("Execute() of no executor = %v, %v, want an empty response", response, err)
+	}
+}
+
+func TestNewExecuteService(t *testing.T) {
+	registerTestExecutors()
+	config := &rest.Config{Host: "http://127.0.0.1:1"}
+	if _, err := NewExecuteService(config, "best-effort", false); err == nil {
+		t.Error("NewExecuteService() of an unknown chain mode succeeded")
+	}
+	service, err := NewExecuteService(config, StopOnError, false)
+	if err != nil {
+		t.Fatalf("NewExecuteService() error = %v", err)
+	}
+	impl := service.(*ExecuteServiceImpl)
+	first, err := impl.clientsOf("test-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := impl.clientsOf("test-a"); second != first {
+		t.Error("the clients of an executor are rebuilt")
+	}
+	other, _ := impl.clientsOf("test-b")
+	if other.Mapper != first.Mapper || other.Dynamic == first.Dynamic || other.Config == first.Config {
+		t.Error("the executors don't share the mapper only")
+	}
+
+	Register("test-late", plain{})
+	late, err := impl.clientsOf("test-late")
+	if err != nil || late == nil {
+		t.Fatalf("clients of an executor registered later = %v, %v", late, err)
+	}
+	if again, _ := impl.clientsOf("test-late"); again != late {
+		t.Error("the clients of an executor registered later are rebuilt")
+	}
+}
@@ -18,6 +18,7 @@ package wrapper
 
 import (
 	"context"
+	"sort"
 	"sync"
 
 	"k8s.io/client-go/rest"
@@ -31,6 +32,12 @@ type Executor interface {
 	Execute(context.Context, *rest.Config, *pb.ExecuteMessage) (*pb.ExecuteResponse, error)
 }
 
+// Prober is implemented by executors that depend on more than the api server,
+// the health service uses it to check their backend.
+type Prober interface {
+	Probe(context.Context, *rest.Config) error
+}
+
 var (
 	once         sync.Once
 	mustRegister map[string]Executor
@@ -52,3 +59,13 @@ func GetExecutor(name string) (Executor, bool) {
 	v, ok := mustRegister[name]
 	return v, ok
 }
+
+// Executors returns the names of the registered executors in order.
+func Executors() []string {
+	names := make([]string, 0, len(mustRegister))
+	for name := range mustRegister {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
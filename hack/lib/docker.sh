@@ -22,7 +22,7 @@ function docker::build() {
 			--build-arg ="${target}" \
 			--tag "${image_name}" \
 			--file "${ROOT_PATH}/${DOCKERFILE_PATH[${target}]}" \
-			"${ROOT_PATH}/${CODE_PATH[$target]}"
+			"${ROOT_PATH}"
 		set +x
 	done
 }
@@ -14,6 +14,10 @@ declare -A CODE_MAIN_PATH=(
 	["executor-default-plugins"]="cmd/server/server.go"
 )
 
+# MODULE_PATH lists every go module, common holds the packages shared by the
+# plugin servers.
+MODULE_PATH=(common "${CODE_PATH[@]}")
+
 declare -A DOCKERFILE_PATH=(
 	["observer-default-plugins"]="observer-plugins/default-plugins/Dockerfile"
 	["executor-default-plugins"]="executor-plugins/default-plugins/Dockerfile"
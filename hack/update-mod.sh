@@ -7,7 +7,7 @@ set -o pipefail
 ROOT_PATH=$(dirname "${BASH_SOURCE[0]}")/..
 source "${ROOT_PATH}/hack/lib/init.sh"
 
-for path in "${CODE_PATH[@]}"; do
+for path in "${MODULE_PATH[@]}"; do
 	echo "in $path run go mod tidy"
 	cd $path && go mod tidy && cd -
 done
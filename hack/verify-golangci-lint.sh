@@ -15,7 +15,7 @@ cd "${ROOT_PATH}"
 
 echo "running golangci-lint"
 
-for path in "${CODE_PATH[@]}"; do
+for path in "${MODULE_PATH[@]}"; do
 	if (cd $path && golangci-lint run ./... && cd -); then
 		echo "in $path golangci-lint verified."
 	else
@@ -17,63 +17,26 @@ limitations under the License.
 package main
 
 import (
-	"net"
+	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"google.golang.org/grpc"
-	"k8s.io/klog/v2"
-
-	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg"
 	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
-	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
-
-	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/install"
-)
-
-var (
-	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/install"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk"
 )
 
 func main() {
-	_, err := os.Stat(*flags.Endpoint)
-	if err != nil && !os.IsNotExist(err) {
-		klog.Fatalln(err)
-	}
-	os.Remove(*flags.Endpoint)
-
-	SetupSignalHandler(*flags.Endpoint)
-	server := grpc.NewServer()
-	obi.RegisterServerServer(server, pkg.NewServer())
-
-	listen, err := net.Listen("unix", *flags.Endpoint)
-	if err != nil {
-		klog.Fatal(err)
-	}
-
-	klog.Infof("Observer plugin started ...\n")
-	klog.Fatalln(server.Serve(listen))
-}
-
-// SetupSignalHandler registered for SIGTERM and SIGINT. A stop channel is returned
-// which is closed on one of these signals. If a second signal is caught, the program
-// is terminated with exit code 1.
-func SetupSignalHandler(socketFile string) {
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, shutdownSignals...)
-	go func() {
-		for s := range c {
-			switch s {
-			case os.Interrupt, syscall.SIGTERM:
-				klog.Infoln("Shutting down normally...")
-				if err := os.RemoveAll(socketFile); err != nil {
-					klog.Fatal(err)
-				}
-				os.Exit(1)
-			default:
-				klog.Infoln("Got signal", s)
-			}
+	flag.Parse()
+	sdk.Main(flags.Server, func(ctx context.Context) error {
+		if err := install.Setup(ctx); err != nil {
+			return err
 		}
-	}()
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go install.Watch(ctx, *flags.Config, *flags.ConfigReloadInterval, reload)
+		return nil
+	})
 }
@@ -0,0 +1,189 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/transport"
+	"sigs.k8s.io/yaml"
+)
+
+// Config declares the observer plugin instances served by the server, for
+// example:
+//
+//	plugins:
+//	- name: prometheus
+//	  type: prometheus
+//	  address: http://prometheus.monitoring:9090
+//	  step: 30s
+//	- name: thanos
+//	  type: prometheus
+//	  address: https://thanos.example.com
+//	  step: 5m
+//	  timeout: 1m
+//	  limits:
+//	    maxConcurrent: 4
+//	    qps: 2
+//	  auth:
+//	    bearerTokenFile: /etc/thanos/token
+//	- name: metrics-server
+//	  type: metrics-server
+//	  required: true
+//	- name: loki
+//	  type: loki
+//	  enabled: false
+//
+// Every instance is registered under its own name, which is the source name
+// used by the ObservabilityIndicant.
+type Config struct {
+	Plugins []PluginConfig `json:"plugins"`
+}
+
+type PluginConfig struct {
+	// Name is the source name of the instance, it must be unique.
+	Name string `json:"name"`
+	// Type is the plugin type, such as prometheus or metrics-server.
+	Type string `json:"type"`
+	// Enabled defaults to true.
+	Enabled *bool `json:"enabled,omitempty"`
+	// Required plugins must start, otherwise the server exits in strict mode.
+	Required bool            `json:"required,omitempty"`
+	Address  string          `json:"address,omitempty"`
+	Step     metav1.Duration `json:"step,omitempty"`
+	// Timeout bounds every backend call of the instance, it defaults to
+	// --source-timeout. The composite and failover instances are only bounded
+	// by the timeouts of their sources by default.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// Limits bounds the requests sent to the backend, the fields left empty
+	// default to the --source-* flags.
+	Limits *Limits `json:"limits,omitempty"`
+	Auth   *Auth   `json:"auth,omitempty"`
+	// Options holds the settings only known by the plugin type.
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// Limits holds the concurrency and rate limits of an instance.
+type Limits struct {
+	MaxConcurrent int             `json:"maxConcurrent,omitempty"`
+	QPS           float64         `json:"qps,omitempty"`
+	Burst         int             `json:"burst,omitempty"`
+	MaxWait       metav1.Duration `json:"maxWait,omitempty"`
+}
+
+// Auth holds the credentials and tls settings used to reach the backend.
+type Auth struct {
+	BearerToken        string `json:"bearerToken,omitempty"`
+	BearerTokenFile    string `json:"bearerTokenFile,omitempty"`
+	Username           string `json:"username,omitempty"`
+	Password           string `json:"password,omitempty"`
+	PasswordFile       string `json:"passwordFile,omitempty"`
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// Load reads and validates the config file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s error: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Default returns the config used without a config file, it has one instance
+// of each plugin type named after the type and configured by the flags.
+func Default(types []string) *Config {
+	cfg := &Config{Plugins: make([]PluginConfig, 0, len(types))}
+	for _, t := range types {
+		cfg.Plugins = append(cfg.Plugins, PluginConfig{Name: t, Type: t})
+	}
+	return cfg
+}
+
+func (c *Config) Validate() error {
+	names := map[string]struct{}{}
+	for idx, plugin := range c.Plugins {
+		if plugin.Name == "" {
+			return fmt.Errorf("plugins[%d] has no name", idx)
+		}
+		if plugin.Type == "" {
+			return fmt.Errorf("plugin %s has no type", plugin.Name)
+		}
+		if _, ok := names[plugin.Name]; ok {
+			return fmt.Errorf("plugin name %s is duplicated", plugin.Name)
+		}
+		names[plugin.Name] = struct{}{}
+	}
+	return nil
+}
+
+func (p *PluginConfig) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// DecodeOptions decodes the plugin options into the given struct, unknown
+// fields are rejected.
+func (p *PluginConfig) DecodeOptions(into interface{}) error {
+	if len(p.Options) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(p.Options))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(into); err != nil {
+		return fmt.Errorf("invalid options of plugin %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// TransportConfig converts the auth settings to a client-go transport config.
+func (a *Auth) TransportConfig() (*transport.Config, error) {
+	cfg := &transport.Config{
+		BearerToken:     a.BearerToken,
+		BearerTokenFile: a.BearerTokenFile,
+		Username:        a.Username,
+		Password:        a.Password,
+		TLS: transport.TLSConfig{
+			CAFile:   a.CAFile,
+			CertFile: a.CertFile,
+			KeyFile:  a.KeyFile,
+			Insecure: a.InsecureSkipVerify,
+		},
+	}
+	if a.PasswordFile != "" {
+		password, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = strings.TrimSpace(string(password))
+	}
+	return cfg, nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func duration(d time.Duration) metav1.Duration {
+	return metav1.Duration{Duration: d}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		want      []PluginConfig
+		wantError string
+	}{
+		{
+			name: "valid",
+			content: `plugins:
+- name: thanos
+  type: prometheus
+  address: https://thanos.example.com
+  step: 5m
+  timeout: 1m
+  limits:
+    maxConcurrent: 4
+    qps: 2
+  options:
+    anything: kept
+- name: loki
+  type: loki
+  enabled: false
+`,
+			want: []PluginConfig{
+				{
+					Name: "thanos", Type: "prometheus", Address: "https://thanos.example.com",
+					Step:    duration(5 * time.Minute),
+					Timeout: duration(time.Minute),
+					Limits:  &Limits{MaxConcurrent: 4, QPS: 2},
+					// the options are decoded by the plugin type
+					Options: []byte(`{"anything":"kept"}`),
+				},
+				{Name: "loki", Type: "loki", Enabled: new(bool)},
+			},
+		},
+		{
+			name:      "unknown top level field",
+			content:   "plugin:\n- name: prometheus\n  type: prometheus\n",
+			wantError: `unknown field "plugin"`,
+		},
+		{
+			name:      "unknown plugin field",
+			content:   "plugins:\n- name: prometheus\n  type: prometheus\n  adress: http://prometheus:9090\n",
+			wantError: `unknown field "adress"`,
+		},
+		{
+			name:      "unknown limits field",
+			content:   "plugins:\n- name: prometheus\n  type: prometheus\n  limits:\n    maxConcurrency: 4\n",
+			wantError: `unknown field "maxConcurrency"`,
+		},
+		{
+			name:      "duplicated key",
+			content:   "plugins:\n- name: prometheus\n  name: thanos\n  type: prometheus\n",
+			wantError: `key "name" already set`,
+		},
+		{
+			name:      "invalid duration",
+			content:   "plugins:\n- name: prometheus\n  type: prometheus\n  step: often\n",
+			wantError: "often",
+		},
+		{
+			name:      "invalid yaml",
+			content:   "plugins: [",
+			wantError: "parse config",
+		},
+		{
+			name:      "plugin without name",
+			content:   "plugins:\n- type: prometheus\n",
+			wantError: "plugins[0] has no name",
+		},
+		{
+			name:      "plugin without type",
+			content:   "plugins:\n- name: prometheus\n",
+			wantError: "plugin prometheus has no type",
+		},
+		{
+			name:      "duplicated plugin name",
+			content:   "plugins:\n- name: prometheus\n  type: prometheus\n- name: prometheus\n  type: loki\n",
+			wantError: "plugin name prometheus is duplicated",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, test.content))
+			if test.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantError) {
+					t.Fatalf("Load() error = %v, want %q", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Plugins, test.want) {
+				t.Errorf("Load() = %+v, want %+v", cfg.Plugins, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	type options struct {
+		OrgID string `json:"orgID"`
+	}
+	tests := []struct {
+		name    string
+		options string
+		want    options
+		wantErr bool
+	}{
+		{name: "no options", want: options{}},
+		{name: "known field", options: `{"orgID":"team-a"}`, want: options{OrgID: "team-a"}},
+		{name: "unknown field", options: `{"org":"team-a"}`, wantErr: true},
+		{name: "wrong type", options: `{"orgID":1}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plugin := PluginConfig{Name: "loki", Options: []byte(test.options)}
+			got := options{}
+			if err := plugin.DecodeOptions(&got); (err != nil) != test.wantErr {
+				t.Fatalf("DecodeOptions() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && got != test.want {
+				t.Errorf("DecodeOptions() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransportConfig(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		auth         Auth
+		wantPassword string
+		wantErr      bool
+	}{
+		{name: "inline password", auth: Auth{Username: "admin", Password: "inline"}, wantPassword: "inline"},
+		{name: "password file is trimmed", auth: Auth{Username: "admin", PasswordFile: passwordFile}, wantPassword: "secret"},
+		{name: "missing password file", auth: Auth{PasswordFile: filepath.Join(t.TempDir(), "missing")}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := test.auth.TransportConfig()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("TransportConfig() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && cfg.Password != test.wantPassword {
+				t.Errorf("TransportConfig() password = %q, want %q", cfg.Password, test.wantPassword)
+			}
+		})
+	}
+}
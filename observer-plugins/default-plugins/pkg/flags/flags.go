@@ -18,19 +18,68 @@ package flags
 
 import (
 	"flag"
+	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk"
 )
 
+// Server holds the flags of the grpc server.
+var Server = sdk.NewOptions("observer-default-plugins")
+
 // NOTE: if your metric resource need some paramer, please define it here.
 var (
-	Kubeconfig  = flag.String("kubeconfig", "", "kubernetes auth config file")
-	Address     = flag.String("address", "", "prometheus server, such as http://localhost:9090")
-	StepSeconds = flag.Int64("step", 60, "query steps")
-	Endpoint    = flag.String("endpoint", "/var/run/observer.sock", "unix socket domain for current server")
+	Kubeconfig           = flag.String("kubeconfig", "", "kubernetes auth config file")
+	Address              = flag.String("address", "", "prometheus server, such as http://localhost:9090")
+	StepSeconds          = flag.Int64("step", 60, "query steps")
+	Config               = flag.String("config", "", "yaml file declaring the plugin instances, the flags of each plugin are used when it's empty")
+	Strict               = flag.Bool("strict", false, "exit with non-zero code when a required plugin can't start or no plugin starts")
+	ConfigReloadInterval = flag.Duration("config-reload-interval", 10*time.Second, "interval to check the --config file for changes, 0 disables it, SIGHUP always reloads")
+	SourceTimeout        = flag.Duration("source-timeout", 30*time.Second, "default timeout of the backend calls of each source, overridden by the timeout of the plugin config")
+	SourceMaxConcurrent  = flag.Int("source-max-concurrent", 0, "default number of requests sent to the backend of each source at once, 0 is unlimited")
+	SourceQPS            = flag.Float64("source-qps", 0, "default rate of requests sent to the backend of each source, 0 is unlimited")
+	SourceBurst          = flag.Int("source-burst", 0, "default burst of --source-qps, it defaults to the qps rounded up")
+	SourceMaxWait        = flag.Duration("source-max-wait", time.Second, "default time a request is queued over the limits of a source before it's rejected")
+
+	ScrapeTimeout   = flag.Duration("scrape-timeout", 10*time.Second, "timeout of a single scrape of a pod metrics endpoint")
+	ScrapeMaxBytes  = flag.Int64("scrape-max-bytes", 10<<20, "maximum size of a scraped metrics response body")
+	ScrapeSampleTTL = flag.Duration("scrape-sample-ttl", 10*time.Minute, "time the previous sample of a series is kept to compute its rate, older samples are dropped")
+
+	HTTPJSONURL              = flag.String("http-json-url", "", "url template of the http-json plugin, {{.Namespace}}, {{.Name}}, {{.Kind}} and {{.MetricName}} are filled from the request, path escaped or query escaped after the '?'")
+	HTTPJSONHeaders          = &StringSlice{}
+	HTTPJSONBearerTokenFile  = flag.String("http-json-bearer-token-file", "", "file containing the bearer token sent by the http-json plugin")
+	HTTPJSONUsername         = flag.String("http-json-username", "", "basic auth username of the http-json plugin")
+	HTTPJSONPasswordFile     = flag.String("http-json-password-file", "", "file containing the basic auth password of the http-json plugin")
+	HTTPJSONCAFile           = flag.String("http-json-ca-file", "", "CA bundle used to verify the server certificate of the http-json plugin")
+	HTTPJSONTimeout          = flag.Duration("http-json-timeout", 5*time.Second, "timeout of a single request of the http-json plugin")
+	HTTPJSONMaxResponseBytes = flag.Int64("http-json-max-response-bytes", 1<<20, "maximum size of a response body read by the http-json plugin")
+
+	CostPriceTable = flag.String("cost-price-table", "", "yaml file with the cpu and memory prices per node label of the cost plugin")
+
+	LokiAddress          = flag.String("loki-address", "", "loki server, such as http://localhost:3100")
+	LokiOrgID            = flag.String("loki-org-id", "", "tenant sent in the X-Scope-OrgID header of loki queries")
+	LokiStepSeconds      = flag.Int64("loki-step", 60, "loki query steps")
+	LokiMaxResponseBytes = flag.Int64("loki-max-response-bytes", 10<<20, "maximum size of a loki query response body")
+
+	FailoverSources = flag.String("failover-sources", "", "comma separated sources tried in order by the failover plugin, such as prometheus,metrics-server")
 )
 
+// StringSlice is a flag value that can be given multiple times.
+type StringSlice []string
+
+func (s *StringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *StringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func init() {
+	Server.AddFlags(flag.CommandLine)
+	flag.Var(HTTPJSONHeaders, "http-json-header", "'Name: value' header sent by the http-json plugin, can be repeated")
 	klog.InitFlags(flag.CommandLine)
-	flag.Parse()
 }
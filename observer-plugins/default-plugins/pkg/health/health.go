@@ -0,0 +1,134 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+)
+
+// Checker serves grpc.health.v1 with one service per registered plugin, named
+// after the source, whose status follows the probe of the plugin backend. The
+// status of the whole server, the empty service name, is SERVING as long as
+// one plugin with a backend of its own is serving, the composite and failover
+// plugins only forward the requests to the other plugins.
+type Checker struct {
+	server   *health.Server
+	interval time.Duration
+	timeout  time.Duration
+
+	// known are the sources of the last check, the sources removed by a reload
+	// are reported as SERVICE_UNKNOWN.
+	known map[string]struct{}
+}
+
+func NewChecker(interval, timeout time.Duration) *Checker {
+	server := health.NewServer()
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return &Checker{
+		server:   server,
+		interval: interval,
+		timeout:  timeout,
+		known:    map[string]struct{}{},
+	}
+}
+
+// Register registers the health service on the grpc server.
+func (c *Checker) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, c.server)
+}
+
+// Run checks the plugins every interval until ctx is done, then reports every
+// service as NOT_SERVING.
+func (c *Checker) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, c.Check, c.interval)
+	c.server.Shutdown()
+}
+
+// probe calls the probe of an observer, a panic of the probe is returned as an
+// error.
+func (c *Checker) probe(ctx context.Context, prober resource.Prober) (err error) {
+	defer rpcerrors.Recover("probe", &err)
+	probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return prober.Probe(probeCtx)
+}
+
+// Check probes the registered plugins implementing resource.Prober, the other
+// plugins are always serving.
+func (c *Checker) Check(ctx context.Context) {
+	method := "Checker/Check"
+	instances := resource.Registered()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		serving  int
+		backends int
+	)
+	for name, instance := range instances {
+		wg.Add(1)
+		go func(name string, instance resource.Observer) {
+			defer wg.Done()
+			status := healthpb.HealthCheckResponse_SERVING
+			if prober, ok := instance.(resource.Prober); ok {
+				if err := c.probe(ctx, prober); err != nil {
+					klog.Warningf("%s probe observer [%s] error: %s\n", method, name, err)
+					status = healthpb.HealthCheckResponse_NOT_SERVING
+				}
+			}
+			c.server.SetServingStatus(name, status)
+			if !resource.HasBackend(instance) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			backends++
+			if status == healthpb.HealthCheckResponse_SERVING {
+				serving++
+			}
+		}(name, instance)
+	}
+	wg.Wait()
+
+	for name := range c.known {
+		if _, ok := instances[name]; !ok {
+			c.server.SetServingStatus(name, healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+		}
+	}
+	c.known = make(map[string]struct{}, len(instances))
+	for name := range instances {
+		c.known[name] = struct{}{}
+	}
+
+	overall := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving > 0 {
+		overall = healthpb.HealthCheckResponse_SERVING
+	}
+	c.server.SetServingStatus("", overall)
+	klog.V(4).Infof("%s %d of %d observers with a backend are serving\n", method, serving, backends)
+}
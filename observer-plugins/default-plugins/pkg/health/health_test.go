@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+type fakeObserver struct {
+	name     string
+	probeErr error
+}
+
+func (f *fakeObserver) Name() string { return f.name }
+
+func (f *fakeObserver) Capabilities() map[string]*obi.CapabilityInfo { return nil }
+
+func (f *fakeObserver) FetchData(context.Context, *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	return &obi.GetMetricsResponse{}, nil
+}
+
+func (f *fakeObserver) Probe(context.Context) error { return f.probeErr }
+
+// dependentObserver forwards to other sources and has no probe, as composite.
+type dependentObserver struct {
+	fakeObserver
+}
+
+func (d *dependentObserver) Sources() []string { return nil }
+
+func (d *dependentObserver) Probe(context.Context) error { return nil }
+
+func TestCheck(t *testing.T) {
+	down := errors.New("connection refused")
+	tests := []struct {
+		name        string
+		instances   []resource.Observer
+		want        map[string]healthpb.HealthCheckResponse_ServingStatus
+		wantOverall healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{
+			name: "a backend is serving",
+			instances: []resource.Observer{
+				&fakeObserver{name: "prometheus"},
+				&fakeObserver{name: "metrics-server", probeErr: down},
+			},
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"prometheus":     healthpb.HealthCheckResponse_SERVING,
+				"metrics-server": healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+			wantOverall: healthpb.HealthCheckResponse_SERVING,
+		},
+		{
+			name: "dependent sources don't keep the server serving",
+			instances: []resource.Observer{
+				&fakeObserver{name: "prometheus", probeErr: down},
+				resource.WithTimeout(&dependentObserver{fakeObserver{name: "composite"}}, time.Second),
+			},
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"prometheus": healthpb.HealthCheckResponse_NOT_SERVING,
+				"composite":  healthpb.HealthCheckResponse_SERVING,
+			},
+			wantOverall: healthpb.HealthCheckResponse_NOT_SERVING,
+		},
+		{
+			name:        "no source",
+			wantOverall: healthpb.HealthCheckResponse_NOT_SERVING,
+		},
+	}
+	defer resource.Replace(nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resource.Replace(test.instances)
+			checker := NewChecker(time.Minute, time.Second)
+			checker.Check(context.Background())
+
+			for service, want := range test.want {
+				resp, err := checker.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil || resp.Status != want {
+					t.Errorf("status of %s = %v, %v, want %s", service, resp, err, want)
+				}
+			}
+			resp, err := checker.server.Check(context.Background(), &healthpb.HealthCheckRequest{})
+			if err != nil || resp.Status != test.wantOverall {
+				t.Errorf("status of the server = %v, %v, want %s", resp, err, test.wantOverall)
+			}
+		})
+	}
+}
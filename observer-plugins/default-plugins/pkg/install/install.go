@@ -17,7 +17,439 @@ limitations under the License.
 package install
 
 import (
-	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/limit"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+
+	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/composite"
+	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/cost"
+	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/failover"
+	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/httpjson"
+	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/loki"
 	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/metrics-server"
 	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/prometheus"
+	_ "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/scrape"
+)
+
+var (
+	// reloadMu serializes the reloads, so that an older config never replaces
+	// a newer one.
+	reloadMu sync.Mutex
+	// registered are the instances registered by Setup or the last Reload, by
+	// name, guarded by reloadMu.
+	registered map[string]builtInstance
 )
+
+// builtInstance is an instance with the config it's built from, a reload keeps
+// the instances whose config didn't change, with the state of their limits and
+// their samples.
+type builtInstance struct {
+	config   config.PluginConfig
+	instance resource.Observer
+}
+
+type State string
+
+const (
+	// Ready instances are built and their backend answered the probe.
+	Ready State = "ready"
+	// Unreachable instances are built and registered, but their backend
+	// didn't answer the probe.
+	Unreachable State = "unreachable"
+	// Failed instances can't be built, they're not registered.
+	Failed State = "failed"
+	// Skipped instances have no settings, such as prometheus without address.
+	Skipped  State = "skipped"
+	Disabled State = "disabled"
+)
+
+// Status is the startup result of a plugin instance.
+type Status struct {
+	Name     string
+	Type     string
+	Required bool
+	// Dependent instances forward the requests to other sources, see
+	// resource.Dependent.
+	Dependent bool
+	State     State
+	Err       error
+}
+
+// Started reports whether the instance serves requests without error.
+func (s *Status) Started() bool {
+	return s.State == Ready
+}
+
+// LoadConfig reads the config file, or returns one instance of each plugin type
+// configured by the flags when path is empty.
+func LoadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return config.Default(resource.Types()), nil
+	}
+	return config.Load(path)
+}
+
+// limits returns the limits of an instance, the fields left empty default to the
+// flags.
+func limits(cfg *config.Limits) limit.Limits {
+	l := limit.Limits{
+		MaxConcurrent: *flags.SourceMaxConcurrent,
+		QPS:           *flags.SourceQPS,
+		Burst:         *flags.SourceBurst,
+		MaxWait:       *flags.SourceMaxWait,
+	}
+	if cfg == nil {
+		return l
+	}
+	if cfg.MaxConcurrent > 0 {
+		l.MaxConcurrent = cfg.MaxConcurrent
+	}
+	if cfg.QPS > 0 {
+		l.QPS = cfg.QPS
+	}
+	if cfg.Burst > 0 {
+		l.Burst = cfg.Burst
+	}
+	if cfg.MaxWait.Duration > 0 {
+		l.MaxWait = cfg.MaxWait.Duration
+	}
+	return l
+}
+
+// probe calls the probe of an instance, a panic of the probe is returned as an
+// error.
+func probe(ctx context.Context, prober resource.Prober, timeout time.Duration) (err error) {
+	defer rpcerrors.Recover("probe", &err)
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return prober.Probe(probeCtx)
+}
+
+// Build creates the instances declared by cfg and probes the backend of the
+// instances implementing resource.Prober. The statuses follow the order of
+// cfg.Plugins, the unreachable instances are returned as well since their
+// backend may come up later.
+func Build(ctx context.Context, cfg *config.Config, probeTimeout time.Duration) ([]resource.Observer, []Status) {
+	instances, statuses, _ := buildInstances(ctx, cfg, probeTimeout, nil)
+	return instances, statuses
+}
+
+// newInstance creates the instance of a plugin, bounded by its timeout and
+// limits.
+func newInstance(plugin config.PluginConfig) (resource.Observer, error) {
+	instance, err := resource.NewObserver(plugin)
+	if err != nil {
+		return nil, err
+	}
+	timeout := plugin.Timeout.Duration
+	if timeout <= 0 && resource.HasBackend(instance) {
+		// the dependent instances are bounded by the timeouts of their
+		// sources, a failover with the same timeout would give up on its next
+		// sources when the first one hangs
+		timeout = *flags.SourceTimeout
+	}
+	return resource.WithTimeout(limit.WithLimits(instance, limits(plugin.Limits)), timeout), nil
+}
+
+// buildInstances is Build reusing the instances of previous whose config is
+// the same, they're probed again. It also returns the built instances by name.
+func buildInstances(ctx context.Context, cfg *config.Config, probeTimeout time.Duration,
+	previous map[string]builtInstance) ([]resource.Observer, []Status, map[string]builtInstance) {
+	statuses := make([]Status, len(cfg.Plugins))
+	instances := make([]resource.Observer, len(cfg.Plugins))
+
+	var wg sync.WaitGroup
+	for idx, plugin := range cfg.Plugins {
+		status := &statuses[idx]
+		status.Name, status.Type, status.Required = plugin.Name, plugin.Type, plugin.Required
+		if !plugin.IsEnabled() {
+			status.State = Disabled
+			continue
+		}
+
+		if reused, ok := previous[plugin.Name]; ok && reflect.DeepEqual(reused.config, plugin) {
+			instances[idx] = reused.instance
+		} else {
+			built, err := newInstance(plugin)
+			if err != nil {
+				status.State, status.Err = Failed, err
+				if errors.Is(err, resource.ErrNotConfigured) {
+					status.State = Skipped
+				}
+				continue
+			}
+			instances[idx] = built
+		}
+		instance := resource.Unwrap(instances[idx])
+
+		if !resource.HasBackend(instance) {
+			// resolved once the state of its sources is known
+			status.Dependent = true
+			continue
+		}
+		prober, ok := instance.(resource.Prober)
+		if !ok {
+			status.State = Ready
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status.State = Ready
+			if err := probe(ctx, prober, probeTimeout); err != nil {
+				status.State, status.Err = Unreachable, err
+			}
+		}()
+	}
+	wg.Wait()
+	resolveDependents(instances, statuses)
+
+	built := make([]resource.Observer, 0, len(instances))
+	byName := make(map[string]builtInstance, len(instances))
+	for idx, instance := range instances {
+		if instance != nil {
+			built = append(built, instance)
+			byName[cfg.Plugins[idx].Name] = builtInstance{config: cfg.Plugins[idx], instance: instance}
+		}
+	}
+	return built, statuses, byName
+}
+
+// resolveDependents sets the state of the instances implementing
+// resource.Dependent, which are ready when one of their sources is ready. The
+// instances in a cycle of sources, which would forward a request forever, fail
+// and aren't registered.
+func resolveDependents(instances []resource.Observer, statuses []Status) {
+	r := &dependents{instances: instances, statuses: statuses, index: make(map[string]int, len(statuses)), marks: make([]int, len(statuses))}
+	for idx, status := range statuses {
+		r.index[status.Name] = idx
+	}
+	for idx := range instances {
+		r.resolve(idx, nil)
+	}
+	for idx := range instances {
+		if statuses[idx].Dependent && statuses[idx].State == Failed {
+			instances[idx] = nil
+		}
+	}
+}
+
+// the marks of the instances resolved by dependents
+const (
+	resolving = iota + 1
+	resolved
+)
+
+type dependents struct {
+	instances []resource.Observer
+	statuses  []Status
+	index     map[string]int
+	marks     []int
+}
+
+// sources returns the instances an instance forwards requests to. The sources
+// of a composite are named by each request, its operands may be any instance
+// with sources of its own, but not another composite.
+func (r *dependents) sources(idx int) []string {
+	sources := resource.Unwrap(r.instances[idx]).(resource.Dependent).Sources()
+	if len(sources) > 0 {
+		return sources
+	}
+	for other, instance := range r.instances {
+		if instance == nil || other == idx {
+			continue
+		}
+		if dependent, ok := resource.Unwrap(instance).(resource.Dependent); ok && len(dependent.Sources()) > 0 {
+			sources = append(sources, r.statuses[other].Name)
+		}
+	}
+	return sources
+}
+
+// resolve sets the state of the instance at idx after the ones of its sources,
+// path is the chain of instances which lead to it.
+func (r *dependents) resolve(idx int, path []string) {
+	if r.instances[idx] == nil || r.marks[idx] == resolved {
+		return
+	}
+	dependent, ok := resource.Unwrap(r.instances[idx]).(resource.Dependent)
+	if !ok {
+		r.marks[idx] = resolved
+		return
+	}
+	status := &r.statuses[idx]
+	if r.marks[idx] == resolving {
+		r.fail(path, status.Name)
+		return
+	}
+	r.marks[idx] = resolving
+	path = append(path, status.Name)
+	for _, source := range r.sources(idx) {
+		if sourceIdx, ok := r.index[source]; ok {
+			r.resolve(sourceIdx, path)
+		}
+	}
+	r.marks[idx] = resolved
+	if status.State == Failed {
+		return
+	}
+	if len(dependent.Sources()) == 0 {
+		status.State = Ready
+		return
+	}
+	status.State, status.Err = Unreachable, fmt.Errorf("none of the sources %s is ready", strings.Join(dependent.Sources(), ", "))
+	for _, source := range dependent.Sources() {
+		if sourceIdx, ok := r.index[source]; ok && r.statuses[sourceIdx].State == Ready {
+			status.State, status.Err = Ready, nil
+			break
+		}
+	}
+}
+
+// fail sets every instance of the cycle ending at name as failed.
+func (r *dependents) fail(path []string, name string) {
+	start := 0
+	for idx, step := range path {
+		if step == name {
+			start = idx
+		}
+	}
+	cycle := append(append([]string{}, path[start:]...), name)
+	err := fmt.Errorf("sources cycle %s", strings.Join(cycle, " -> "))
+	for _, step := range cycle {
+		status := &r.statuses[r.index[step]]
+		status.State, status.Err = Failed, err
+	}
+}
+
+// Setup registers the instances declared by --config, or one instance of each
+// plugin type configured by the flags, and logs the status of every instance.
+// A config that can't be loaded is always an error, in strict mode a required
+// instance that isn't ready, or no ready instance with a backend of its own, is
+// an error too.
+func Setup(ctx context.Context) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	instances, built, err := build(ctx, nil)
+	if err != nil {
+		return err
+	}
+	resource.Replace(instances)
+	registered = built
+	return nil
+}
+
+// Reload builds the instances again from --config and swaps the registry. The
+// registered instances are kept when the new ones fail the checks of Setup,
+// requests in flight finish with the instances they started with. The
+// instances whose config didn't change are kept as well, with their limits and
+// state, the other ones start with fresh limits, so that a changed instance may
+// briefly run the requests of both its old and new limits.
+func Reload(ctx context.Context) error {
+	return reload(ctx, true)
+}
+
+// Rebuild is Reload building every instance again, so that the files read by
+// the instances, such as the price table of cost, are read again as well.
+func Rebuild(ctx context.Context) error {
+	return reload(ctx, false)
+}
+
+func reload(ctx context.Context, keep bool) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var previous map[string]builtInstance
+	if keep {
+		previous = registered
+	}
+	instances, built, err := build(ctx, previous)
+	if err != nil {
+		return fmt.Errorf("keep the registered observers: %w", err)
+	}
+	resource.Replace(instances)
+	registered = built
+	klog.Infof("Observer config is reloaded\n")
+	return nil
+}
+
+func build(ctx context.Context, previous map[string]builtInstance) ([]resource.Observer, map[string]builtInstance, error) {
+	cfg, err := LoadConfig(*flags.Config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load observer config error: %w", err)
+	}
+
+	instances, statuses, built := buildInstances(ctx, cfg, flags.Server.ProbeTimeout, previous)
+	Report(statuses)
+
+	if !*flags.Strict {
+		return instances, built, nil
+	}
+	return instances, built, checkStrict(statuses)
+}
+
+// checkStrict returns an error when a required instance didn't start, or when
+// no instance with a backend of its own started, the composite and failover
+// instances are always registered but can't answer without one.
+func checkStrict(statuses []Status) error {
+	var notStarted []string
+	backends := 0
+	for idx := range statuses {
+		if statuses[idx].Required && !statuses[idx].Started() {
+			notStarted = append(notStarted, statuses[idx].Name)
+		}
+		if !statuses[idx].Dependent && statuses[idx].Started() {
+			backends++
+		}
+	}
+	switch {
+	case len(notStarted) > 0:
+		return fmt.Errorf("required observers [%s] didn't start", strings.Join(notStarted, ", "))
+	case backends == 0:
+		return fmt.Errorf("no observer with a backend is ready")
+	}
+	return nil
+}
+
+// Report logs the status of each instance.
+func Report(statuses []Status) {
+	registered := 0
+	for _, status := range statuses {
+		switch status.State {
+		case Ready:
+			registered++
+			klog.Infof("Observer [%s] of type %s is ready\n", status.Name, status.Type)
+		case Unreachable:
+			registered++
+			klog.Warningf("Observer [%s] of type %s is registered but unreachable: %s\n", status.Name, status.Type, status.Err)
+		case Failed:
+			klog.Errorf("Observer [%s] of type %s failed: %s\n", status.Name, status.Type, status.Err)
+		case Skipped:
+			if status.Required {
+				klog.Errorf("Observer [%s] of type %s is required but not configured: %s\n", status.Name, status.Type, status.Err)
+				continue
+			}
+			klog.V(4).Infof("Observer [%s] of type %s is skipped: %s\n", status.Name, status.Type, status.Err)
+		case Disabled:
+			klog.Infof("Observer [%s] of type %s is disabled\n", status.Name, status.Type)
+		}
+	}
+	if registered == 0 {
+		klog.Warningf("No observer is registered, all requests will return empty responses\n")
+		return
+	}
+	klog.Infof("%d of %d observers are registered\n", registered, len(statuses))
+}
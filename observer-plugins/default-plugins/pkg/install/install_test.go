@@ -0,0 +1,334 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakeprometheus"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// setFlags sets the flags of a test and restores them when it ends.
+func setFlags(t *testing.T, kubeconfig, address string) {
+	t.Helper()
+	saved := []*string{flags.Config, flags.Kubeconfig, flags.Address}
+	values := []string{*flags.Config, *flags.Kubeconfig, *flags.Address}
+	strict := *flags.Strict
+	t.Cleanup(func() {
+		for idx, flag := range saved {
+			*flag = values[idx]
+		}
+		*flags.Strict = strict
+	})
+	*flags.Config, *flags.Kubeconfig, *flags.Address, *flags.Strict = "", kubeconfig, address, true
+}
+
+// writeKubeconfig writes a kubeconfig of the api server at address.
+func writeKubeconfig(t *testing.T, address string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`, address)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuildStrict(t *testing.T) {
+	prometheus := fakeprometheus.NewServer()
+	defer prometheus.Close()
+	down := fakeprometheus.NewServer()
+	down.Close()
+
+	tests := []struct {
+		name       string
+		kubeconfig string
+		address    string
+		wantErr    bool
+	}{
+		{
+			// composite is always registered, it doesn't count
+			name:       "a bad kubeconfig leaves no backend",
+			kubeconfig: filepath.Join(t.TempDir(), "missing"),
+			wantErr:    true,
+		},
+		{
+			name:       "every backend is unreachable",
+			kubeconfig: writeKubeconfig(t, down.URL),
+			address:    down.URL,
+			wantErr:    true,
+		},
+		{
+			name:       "a backend is ready",
+			kubeconfig: writeKubeconfig(t, down.URL),
+			address:    prometheus.URL,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, test.kubeconfig, test.address)
+			instances, _, err := build(context.Background(), nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("build() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && len(instances) == 0 {
+				t.Error("build() registered no instance")
+			}
+		})
+	}
+}
+
+func TestCheckStrict(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []Status
+		wantErr  bool
+	}{
+		{
+			name: "ready backend",
+			statuses: []Status{
+				{Name: "prometheus", State: Ready},
+				{Name: "composite", Dependent: true, State: Ready},
+			},
+		},
+		{
+			name: "only dependent instances are ready",
+			statuses: []Status{
+				{Name: "metrics-server", State: Failed},
+				{Name: "composite", Dependent: true, State: Ready},
+				{Name: "failover", Dependent: true, State: Ready},
+			},
+			wantErr: true,
+		},
+		{
+			name: "required instance unreachable",
+			statuses: []Status{
+				{Name: "prometheus", State: Ready},
+				{Name: "thanos", Required: true, State: Unreachable},
+			},
+			wantErr: true,
+		},
+		{
+			name: "required instance skipped",
+			statuses: []Status{
+				{Name: "prometheus", State: Ready},
+				{Name: "loki", Required: true, State: Skipped},
+			},
+			wantErr: true,
+		},
+		{
+			name: "optional instance unreachable",
+			statuses: []Status{
+				{Name: "prometheus", State: Ready},
+				{Name: "thanos", State: Unreachable},
+			},
+		},
+		{
+			name:    "nothing configured",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkStrict(test.statuses); (err != nil) != test.wantErr {
+				t.Errorf("checkStrict() error = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildFailoverTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer hanging.Close()
+	defer close(stop)
+	prometheus := fakeprometheus.NewServer()
+	defer prometheus.Close()
+	prometheus.SetResponse("up", fakeprometheus.Response{Result: model.Vector{{Value: 1}}})
+
+	setFlags(t, writeKubeconfig(t, prometheus.URL), "")
+	timeout := *flags.SourceTimeout
+	defer func() { *flags.SourceTimeout = timeout }()
+	*flags.SourceTimeout = 200 * time.Millisecond
+
+	cfg := &config.Config{Plugins: []config.PluginConfig{
+		{Name: "hanging", Type: "prometheus", Address: hanging.URL},
+		{Name: "prometheus", Type: "prometheus", Address: prometheus.URL},
+		{Name: "cpu", Type: "failover", Options: json.RawMessage(`{"sources":["hanging","prometheus"]}`)},
+	}}
+	instances, statuses := Build(context.Background(), cfg, 100*time.Millisecond)
+	if statuses[2].State != Ready {
+		t.Fatalf("failover state = %s, want %s", statuses[2].State, Ready)
+	}
+	resource.Replace(instances)
+	defer resource.Replace(nil)
+
+	failover, _ := resource.GetRegisters("cpu")
+	got, err := failover.FetchData(context.Background(), &obi.GetMetricsRequest{
+		Source: "cpu", Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+		MetricName: "cpu", Query: "up", Aggregation: []string{"avg"},
+	})
+	if err != nil {
+		t.Fatalf("FetchData() error = %v", err)
+	}
+	if got.Source != "prometheus" {
+		t.Errorf("FetchData() answered by %s, want prometheus", got.Source)
+	}
+}
+
+// observer is a fake instance, with a backend unless it's dependent.
+type observer struct {
+	name      string
+	dependent bool
+	sources   []string
+}
+
+func (o *observer) Name() string {
+	return o.name
+}
+
+func (o *observer) Capabilities() map[string]*obi.CapabilityInfo {
+	return nil
+}
+
+func (o *observer) FetchData(context.Context, *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	return &obi.GetMetricsResponse{}, nil
+}
+
+type dependentObserver struct{ observer }
+
+func (d *dependentObserver) Sources() []string {
+	return d.sources
+}
+
+func TestResolveDependents(t *testing.T) {
+	tests := []struct {
+		name       string
+		instances  []resource.Observer
+		states     []State
+		wantStates []State
+	}{
+		{
+			name: "ready source",
+			instances: []resource.Observer{
+				&observer{name: "prometheus"},
+				&observer{name: "thanos"},
+				&dependentObserver{observer{name: "cpu", sources: []string{"thanos", "prometheus"}}},
+			},
+			states:     []State{Unreachable, Ready, ""},
+			wantStates: []State{Unreachable, Ready, Ready},
+		},
+		{
+			name: "no ready source",
+			instances: []resource.Observer{
+				&observer{name: "prometheus"},
+				&dependentObserver{observer{name: "cpu", sources: []string{"prometheus", "missing"}}},
+			},
+			states:     []State{Unreachable, ""},
+			wantStates: []State{Unreachable, Unreachable},
+		},
+		{
+			name: "dependent source resolved first",
+			instances: []resource.Observer{
+				&dependentObserver{observer{name: "outer", sources: []string{"inner"}}},
+				&dependentObserver{observer{name: "inner", sources: []string{"prometheus"}}},
+				&observer{name: "prometheus"},
+			},
+			states:     []State{"", "", Ready},
+			wantStates: []State{Ready, Ready, Ready},
+		},
+		{
+			name: "composite names its sources per request",
+			instances: []resource.Observer{
+				&dependentObserver{observer{name: "composite"}},
+				&dependentObserver{observer{name: "cpu", sources: []string{"prometheus"}}},
+				&observer{name: "prometheus"},
+			},
+			states:     []State{"", "", Ready},
+			wantStates: []State{Ready, Ready, Ready},
+		},
+		{
+			name: "cycle of sources",
+			instances: []resource.Observer{
+				&observer{name: "prometheus"},
+				&dependentObserver{observer{name: "a", sources: []string{"prometheus", "b"}}},
+				&dependentObserver{observer{name: "b", sources: []string{"a"}}},
+				&dependentObserver{observer{name: "c", sources: []string{"b", "prometheus"}}},
+			},
+			states:     []State{Ready, "", "", ""},
+			wantStates: []State{Ready, Failed, Failed, Ready},
+		},
+		{
+			name: "failover over a composite",
+			instances: []resource.Observer{
+				&observer{name: "prometheus"},
+				&dependentObserver{observer{name: "cpu", sources: []string{"composite", "prometheus"}}},
+				&dependentObserver{observer{name: "composite"}},
+			},
+			states:     []State{Ready, "", ""},
+			wantStates: []State{Ready, Failed, Failed},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statuses := make([]Status, len(test.instances))
+			for idx, instance := range test.instances {
+				statuses[idx] = Status{Name: instance.Name(), Dependent: !resource.HasBackend(instance), State: test.states[idx]}
+			}
+			instances := append([]resource.Observer{}, test.instances...)
+			resolveDependents(instances, statuses)
+			for idx := range statuses {
+				if statuses[idx].State != test.wantStates[idx] {
+					t.Errorf("%s state = %s (%v), want %s", statuses[idx].Name, statuses[idx].State, statuses[idx].Err, test.wantStates[idx])
+				}
+				if registered := instances[idx] != nil; registered == (test.wantStates[idx] == Failed) {
+					t.Errorf("%s registered = %t with state %s", statuses[idx].Name, registered, test.wantStates[idx])
+				}
+			}
+		})
+	}
+}
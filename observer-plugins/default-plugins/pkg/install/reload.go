@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Watch rebuilds the plugin instances when a value is received from trigger,
+// usually on SIGHUP, and reloads them when the content of the config file
+// changes. The file is read rather than watched by inotify, so that the symlink
+// swap of a mounted ConfigMap is seen as well. A change which fails to reload
+// is retried every interval until it succeeds or the file changes again. Watch
+// returns when ctx is done and the reload in progress finished.
+func Watch(ctx context.Context, path string, interval time.Duration, trigger <-chan os.Signal) {
+	method := "install/Watch"
+
+	run := func(reason string, reload func(context.Context) error) error {
+		klog.Infof("%s reload observer config on %s\n", method, reason)
+		err := reload(ctx)
+		if err != nil {
+			klog.Errorf("%s reload error: %s\n", method, err)
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if path != "" && interval > 0 {
+		last := checksum(path)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.UntilWithContext(ctx, func(ctx context.Context) {
+				current := checksum(path)
+				if current == nil || bytes.Equal(current, last) {
+					return
+				}
+				if run("change of "+path, Reload) == nil {
+					last = current
+				}
+			}, interval)
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-trigger:
+			_ = run(s.String(), Rebuild)
+		}
+	}
+}
+
+// checksum returns the sha256 of the file, or nil when it can't be read, for
+// example during the update of a ConfigMap.
+func checksum(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		klog.V(4).Infof("install/checksum read %s error: %s\n", path, err)
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
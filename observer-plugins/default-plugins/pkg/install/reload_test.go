@@ -0,0 +1,251 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakeprometheus"
+)
+
+// writeFile writes content to path, replacing the file atomically as the
+// update of a mounted ConfigMap does.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// registeredNames returns the sorted names of the registered instances.
+func registeredNames() []string {
+	names := []string{}
+	for name := range resource.Registered() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// eventually waits up to a second for condition.
+func eventually(t *testing.T, condition func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// setConfig points --config to a file of the test, the instances registered by
+// the test are removed when it ends.
+func setConfig(t *testing.T, kubeconfig string) string {
+	t.Helper()
+	setFlags(t, kubeconfig, "")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	*flags.Config = path
+	t.Cleanup(func() {
+		resource.Replace(nil)
+		registered = nil
+	})
+	return path
+}
+
+func TestReload(t *testing.T) {
+	prometheus := fakeprometheus.NewServer()
+	defer prometheus.Close()
+	path := setConfig(t, writeKubeconfig(t, prometheus.URL))
+
+	config := func(step, composite string) string {
+		return fmt.Sprintf(`plugins:
+- name: prometheus
+  type: prometheus
+  address: %s
+  step: %s
+- name: %s
+  type: composite
+`, prometheus.URL, step, composite)
+	}
+	writeFile(t, path, config("30s", "expr-a"))
+	if err := Setup(context.Background()); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		config    string
+		wantErr   bool
+		wantNames []string
+		rebuild   bool
+		// wantKept is set when the prometheus instance isn't rebuilt
+		wantKept bool
+	}{
+		{
+			name:      "unchanged instances are kept",
+			config:    config("30s", "expr-b"),
+			wantNames: []string{"expr-b", "prometheus"},
+			wantKept:  true,
+		},
+		{
+			name:      "changed instances are rebuilt",
+			config:    config("1m", "expr-b"),
+			wantNames: []string{"expr-b", "prometheus"},
+		},
+		{
+			name:      "rebuild builds the unchanged instances again",
+			config:    config("1m", "expr-b"),
+			rebuild:   true,
+			wantNames: []string{"expr-b", "prometheus"},
+		},
+		{
+			name:      "a config which can't be loaded keeps the registered instances",
+			config:    "plugins: [",
+			wantErr:   true,
+			wantNames: []string{"expr-b", "prometheus"},
+			wantKept:  true,
+		},
+		{
+			name: "a config without a ready backend keeps the registered instances",
+			config: `plugins:
+- name: expr-c
+  type: composite
+`,
+			wantErr:   true,
+			wantNames: []string{"expr-b", "prometheus"},
+			wantKept:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, _ := resource.GetRegisters("prometheus")
+			writeFile(t, path, test.config)
+			reload := Reload
+			if test.rebuild {
+				reload = Rebuild
+			}
+			if err := reload(context.Background()); (err != nil) != test.wantErr {
+				t.Fatalf("reload() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if names := registeredNames(); fmt.Sprint(names) != fmt.Sprint(test.wantNames) {
+				t.Errorf("registered %v, want %v", names, test.wantNames)
+			}
+			if after, _ := resource.GetRegisters("prometheus"); (after == before) != test.wantKept {
+				t.Errorf("prometheus kept = %t, want %t", after == before, test.wantKept)
+			}
+		})
+	}
+}
+
+func TestWatchSignal(t *testing.T) {
+	prometheus := fakeprometheus.NewServer()
+	defer prometheus.Close()
+	path := setConfig(t, writeKubeconfig(t, prometheus.URL))
+	config := `plugins:
+- name: prometheus
+  type: prometheus
+  address: ` + prometheus.URL + "\n"
+	writeFile(t, path, config)
+	if err := Setup(context.Background()); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	trigger := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the file isn't watched, only the signal reloads it
+		Watch(ctx, path, 0, trigger)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	writeFile(t, path, config+"- name: expr\n  type: composite\n")
+	trigger <- syscall.SIGHUP
+	if !eventually(t, func() bool { _, ok := resource.GetRegisters("expr"); return ok }) {
+		t.Errorf("registered %v after SIGHUP, want expr", registeredNames())
+	}
+}
+
+func TestWatchRetry(t *testing.T) {
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major": "1", "minor": "24"}`))
+	}))
+	defer kube.Close()
+	path := setConfig(t, writeKubeconfig(t, kube.URL))
+	prices := filepath.Join(t.TempDir(), "prices.yaml")
+	writeFile(t, prices, "default:\n  cpuCoreHour: 0.04\n  memoryGiBHour: 0.005\n")
+	config := `plugins:
+- name: cost
+  type: cost
+  required: true
+  options:
+    priceTableFile: ` + prices + "\n"
+	writeFile(t, path, config)
+	if err := Setup(context.Background()); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	trigger := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, path, 10*time.Millisecond, trigger)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// the signal is received once Watch has read the checksum of the config
+	trigger <- syscall.SIGHUP
+
+	// the changed cost instance fails without its price table, so the change
+	// of the config isn't reloaded
+	if err := os.Remove(prices); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, config+"  timeout: 1m\n- name: expr\n  type: composite\n")
+	if eventually(t, func() bool { _, ok := resource.GetRegisters("expr"); return ok }) {
+		t.Fatalf("registered %v without the price table", registeredNames())
+	}
+	// the change is reloaded once the price table is back, although the
+	// config didn't change again
+	writeFile(t, prices, "default:\n  cpuCoreHour: 0.04\n  memoryGiBHour: 0.005\n")
+	if !eventually(t, func() bool { _, ok := resource.GetRegisters("expr"); return ok }) {
+		t.Errorf("registered %v after the price table is back, want expr", registeredNames())
+	}
+}
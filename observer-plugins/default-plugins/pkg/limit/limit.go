@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package limit bounds the requests sent by the server to each source, so that
+// a burst of policy evaluations can't overload the backend.
+package limit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	rateLimit        = "rate"
+	concurrencyLimit = "concurrency"
+)
+
+// Limits of the requests of a source, a zero value disables the limit.
+type Limits struct {
+	// MaxConcurrent is the number of requests sent to the source at once.
+	MaxConcurrent int
+	// QPS is the rate of the token bucket, Burst its size, it defaults to
+	// the QPS rounded up.
+	QPS   float64
+	Burst int
+	// MaxWait is the time a request is queued for a token or a slot before
+	// it's rejected.
+	MaxWait time.Duration
+}
+
+func (l Limits) enabled() bool {
+	return l.MaxConcurrent > 0 || l.QPS > 0
+}
+
+type limitedObserver struct {
+	resource.Observer
+	limits  Limits
+	limiter *rate.Limiter
+	slots   chan struct{}
+}
+
+// WithLimits queues the FetchData calls of the observer over its limits, and
+// rejects them with ResourceExhausted after the max wait. Probes aren't
+// limited.
+func WithLimits(instance resource.Observer, limits Limits) resource.Observer {
+	if !limits.enabled() {
+		return instance
+	}
+	l := &limitedObserver{Observer: instance, limits: limits}
+	if limits.QPS > 0 {
+		burst := limits.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(limits.QPS))
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(limits.QPS), burst)
+	}
+	if limits.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return l
+}
+
+func (l *limitedObserver) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.Observer.FetchData(ctx, req)
+}
+
+// acquire waits for a concurrency slot then for a rate token, the returned
+// function releases the slot. The token is taken last, so that a request
+// rejected while it waits for a slot doesn't use one.
+func (l *limitedObserver) acquire(ctx context.Context) (func(), error) {
+	start := time.Now()
+	waitCtx := ctx
+	if l.limits.MaxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.limits.MaxWait)
+		defer cancel()
+	}
+	done := metrics.TrackLimiterWaiting(l.Name())
+	defer done()
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-waitCtx.Done():
+			return nil, l.reject(ctx, concurrencyLimit, start)
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+	// Wait fails at once, without taking the token, when the token isn't
+	// available before the deadline
+	if l.limiter != nil {
+		if err := l.limiter.Wait(waitCtx); err != nil {
+			release()
+			return nil, l.reject(ctx, rateLimit, start)
+		}
+	}
+
+	finished := metrics.TrackLimiterInFlight(l.Name(), start)
+	return func() {
+		release()
+		finished()
+	}, nil
+}
+
+// reject returns the error of the request which couldn't be admitted, the
+// request is only rejected by the limiter when its own context is still valid.
+func (l *limitedObserver) reject(ctx context.Context, limit string, start time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	klog.V(4).Infof("limitedObserver/reject %s is over its %s limit after %s\n", l.Name(), limit, time.Since(start))
+	metrics.ObserveLimiterRejected(l.Name(), limit)
+	return rpcerrors.ResourceExhausted(l.Name(), limit, "source %s is over its %s limit, retry later", l.Name(), limit)
+}
+
+// Probe calls the probe of the observer, observers without probe are always
+// reachable.
+func (l *limitedObserver) Probe(ctx context.Context) error {
+	prober, ok := l.Observer.(resource.Prober)
+	if !ok {
+		return nil
+	}
+	return prober.Probe(ctx)
+}
+
+func (l *limitedObserver) Unwrap() resource.Observer {
+	return l.Observer
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package limit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// fakeObserver answers at once, except the requests whose query is "hold",
+// which wait until release is closed.
+type fakeObserver struct {
+	name    string
+	release chan struct{}
+}
+
+func (f *fakeObserver) Name() string {
+	return f.name
+}
+
+func (f *fakeObserver) Capabilities() map[string]*obi.CapabilityInfo {
+	return nil
+}
+
+func (f *fakeObserver) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	if req.Query == "hold" {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &obi.GetMetricsResponse{Source: f.name}, nil
+}
+
+// metricValue returns the value of the gauge or counter of the source, and of
+// the limit when it's set.
+func metricValue(t *testing.T, name, source, limit string) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "arbiter_observer_"+name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["source"] != source || labels["limit"] != limit {
+				continue
+			}
+			if metric.Gauge != nil {
+				return metric.Gauge.GetValue()
+			}
+			return metric.Counter.GetValue()
+		}
+	}
+	return 0
+}
+
+// hold starts count requests which stay in flight until the returned function
+// is called, it returns once they're admitted.
+func hold(t *testing.T, instance *fakeObserver, limited resource.Observer, count int) func() {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := limited.FetchData(context.Background(), &obi.GetMetricsRequest{Query: "hold"}); err != nil {
+				t.Errorf("held FetchData() error = %v", err)
+			}
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); metricValue(t, "limiter_in_flight", instance.name, "") < float64(count); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests aren't admitted", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return func() {
+		close(instance.release)
+		wg.Wait()
+	}
+}
+
+func TestFetchData(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		// held requests stay in flight while the requests of wantHeld run,
+		// they finish before the requests of wantAfter
+		held         int
+		wantHeld     []codes.Code
+		wantAfter    []codes.Code
+		wantRejected map[string]float64
+	}{
+		{
+			name:      "disabled",
+			wantAfter: []codes.Code{codes.OK, codes.OK, codes.OK},
+		},
+		{
+			name:         "the burst is admitted then the rate is exhausted",
+			limits:       Limits{QPS: 0.1, Burst: 2, MaxWait: 10 * time.Millisecond},
+			wantAfter:    []codes.Code{codes.OK, codes.OK, codes.ResourceExhausted},
+			wantRejected: map[string]float64{rateLimit: 1},
+		},
+		{
+			name:      "a request waits for a token within the max wait",
+			limits:    Limits{QPS: 50, Burst: 1, MaxWait: time.Second},
+			wantAfter: []codes.Code{codes.OK, codes.OK, codes.OK},
+		},
+		{
+			name:         "the concurrency is exhausted while the slots are held",
+			limits:       Limits{MaxConcurrent: 2, MaxWait: 10 * time.Millisecond},
+			held:         2,
+			wantHeld:     []codes.Code{codes.ResourceExhausted},
+			wantAfter:    []codes.Code{codes.OK},
+			wantRejected: map[string]float64{concurrencyLimit: 1},
+		},
+		{
+			name:         "a request rejected for a slot doesn't use a token",
+			limits:       Limits{MaxConcurrent: 1, QPS: 0.1, Burst: 2, MaxWait: 10 * time.Millisecond},
+			held:         1,
+			wantHeld:     []codes.Code{codes.ResourceExhausted, codes.ResourceExhausted},
+			wantAfter:    []codes.Code{codes.OK, codes.ResourceExhausted},
+			wantRejected: map[string]float64{concurrencyLimit: 2, rateLimit: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := &fakeObserver{name: "limit-" + t.Name(), release: make(chan struct{})}
+			limited := WithLimits(instance, test.limits)
+
+			fetch := func(want []codes.Code) {
+				for idx, wantCode := range want {
+					_, err := limited.FetchData(context.Background(), &obi.GetMetricsRequest{})
+					if code := status.Code(err); code != wantCode {
+						t.Errorf("FetchData() %d code = %s, want %s, error %v", idx, code, wantCode, err)
+					}
+				}
+			}
+			release := func() { close(instance.release) }
+			if test.held > 0 {
+				release = hold(t, instance, limited, test.held)
+			}
+			fetch(test.wantHeld)
+			release()
+			fetch(test.wantAfter)
+
+			for _, limit := range []string{rateLimit, concurrencyLimit} {
+				if got := metricValue(t, "limiter_rejected_total", instance.name, limit); got != test.wantRejected[limit] {
+					t.Errorf("limiter_rejected_total{limit=%q} = %v, want %v", limit, got, test.wantRejected[limit])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchDataCanceled(t *testing.T) {
+	instance := &fakeObserver{name: "limit-canceled", release: make(chan struct{})}
+	limited := WithLimits(instance, Limits{MaxConcurrent: 1, MaxWait: time.Second})
+	release := hold(t, instance, limited, 1)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the request isn't rejected by the limiter when it ends first
+	if _, err := limited.FetchData(ctx, &obi.GetMetricsRequest{}); err != context.DeadlineExceeded {
+		t.Errorf("FetchData() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := metricValue(t, "limiter_rejected_total", instance.name, concurrencyLimit); got != 0 {
+		t.Errorf("limiter_rejected_total = %v, want 0", got)
+	}
+}
+
+func TestGauges(t *testing.T) {
+	instance := &fakeObserver{name: "limit-gauges", release: make(chan struct{})}
+	limited := WithLimits(instance, Limits{MaxConcurrent: 1, MaxWait: time.Second})
+	release := hold(t, instance, limited, 1)
+
+	queued := make(chan error)
+	go func() {
+		_, err := limited.FetchData(context.Background(), &obi.GetMetricsRequest{})
+		queued <- err
+	}()
+	for deadline := time.Now().Add(time.Second); metricValue(t, "limiter_waiting", instance.name, "") != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("limiter_waiting isn't 1 while a request is queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := metricValue(t, "limiter_in_flight", instance.name, ""); got != 1 {
+		t.Errorf("limiter_in_flight = %v while a request is held, want 1", got)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued FetchData() error = %v", err)
+	}
+	for _, name := range []string{"limiter_waiting", "limiter_in_flight"} {
+		if got := metricValue(t, name, instance.name, ""); got != 0 {
+			t.Errorf("%s = %v after the requests, want 0", name, got)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	namespace = "arbiter_observer"
+
+	// unknownSource is the source label of the requests for a source that isn't
+	// registered, so that clients can't grow the label values.
+	unknownSource = "unknown"
+)
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of grpc requests by method and source.",
+	}, []string{"method", "source"})
+
+	requestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_errors_total",
+		Help:      "Number of failed grpc requests by method, source and grpc code.",
+	}, []string{"method", "source", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of grpc requests by method and source.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "source"})
+
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of the http requests sent by the plugins to their backend, by source, backend and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "backend", "code"})
+
+	limiterInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "limiter_in_flight",
+		Help:      "Number of requests admitted by the limiter of a source and not finished yet.",
+	}, []string{"source"})
+
+	limiterWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "limiter_waiting",
+		Help:      "Number of requests queued by the limiter of a source for a rate token or a concurrency slot.",
+	}, []string{"source"})
+
+	limiterRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limiter_rejected_total",
+		Help:      "Number of requests rejected by the limiter of a source after the max wait, by exhausted limit.",
+	}, []string{"source", "limit"})
+
+	limiterWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "limiter_wait_duration_seconds",
+		Help:      "Time the admitted requests waited in the limiter of a source.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"source"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestErrorsTotal,
+		requestDuration,
+		backendRequestDuration,
+		limiterInFlight,
+		limiterWaiting,
+		limiterRejectedTotal,
+		limiterWaitDuration,
+	)
+}
+
+// UnaryServerInterceptor records the count, errors and latency of the grpc
+// requests, GetMetrics requests are labeled with their source.
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	source := ""
+	if r, ok := req.(*obi.GetMetricsRequest); ok {
+		source = unknownSource
+		if _, registered := resource.GetRegisters(r.Source); registered {
+			source = r.Source
+		}
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	requestDuration.WithLabelValues(method, source).Observe(time.Since(start).Seconds())
+	requestsTotal.WithLabelValues(method, source).Inc()
+	if err != nil {
+		requestErrorsTotal.WithLabelValues(method, source, status.Code(err).String()).Inc()
+	}
+	return resp, err
+}
+
+// InstrumentRoundTripper returns a wrapper recording the latency of the http
+// requests sent to the backend of the source, it can be used as the
+// WrapTransport of client-go configs.
+func InstrumentRoundTripper(source, backend string) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := rt.RoundTrip(req)
+			code := "error"
+			if err == nil {
+				code = strconv.Itoa(resp.StatusCode)
+			}
+			backendRequestDuration.WithLabelValues(source, backend, code).Observe(time.Since(start).Seconds())
+			return resp, err
+		})
+	}
+}
+
+// TrackLimiterWaiting counts a request queued by the limiter of the source
+// until the returned function is called.
+func TrackLimiterWaiting(source string) func() {
+	gauge := limiterWaiting.WithLabelValues(source)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// TrackLimiterInFlight counts a request admitted by the limiter of the source
+// until the returned function is called, the wait since start is recorded.
+func TrackLimiterInFlight(source string, start time.Time) func() {
+	limiterWaitDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+	gauge := limiterInFlight.WithLabelValues(source)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// ObserveLimiterRejected counts a request rejected by the limiter of the
+// source, limit is either rate or concurrency.
+func ObserveLimiterRejected(source, limit string) {
+	limiterRejectedTotal.WithLabelValues(source, limit).Inc()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
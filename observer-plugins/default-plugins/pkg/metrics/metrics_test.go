@@ -0,0 +1,203 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+type fakeObserver struct{}
+
+func (fakeObserver) Name() string { return "metrics-test" }
+
+func (fakeObserver) Capabilities() map[string]*obi.CapabilityInfo { return nil }
+
+func (fakeObserver) FetchData(context.Context, *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	return &obi.GetMetricsResponse{}, nil
+}
+
+// sampleCount returns the number of observations of a histogram.
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.Histogram.GetSampleCount()
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	resource.Replace([]resource.Observer{fakeObserver{}})
+	defer resource.Replace(nil)
+
+	tests := []struct {
+		name       string
+		fullMethod string
+		req        interface{}
+		err        error
+		wantMethod string
+		wantSource string
+	}{
+		{
+			name:       "registered source",
+			fullMethod: "/obi.v1.Server/GetMetrics",
+			req:        &obi.GetMetricsRequest{Source: "metrics-test"},
+			wantMethod: "GetMetrics",
+			wantSource: "metrics-test",
+		},
+		{
+			// the label values can't be grown by the clients
+			name:       "unregistered source",
+			fullMethod: "/obi.v1.Server/GetMetrics",
+			req:        &obi.GetMetricsRequest{Source: "made-up"},
+			err:        status.Error(codes.NotFound, "source made-up isn't registered"),
+			wantMethod: "GetMetrics",
+			wantSource: unknownSource,
+		},
+		{
+			name:       "request without source",
+			fullMethod: "/obi.v1.Server/PluginCapabilities",
+			req:        &obi.PluginCapabilitiesRequest{},
+			err:        errors.New("boom"),
+			wantMethod: "PluginCapabilities",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := testutil.ToFloat64(requestsTotal.WithLabelValues(test.wantMethod, test.wantSource))
+			code := status.Code(test.err).String()
+			failures := testutil.ToFloat64(requestErrorsTotal.WithLabelValues(test.wantMethod, test.wantSource, code))
+			observations := sampleCount(t, requestDuration.WithLabelValues(test.wantMethod, test.wantSource))
+
+			_, err := UnaryServerInterceptor(context.Background(), test.req, &grpc.UnaryServerInfo{FullMethod: test.fullMethod},
+				func(context.Context, interface{}) (interface{}, error) { return nil, test.err })
+			if err != test.err {
+				t.Fatalf("UnaryServerInterceptor() error = %v, want %v", err, test.err)
+			}
+
+			if got := testutil.ToFloat64(requestsTotal.WithLabelValues(test.wantMethod, test.wantSource)) - requests; got != 1 {
+				t.Errorf("requests_total increased by %v, want 1", got)
+			}
+			wantFailures := 0.0
+			if test.err != nil {
+				wantFailures = 1
+			}
+			if got := testutil.ToFloat64(requestErrorsTotal.WithLabelValues(test.wantMethod, test.wantSource, code)) - failures; got != wantFailures {
+				t.Errorf("request_errors_total{code=%q} increased by %v, want %v", code, got, wantFailures)
+			}
+			if got := sampleCount(t, requestDuration.WithLabelValues(test.wantMethod, test.wantSource)) - observations; got != 1 {
+				t.Errorf("request_duration_seconds observed %d requests, want 1", got)
+			}
+		})
+	}
+}
+
+func TestInstrumentRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode string
+	}{
+		{name: "ok", url: server.URL + "/up", wantCode: "200"},
+		{name: "server error", url: server.URL + "/down", wantCode: "503"},
+		{name: "transport error", url: closed.URL, wantCode: "error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			observer := backendRequestDuration.WithLabelValues("metrics-test", "http", test.wantCode)
+			before := sampleCount(t, observer)
+			client := &http.Client{Transport: InstrumentRoundTripper("metrics-test", "http")(nil)}
+			if response, err := client.Get(test.url); err == nil {
+				response.Body.Close()
+			}
+			if got := sampleCount(t, observer) - before; got != 1 {
+				t.Errorf("backend_request_duration_seconds{code=%q} observed %d requests, want 1", test.wantCode, got)
+			}
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	const source = "metrics-test"
+	doneWaiting := TrackLimiterWaiting(source)
+	if got := testutil.ToFloat64(limiterWaiting.WithLabelValues(source)); got != 1 {
+		t.Errorf("limiter_waiting = %v while waiting, want 1", got)
+	}
+	finished := TrackLimiterInFlight(source, time.Now())
+	doneWaiting()
+	if got := testutil.ToFloat64(limiterInFlight.WithLabelValues(source)); got != 1 {
+		t.Errorf("limiter_in_flight = %v while in flight, want 1", got)
+	}
+	finished()
+	ObserveLimiterRejected(source, "rate")
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{name: "limiter_waiting", collector: limiterWaiting.WithLabelValues(source), want: 0},
+		{name: "limiter_in_flight", collector: limiterInFlight.WithLabelValues(source), want: 0},
+		{name: "limiter_rejected_total", collector: limiterRejectedTotal.WithLabelValues(source, "rate"), want: 1},
+	}
+	for _, test := range tests {
+		if got := testutil.ToFloat64(test.collector); got != test.want {
+			t.Errorf("%s = %v, want %v", test.name, got, test.want)
+		}
+	}
+	if got := sampleCount(t, limiterWaitDuration.WithLabelValues(source)); got != 1 {
+		t.Errorf("limiter_wait_duration_seconds observed %d requests, want 1", got)
+	}
+}
+
+func TestLint(t *testing.T) {
+	problems, err := testutil.GatherAndLint(Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the go collector isn't ours
+	for _, problem := range problems {
+		if strings.HasPrefix(problem.Metric, namespace+"_") {
+			t.Errorf("metric %s: %s", problem.Metric, problem.Text)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package composite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	PluginName = "composite"
+)
+
+// Query is the json form of GetMetricsRequest.Query, for example:
+//
+//	{
+//	  "expression": "rate / cpu",
+//	  "operands": {
+//	    "rate": {"source": "prometheus", "query": "sum(rate(http_requests_total[5m]))"},
+//	    "cpu": {"source": "metrics-server", "metricName": "cpu"}
+//	  }
+//	}
+//
+// Every operand is fetched from another registered observer, the fields that
+// an operand leaves empty are inherited from the composite request.
+type Query struct {
+	Expression string             `json:"expression"`
+	Operands   map[string]Operand `json:"operands"`
+}
+
+type Operand struct {
+	Source      string   `json:"source"`
+	MetricName  string   `json:"metricName,omitempty"`
+	Query       string   `json:"query,omitempty"`
+	Kind        string   `json:"kind,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+	Aggregation []string `json:"aggregation,omitempty"`
+}
+
+type compositeServer struct {
+	name string
+}
+
+func NewCompositeServer(name string) *compositeServer {
+	return &compositeServer{name: name}
+}
+
+func (c *compositeServer) Name() string {
+	return c.name
+}
+
+// Sources is empty, the sources are named by the operands of each query.
+func (c *compositeServer) Sources() []string {
+	return nil
+}
+
+func (c *compositeServer) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{
+		"expression": {
+			Description: "evaluate an arithmetic expression over metrics of other observers",
+		},
+	}
+}
+
+func (c *compositeServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	method := "compositeServer/FetchData"
+	klog.V(4).Infof("%s req %s\n", method, req.String())
+
+	result := &obi.GetMetricsResponse{
+		Namespace: req.Namespace,
+		Unit:      req.Unit,
+		Source:    c.name,
+		Records:   []*obi.GetMetricsResponseRecord{},
+	}
+	if len(req.ResourceNames) > 0 {
+		result.ResourceName = req.ResourceNames[0]
+	}
+
+	query := Query{}
+	if err := json.Unmarshal([]byte(req.Query), &query); err != nil {
+		return result, rpcerrors.InvalidArgument("query", "invalid %s query: %s", PluginName, err)
+	}
+	expr, err := parseExpression(query.Expression)
+	if err != nil {
+		return result, rpcerrors.InvalidArgument("query", "%s", err)
+	}
+	names := identifiers(expr)
+	for _, name := range names {
+		if _, ok := query.Operands[name]; !ok {
+			return result, rpcerrors.InvalidArgument("query", "operand %s of expression '%s' isn't defined", name, query.Expression)
+		}
+	}
+
+	values, err := c.fetchOperands(ctx, req, query.Operands, names)
+	if err != nil {
+		return result, err
+	}
+	value, err := evaluate(expr, values)
+	if err != nil {
+		return result, fmt.Errorf("evaluate '%s' error: %w", query.Expression, err)
+	}
+
+	result.Records = append(result.Records, &obi.GetMetricsResponseRecord{
+		Timestamp: time.Now().UnixMilli(),
+		Value:     fmt.Sprintf("%f", value),
+	})
+	klog.V(5).Infof("%s evaluate '%s' with %v result: %f\n", method, query.Expression, values, value)
+	return result, nil
+}
+
+// fetchOperands requests all operands concurrently and returns the latest value
+// of each one.
+func (c *compositeServer) fetchOperands(ctx context.Context, req *obi.GetMetricsRequest, operands map[string]Operand, names []string) (map[string]float64, error) {
+	method := "compositeServer.fetchOperands"
+	results := make([]float64, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	for idx, name := range names {
+		operand := operands[name]
+		instance, ok := resource.GetRegisters(operand.Source)
+		if !ok {
+			return nil, rpcerrors.NotFound("source", operand.Source, "operand %s references unknown source %s", name, operand.Source)
+		}
+		if _, ok := resource.Unwrap(instance).(*compositeServer); ok {
+			return nil, rpcerrors.InvalidArgument("query", "operand %s can't reference the %s source", name, PluginName)
+		}
+
+		wg.Add(1)
+		go func(idx int, name string, instance resource.Observer, operandReq *obi.GetMetricsRequest) {
+			defer wg.Done()
+			defer rpcerrors.Recover("operand "+name, &errs[idx])
+			ctx, span := tracing.Start(ctx, "composite.Operand",
+				attribute.String("arbiter.source", operandReq.Source),
+				attribute.String("composite.operand", name),
+			)
+			response, err := instance.FetchData(ctx, operandReq)
+			tracing.End(span, err)
+			if err != nil {
+				klog.Errorf("%s fetch operand %s from %s error: %s\n", method, name, operandReq.Source, err)
+				errs[idx] = rpcerrors.Wrap(rpcerrors.FromError(operandReq.Source, err), "operand %s", name)
+				return
+			}
+			results[idx], errs[idx] = resource.LatestValue(response)
+			if errs[idx] != nil {
+				errs[idx] = fmt.Errorf("operand %s: %w", name, errs[idx])
+			}
+		}(idx, name, instance, operandRequest(req, operand))
+	}
+	wg.Wait()
+
+	values := make(map[string]float64, len(names))
+	for idx, name := range names {
+		if errs[idx] != nil {
+			return nil, errs[idx]
+		}
+		values[name] = results[idx]
+	}
+	return values, nil
+}
+
+// operandRequest builds the request of an operand, fields that the operand
+// leaves empty are inherited from the composite request.
+func operandRequest(req *obi.GetMetricsRequest, operand Operand) *obi.GetMetricsRequest {
+	operandReq := &obi.GetMetricsRequest{
+		ResourceNames: req.ResourceNames,
+		Namespace:     req.Namespace,
+		MetricName:    req.MetricName,
+		StartTime:     req.StartTime,
+		EndTime:       req.EndTime,
+		Kind:          req.Kind,
+		Unit:          req.Unit,
+		Source:        operand.Source,
+		Query:         operand.Query,
+	}
+	if operand.MetricName != "" {
+		operandReq.MetricName = operand.MetricName
+	}
+	if operand.Kind != "" {
+		operandReq.Kind = operand.Kind
+	}
+	if operand.Unit != "" {
+		operandReq.Unit = operand.Unit
+	}
+	// the composite evaluates a single value, so only the first aggregation of
+	// the request is inherited
+	switch {
+	case len(operand.Aggregation) > 0:
+		operandReq.Aggregation = operand.Aggregation[:1]
+	case len(req.Aggregation) > 0:
+		operandReq.Aggregation = req.Aggregation[:1]
+	}
+	return operandReq
+}
+
+// New creates a composite instance, it has no settings.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	return NewCompositeServer(cfg.Name), nil
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
+}
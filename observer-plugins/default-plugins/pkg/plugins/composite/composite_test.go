@@ -0,0 +1,261 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package composite
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// fakeSource answers its records, or fails, or returns the error of a context
+// which is done. A source with a barrier waits until every source of the
+// barrier is called, so that operands fetched one after the other time out.
+type fakeSource struct {
+	name    string
+	records []*obi.GetMetricsResponseRecord
+	err     error
+	barrier *sync.WaitGroup
+}
+
+func (f *fakeSource) Name() string {
+	return f.name
+}
+
+func (f *fakeSource) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{"cpu": {Aggregation: []string{"max", "avg"}}}
+}
+
+func (f *fakeSource) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.barrier != nil {
+		f.barrier.Done()
+		done := make(chan struct{})
+		go func() {
+			f.barrier.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			return nil, fmt.Errorf("%s: the operands aren't fetched concurrently", f.name)
+		}
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &obi.GetMetricsResponse{Source: f.name, Records: f.records}, nil
+}
+
+// records returns records of the values, a minute apart from at.
+func records(at time.Time, values ...string) []*obi.GetMetricsResponseRecord {
+	result := make([]*obi.GetMetricsResponseRecord, len(values))
+	for idx, value := range values {
+		result[idx] = &obi.GetMetricsResponseRecord{
+			Timestamp: at.Add(time.Duration(idx) * time.Minute).UnixMilli(),
+			Value:     value,
+		}
+	}
+	return result
+}
+
+// register registers the sources and the composite instance for the test.
+func register(t *testing.T, sources ...resource.Observer) {
+	t.Helper()
+	previous := resource.Registered()
+	t.Cleanup(func() {
+		instances := make([]resource.Observer, 0, len(previous))
+		for _, instance := range previous {
+			instances = append(instances, instance)
+		}
+		resource.Replace(instances)
+	})
+	resource.Replace(append(sources, NewCompositeServer("composite")))
+}
+
+func TestFetchData(t *testing.T) {
+	at := time.UnixMilli(1660000000000)
+	barrier := &sync.WaitGroup{}
+	barrier.Add(2)
+	register(t,
+		&fakeSource{name: "used", records: records(at, "1", "2", "3")},
+		// the records of total are newest first and later than the ones of used
+		&fakeSource{name: "total", records: []*obi.GetMetricsResponseRecord{
+			{Timestamp: at.Add(time.Hour).UnixMilli(), Value: "4"},
+			{Timestamp: at.UnixMilli(), Value: "40"},
+		}},
+		&fakeSource{name: "left", records: records(at, "1"), barrier: barrier},
+		&fakeSource{name: "right", records: records(at, "2"), barrier: barrier},
+		&fakeSource{name: "down", err: rpcerrors.Unavailable("connection refused")},
+		&fakeSource{name: "empty"},
+		&fakeSource{name: "text", records: records(at, "NaN?")},
+	)
+
+	tests := []struct {
+		name      string
+		query     string
+		want      string
+		wantCode  codes.Code
+		wantError string
+	}{
+		{
+			// the newest record of each operand is used, whatever their order
+			// and timestamps
+			name:  "the latest values of the operands are evaluated",
+			query: `{"expression": "used / total * 100", "operands": {"used": {"source": "used"}, "total": {"source": "total"}}}`,
+			want:  "75.000000",
+		},
+		{
+			// each operand waits until both are in flight
+			name:  "the operands are fetched concurrently",
+			query: `{"expression": "left + right", "operands": {"left": {"source": "left"}, "right": {"source": "right"}}}`,
+			want:  "3.000000",
+		},
+		{
+			name:      "a failing operand fails the request with its code",
+			query:     `{"expression": "used + down", "operands": {"used": {"source": "used"}, "down": {"source": "down"}}}`,
+			wantCode:  codes.Unavailable,
+			wantError: "operand down",
+		},
+		{
+			name:      "an operand without record",
+			query:     `{"expression": "used + empty", "operands": {"used": {"source": "used"}, "empty": {"source": "empty"}}}`,
+			wantCode:  codes.Unknown,
+			wantError: "operand empty: no records returned",
+		},
+		{
+			name:      "an operand whose value isn't a number",
+			query:     `{"expression": "text", "operands": {"text": {"source": "text"}}}`,
+			wantCode:  codes.Unknown,
+			wantError: "isn't a number",
+		},
+		{
+			name:     "an operand of an unknown source",
+			query:    `{"expression": "a", "operands": {"a": {"source": "missing"}}}`,
+			wantCode: codes.NotFound,
+		},
+		{
+			name:     "an operand of a composite source",
+			query:    `{"expression": "a", "operands": {"a": {"source": "composite"}}}`,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "an undefined operand",
+			query:    `{"expression": "a + b", "operands": {"a": {"source": "used"}}}`,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "an invalid expression",
+			query:    `{"expression": "a +", "operands": {"a": {"source": "used"}}}`,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "a query which isn't json",
+			query:    "used / total",
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := time.Now().UnixMilli()
+			response, err := NewCompositeServer("composite").FetchData(context.Background(), &obi.GetMetricsRequest{
+				Source: "composite", Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, Query: test.query,
+			})
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() code = %s, want %s, error %v", code, test.wantCode, err)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), test.wantError) {
+					t.Errorf("FetchData() error = %v, want %q", err, test.wantError)
+				}
+				return
+			}
+			if len(response.Records) != 1 || response.Records[0].Value != test.want {
+				t.Fatalf("FetchData() records = %v, want %s", response.Records, test.want)
+			}
+			// the value is evaluated now, not at the time of an operand
+			if timestamp := response.Records[0].Timestamp; timestamp < before {
+				t.Errorf("FetchData() timestamp = %d, before the request %d", timestamp, before)
+			}
+			if response.ResourceName != "web-0" || response.Namespace != "default" || response.Source != "composite" {
+				t.Errorf("FetchData() response = %v, want the resource of the request", response)
+			}
+		})
+	}
+}
+
+func TestOperandRequest(t *testing.T) {
+	req := &obi.GetMetricsRequest{
+		Source: "composite", Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+		MetricName: "ratio", Unit: "%", Aggregation: []string{"max", "avg"}, StartTime: 1, EndTime: 2,
+	}
+	tests := []struct {
+		name    string
+		operand Operand
+		want    *obi.GetMetricsRequest
+	}{
+		{
+			name:    "the fields are inherited with the first aggregation",
+			operand: Operand{Source: "used", Query: "q"},
+			want: &obi.GetMetricsRequest{
+				Source: "used", Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+				MetricName: "ratio", Unit: "%", Aggregation: []string{"max"}, StartTime: 1, EndTime: 2, Query: "q",
+			},
+		},
+		{
+			name:    "the fields of the operand override the request",
+			operand: Operand{Source: "total", MetricName: "cpu", Kind: "Node", Unit: "c", Aggregation: []string{"avg", "max"}},
+			want: &obi.GetMetricsRequest{
+				Source: "total", Kind: "Node", Namespace: "default", ResourceNames: []string{"web-0"},
+				MetricName: "cpu", Unit: "c", Aggregation: []string{"avg"}, StartTime: 1, EndTime: 2,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := operandRequest(req, test.operand); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("operandRequest() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	at := time.Now()
+	register(t, &fakeSource{name: "used", records: records(at, "1")}, &fakeSource{name: "total", records: records(at, "4")})
+	conformance.Suite{
+		Observer: NewCompositeServer("composite"),
+		Requests: []*obi.GetMetricsRequest{{
+			Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "expression",
+			Query: `{"expression": "used / total", "operands": {"used": {"source": "used"}, "total": {"source": "total"}}}`,
+		}},
+	}.Run(t)
+}
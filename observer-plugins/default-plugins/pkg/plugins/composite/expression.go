@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package composite
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"math"
+)
+
+// parseExpression parses an arithmetic expression such as '(a + b) / c * 100'.
+// Only numbers, operand identifiers, parentheses and + - * / are allowed.
+func parseExpression(expression string) (ast.Expr, error) {
+	expr, err := parser.ParseExpr(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression '%s': %w", expression, err)
+	}
+	var walkErr error
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if walkErr != nil {
+			return false
+		}
+		switch n := node.(type) {
+		case nil, *ast.Ident, *ast.ParenExpr:
+		case *ast.BasicLit:
+			if n.Kind != token.INT && n.Kind != token.FLOAT {
+				walkErr = fmt.Errorf("expression '%s' has unsupported literal %s", expression, n.Value)
+			} else if _, ok := literalValue(n); !ok {
+				walkErr = fmt.Errorf("expression '%s' has out of range number %s", expression, n.Value)
+			}
+		case *ast.UnaryExpr:
+			if n.Op != token.ADD && n.Op != token.SUB {
+				walkErr = fmt.Errorf("expression '%s' has unsupported operator %s", expression, n.Op)
+			}
+		case *ast.BinaryExpr:
+			switch n.Op {
+			case token.ADD, token.SUB, token.MUL, token.QUO:
+			default:
+				walkErr = fmt.Errorf("expression '%s' has unsupported operator %s", expression, n.Op)
+			}
+		default:
+			walkErr = fmt.Errorf("expression '%s' has unsupported syntax %T", expression, node)
+		}
+		return walkErr == nil
+	})
+	return expr, walkErr
+}
+
+// identifiers returns the operand names referenced by the expression.
+func identifiers(expr ast.Expr) []string {
+	seen := map[string]struct{}{}
+	names := make([]string, 0)
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if _, ok := seen[ident.Name]; !ok {
+				seen[ident.Name] = struct{}{}
+				names = append(names, ident.Name)
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// evaluate computes the expression with the operand values.
+func evaluate(expr ast.Expr, values map[string]float64) (float64, error) {
+	switch n := expr.(type) {
+	case *ast.BasicLit:
+		v, ok := literalValue(n)
+		if !ok {
+			return 0, fmt.Errorf("invalid number %s", n.Value)
+		}
+		return v, nil
+	case *ast.Ident:
+		v, ok := values[n.Name]
+		if !ok {
+			return 0, fmt.Errorf("operand %s has no value", n.Name)
+		}
+		return v, nil
+	case *ast.ParenExpr:
+		return evaluate(n.X, values)
+	case *ast.UnaryExpr:
+		v, err := evaluate(n.X, values)
+		if err != nil {
+			return 0, err
+		}
+		if n.Op == token.SUB {
+			return -v, nil
+		}
+		return v, nil
+	case *ast.BinaryExpr:
+		x, err := evaluate(n.X, values)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evaluate(n.Y, values)
+		if err != nil {
+			return 0, err
+		}
+		switch n.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return x / y, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported expression %T", expr)
+}
+
+// literalValue converts a number literal as the go compiler does, so that the
+// forms accepted by the parser, such as 0x10, 0o17, 1_000 or 1e3, are valid.
+// It's false when the literal can't be represented by a float64.
+func literalValue(lit *ast.BasicLit) (float64, bool) {
+	value := constant.MakeFromLiteral(lit.Value, lit.Kind, 0)
+	if value.Kind() != constant.Int && value.Kind() != constant.Float {
+		return 0, false
+	}
+	v, _ := constant.Float64Val(value)
+	return v, !math.IsInf(v, 0)
+}
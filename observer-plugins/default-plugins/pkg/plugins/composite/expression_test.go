@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package composite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    bool
+	}{
+		{expression: "(a + b) / c * 100"},
+		{expression: "-a + +b"},
+		{expression: "0x10 + 0o17 + 0b101 + 1_000 + 1e3 + .5"},
+		{expression: "a % b", wantErr: true},
+		{expression: "a && b", wantErr: true},
+		{expression: "!a", wantErr: true},
+		{expression: "f(a)", wantErr: true},
+		{expression: "a.b", wantErr: true},
+		{expression: "a[0]", wantErr: true},
+		{expression: `"text"`, wantErr: true},
+		{expression: "'c'", wantErr: true},
+		{expression: "2i", wantErr: true},
+		{expression: "1e400", wantErr: true},
+		{expression: "a +", wantErr: true},
+		{expression: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			_, err := parseExpression(test.expression)
+			if (err != nil) != test.wantErr {
+				t.Errorf("parseExpression() error = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	expr, err := parseExpression("(used + cached) / total - used")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"used", "cached", "total"}
+	if got := identifiers(expr); !reflect.DeepEqual(got, want) {
+		t.Errorf("identifiers() = %v, want %v", got, want)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	values := map[string]float64{"a": 6, "b": 2, "zero": 0}
+	tests := []struct {
+		expression string
+		want       float64
+		wantErr    bool
+	}{
+		{expression: "a + b * 3", want: 12},
+		{expression: "(a + b) * 3", want: 24},
+		{expression: "a / b - 1", want: 2},
+		{expression: "-a + +b", want: -4},
+		{expression: "2.5", want: 2.5},
+		{expression: ".5 * a", want: 3},
+		{expression: "1e3", want: 1000},
+		{expression: "0x10", want: 16},
+		{expression: "0o17", want: 15},
+		{expression: "017", want: 15},
+		{expression: "0b101", want: 5},
+		{expression: "1_000 * a", want: 6000},
+		{expression: "0x1p-2", want: 0.25},
+		{expression: "a / zero", wantErr: true},
+		{expression: "a + missing", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			expr, err := parseExpression(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := evaluate(expr, values)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("evaluate() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("evaluate() = %f, want %f", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cost
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	PluginName = "cost"
+
+	PodKind       = "Pod"
+	NodeKind      = "Node"
+	NamespaceKind = "Namespace"
+
+	CPUMetric    = "cpu"
+	MemoryMetric = "memory"
+	TotalMetric  = "cost"
+	CostUnit     = "per-hour"
+
+	defaultUsageSource = "metrics-server"
+	bytesPerGiB        = 1 << 30
+	milliPerCore       = 1000
+)
+
+// costServer prices the cpu and memory usage reported by another observer with
+// the price of the node the workload runs on.
+type costServer struct {
+	name        string
+	client      kubernetes.Interface
+	table       *PriceTable
+	cpuQuery    *template.Template
+	memoryQuery *template.Template
+}
+
+func NewCostServer(name string, client kubernetes.Interface, table *PriceTable) (*costServer, error) {
+	cpuQuery, err := template.New("cpu").Option("missingkey=error").Parse(table.Usage.CPUQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cpu query template: %w", err)
+	}
+	memoryQuery, err := template.New("memory").Option("missingkey=error").Parse(table.Usage.MemoryQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory query template: %w", err)
+	}
+	return &costServer{
+		name:        name,
+		client:      client,
+		table:       table,
+		cpuQuery:    cpuQuery,
+		memoryQuery: memoryQuery,
+	}, nil
+}
+
+func (c *costServer) Name() string {
+	return c.name
+}
+
+// Probe checks that the api server is reachable.
+func (c *costServer) Probe(ctx context.Context) error {
+	return c.client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+func (c *costServer) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{
+		TotalMetric: {
+			MetricUnit:  CostUnit,
+			Description: "cpu and memory cost per hour of a pod, node or namespace",
+		},
+		CPUMetric: {
+			MetricUnit:  CostUnit,
+			Description: "cpu cost per hour of a pod, node or namespace",
+		},
+		MemoryMetric: {
+			MetricUnit:  CostUnit,
+			Description: "memory cost per hour of a pod, node or namespace",
+		},
+	}
+}
+
+func (c *costServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	method := "costServer/FetchData"
+	klog.V(4).Infof("%s req %s\n", method, req.String())
+
+	result := &obi.GetMetricsResponse{
+		Namespace: req.Namespace,
+		Unit:      CostUnit,
+		Source:    c.name,
+		Records:   []*obi.GetMetricsResponseRecord{},
+	}
+	if len(req.ResourceNames) > 0 {
+		result.ResourceName = req.ResourceNames[0]
+	}
+
+	var (
+		cost Cost
+		err  error
+	)
+	switch req.Kind {
+	case PodKind:
+		if result.ResourceName == "" {
+			return result, rpcerrors.InvalidArgument("resource_names", "%s requires the pod name", PluginName)
+		}
+		cost, err = c.podCost(ctx, req, req.Namespace, result.ResourceName)
+	case NodeKind:
+		if result.ResourceName == "" {
+			return result, rpcerrors.InvalidArgument("resource_names", "%s requires the node name", PluginName)
+		}
+		cost, err = c.nodeCost(ctx, req, result.ResourceName)
+	case NamespaceKind:
+		namespace := result.ResourceName
+		if namespace == "" {
+			namespace = req.Namespace
+		}
+		cost, err = c.namespaceCost(ctx, req, namespace)
+	default:
+		return result, rpcerrors.InvalidArgument("kind", "%s doesn't support kind %s", PluginName, req.Kind)
+	}
+	if err != nil {
+		klog.Errorf("%s get cost of %s %s error: %s\n", method, req.Kind, result.ResourceName, err)
+		return result, err
+	}
+
+	value := cost.CPU + cost.Memory
+	switch req.MetricName {
+	case CPUMetric:
+		value = cost.CPU
+	case MemoryMetric:
+		value = cost.Memory
+	}
+	result.Records = append(result.Records, &obi.GetMetricsResponseRecord{
+		Timestamp: time.Now().UnixMilli(),
+		Value:     fmt.Sprintf("%f", value),
+	})
+	klog.V(5).Infof("%s cost of %s %s: %+v\n", method, req.Kind, result.ResourceName, cost)
+	return result, nil
+}
+
+// Cost is the hourly cost of the cpu and memory usage.
+type Cost struct {
+	CPU    float64
+	Memory float64
+}
+
+func (c *costServer) nodeCost(ctx context.Context, req *obi.GetMetricsRequest, name string) (Cost, error) {
+	node, err := c.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return Cost{}, err
+	}
+	price, err := c.table.Match(node.Labels)
+	if err != nil {
+		return Cost{}, err
+	}
+	return c.usageCost(ctx, req, NodeKind, "", name, price)
+}
+
+// podCost prices the usage of the pod with the price of its node.
+func (c *costServer) podCost(ctx context.Context, req *obi.GetMetricsRequest, namespace, name string) (Cost, error) {
+	pod, err := c.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return Cost{}, err
+	}
+	if pod.Spec.NodeName == "" {
+		return Cost{}, fmt.Errorf("pod %s/%s isn't scheduled yet", pod.Namespace, pod.Name)
+	}
+	node, err := c.client.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return Cost{}, err
+	}
+	return c.scheduledPodCost(ctx, req, pod, node)
+}
+
+func (c *costServer) scheduledPodCost(ctx context.Context, req *obi.GetMetricsRequest, pod *v1.Pod, node *v1.Node) (Cost, error) {
+	price, err := c.table.Match(node.Labels)
+	if err != nil {
+		return Cost{}, err
+	}
+	return c.usageCost(ctx, req, PodKind, pod.Namespace, pod.Name, price)
+}
+
+// namespaceConcurrency bounds the pods of a namespace priced at the same time.
+const namespaceConcurrency = 8
+
+// namespaceCost sums the cost of the running pods in the namespace, priced
+// concurrently. A pod which can't be priced, such as a pod whose usage isn't
+// reported yet, is logged and left out of the sum, so that a single pod doesn't
+// hide the cost of the others. The cost is an error when no pod can be priced.
+func (c *costServer) namespaceCost(ctx context.Context, req *obi.GetMetricsRequest, namespace string) (Cost, error) {
+	method := "costServer.namespaceCost"
+	if namespace == "" {
+		return Cost{}, rpcerrors.InvalidArgument("namespace", "%s requires the namespace name", PluginName)
+	}
+	pods, err := c.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase=" + string(v1.PodRunning),
+	})
+	if err != nil {
+		return Cost{}, err
+	}
+
+	// each node is fetched once for all its pods
+	nodes := map[string]*v1.Node{}
+	nodeErrs := map[string]error{}
+	for idx := range pods.Items {
+		name := pods.Items[idx].Spec.NodeName
+		if _, ok := nodes[name]; ok || name == "" || nodeErrs[name] != nil {
+			continue
+		}
+		node, err := c.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			nodeErrs[name] = err
+			continue
+		}
+		nodes[name] = node
+	}
+
+	costs := make([]Cost, len(pods.Items))
+	errs := make([]error, len(pods.Items))
+	slots := make(chan struct{}, namespaceConcurrency)
+	var wg sync.WaitGroup
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		node, ok := nodes[pod.Spec.NodeName]
+		switch {
+		case pod.Spec.NodeName == "":
+			errs[idx] = fmt.Errorf("pod %s/%s isn't scheduled yet", pod.Namespace, pod.Name)
+			continue
+		case !ok:
+			errs[idx] = nodeErrs[pod.Spec.NodeName]
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer rpcerrors.Recover("pod "+pod.Name, &errs[idx])
+			costs[idx], errs[idx] = c.scheduledPodCost(ctx, req, pod, node)
+		}(idx)
+	}
+	wg.Wait()
+
+	total := Cost{}
+	var firstErr error
+	failed := 0
+	for idx := range pods.Items {
+		if errs[idx] != nil {
+			klog.Warningf("%s skip pod %s/%s: %s\n", method, namespace, pods.Items[idx].Name, errs[idx])
+			if firstErr == nil {
+				firstErr = errs[idx]
+			}
+			failed++
+			continue
+		}
+		total.CPU += costs[idx].CPU
+		total.Memory += costs[idx].Memory
+	}
+	if failed > 0 && failed == len(pods.Items) {
+		return Cost{}, rpcerrors.Wrap(firstErr, "no pod of namespace %s can be priced", namespace)
+	}
+	return total, nil
+}
+
+// usageCost fetches the cpu and memory usage of the resource from the usage
+// source and multiplies them by the price.
+func (c *costServer) usageCost(ctx context.Context, req *obi.GetMetricsRequest, kind, namespace, name string, price *Price) (Cost, error) {
+	instance, ok := resource.GetRegisters(c.table.Usage.Source)
+	if !ok {
+		return Cost{}, rpcerrors.Unavailable("usage source %s isn't registered", c.table.Usage.Source)
+	}
+
+	cpu, err := c.usage(ctx, instance, req, CPUMetric, c.cpuQuery, kind, namespace, name)
+	if err != nil {
+		return Cost{}, err
+	}
+	memory, err := c.usage(ctx, instance, req, MemoryMetric, c.memoryQuery, kind, namespace, name)
+	if err != nil {
+		return Cost{}, err
+	}
+
+	return Cost{
+		CPU:    cpu / milliPerCore * price.CPUCoreHour,
+		Memory: memory / bytesPerGiB * price.MemoryGiBHour,
+	}, nil
+}
+
+// usage returns the cpu usage in millicores or the memory usage in bytes.
+func (c *costServer) usage(ctx context.Context, instance resource.Observer, req *obi.GetMetricsRequest,
+	metricName string, query *template.Template, kind, namespace, name string) (float64, error) {
+	var buf bytes.Buffer
+	if err := query.Execute(&buf, struct{ Namespace, Name, Kind string }{namespace, name, kind}); err != nil {
+		return 0, fmt.Errorf("render %s query error: %w", metricName, err)
+	}
+
+	unit := "byte"
+	if metricName == CPUMetric {
+		unit = "m"
+	}
+	// the cost is a single value, so only the first aggregation is used
+	var aggregation []string
+	if len(req.Aggregation) > 0 {
+		aggregation = req.Aggregation[:1]
+	}
+	response, err := instance.FetchData(ctx, &obi.GetMetricsRequest{
+		ResourceNames: []string{name},
+		Namespace:     namespace,
+		MetricName:    metricName,
+		Aggregation:   aggregation,
+		Query:         buf.String(),
+		StartTime:     req.StartTime,
+		EndTime:       req.EndTime,
+		Kind:          kind,
+		Unit:          unit,
+		Source:        c.table.Usage.Source,
+	})
+	if err != nil {
+		return 0, rpcerrors.Wrap(err, "get %s usage of %s %s from %s", metricName, kind, name, c.table.Usage.Source)
+	}
+	return resource.LatestValue(response)
+}
+
+// Options are the cost settings of the plugin config, the price table is either
+// written inline or read from priceTableFile.
+type Options struct {
+	PriceTableFile string `json:"priceTableFile,omitempty"`
+	PriceTable
+}
+
+// New creates a cost instance from its config, without a price table in the
+// options the --cost-price-table file is used.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	opts := Options{}
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		return nil, err
+	}
+
+	var (
+		table *PriceTable
+		err   error
+	)
+	switch {
+	case opts.PriceTableFile != "":
+		table, err = LoadPriceTable(opts.PriceTableFile)
+	case len(opts.Prices) > 0 || opts.Default != nil:
+		table = &opts.PriceTable
+		err = table.complete()
+	case *flags.CostPriceTable != "":
+		table, err = LoadPriceTable(*flags.CostPriceTable)
+	default:
+		return nil, fmt.Errorf("%w: %s has no price table", resource.ErrNotConfigured, cfg.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	restConf, err := clientcmd.BuildConfigFromFlags("", *flags.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	restConf.Wrap(metrics.InstrumentRoundTripper(cfg.Name, "kube-apiserver"))
+	restConf.Wrap(tracing.RoundTripper)
+	client, err := kubernetes.NewForConfig(restConf)
+	if err != nil {
+		return nil, err
+	}
+	return NewCostServer(cfg.Name, client, table)
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
+}
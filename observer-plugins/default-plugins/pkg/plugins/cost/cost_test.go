@@ -0,0 +1,294 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cost
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	metricsserver "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/metrics-server"
+	observers "github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakemetricsapi"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+func usage(cpu, memory string) v1.ResourceList {
+	return v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu), v1.ResourceMemory: resource.MustParse(memory)}
+}
+
+func pod(namespace, name, node string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       v1.PodSpec{NodeName: node},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+// newTestServer returns a cost instance whose usage source is a metrics-server
+// instance reading a fake metrics api. node-1 is a spot node, node-2 has the
+// default price, and web-2 and job-0 have no usage.
+func newTestServer(t *testing.T) *costServer {
+	t.Helper()
+	metricsAPI := fakemetricsapi.NewServer()
+	t.Cleanup(metricsAPI.Close)
+	metricsAPI.AddNode("node-1", usage("1500m", "2Gi"))
+	metricsAPI.AddPod("default", "web-0", map[string]v1.ResourceList{"app": usage("500m", "1Gi")})
+	metricsAPI.AddPod("default", "web-1", map[string]v1.ResourceList{"app": usage("200m", "256Mi"), "sidecar": usage("50m", "256Mi")})
+	usageSource, err := metricsserver.NewMetricServer("metrics-server", metricsAPI.RestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	observers.Replace([]observers.Observer{usageSource})
+	t.Cleanup(func() { observers.Replace(nil) })
+
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"node.kubernetes.io/lifecycle": "spot"}}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		pod("default", "web-0", "node-1"),
+		pod("default", "web-1", "node-2"),
+		pod("default", "web-2", "node-2"),
+		pod("default", "pending", ""),
+		pod("batch", "job-0", "node-1"),
+	)
+	table := &PriceTable{
+		Prices: []Price{{
+			NodeSelector:  map[string]string{"node.kubernetes.io/lifecycle": "spot"},
+			CPUCoreHour:   0.01,
+			MemoryGiBHour: 0.001,
+		}},
+		Default: &Price{CPUCoreHour: 0.04, MemoryGiBHour: 0.005},
+	}
+	if err := table.complete(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewCostServer("cost", client, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestFetchData(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name     string
+		req      *obi.GetMetricsRequest
+		want     string
+		wantErr  bool
+		wantCode codes.Code
+	}{
+		{
+			name: "node cost with the matching price",
+			req:  &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: TotalMetric},
+			want: "0.017000",
+		},
+		{
+			name: "pod cost with the price of its node",
+			req:  &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: TotalMetric},
+			want: "0.006000",
+		},
+		{
+			name: "pod cpu cost with the default price",
+			req:  &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-1"}, MetricName: CPUMetric},
+			want: "0.010000",
+		},
+		{
+			name: "pod memory cost with the default price",
+			req:  &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-1"}, MetricName: MemoryMetric},
+			want: "0.002500",
+		},
+		{
+			name: "namespace cost skips the pods which can't be priced",
+			req:  &obi.GetMetricsRequest{Kind: NamespaceKind, ResourceNames: []string{"default"}, MetricName: TotalMetric},
+			want: "0.018500",
+		},
+		{
+			name: "namespace of the request",
+			req:  &obi.GetMetricsRequest{Kind: NamespaceKind, Namespace: "default", MetricName: CPUMetric},
+			want: "0.015000",
+		},
+		{
+			name:    "namespace without a pod which can be priced",
+			req:     &obi.GetMetricsRequest{Kind: NamespaceKind, ResourceNames: []string{"batch"}, MetricName: TotalMetric},
+			wantErr: true,
+		},
+		{
+			name: "empty namespace",
+			req:  &obi.GetMetricsRequest{Kind: NamespaceKind, ResourceNames: []string{"empty"}, MetricName: TotalMetric},
+			want: "0.000000",
+		},
+		{
+			name:    "pod without usage",
+			req:     &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-2"}, MetricName: TotalMetric},
+			wantErr: true,
+		},
+		{
+			name:    "pod not scheduled",
+			req:     &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"pending"}, MetricName: TotalMetric},
+			wantErr: true,
+		},
+		{
+			name:     "pod without name",
+			req:      &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", MetricName: TotalMetric},
+			wantErr:  true,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "namespace without name",
+			req:      &obi.GetMetricsRequest{Kind: NamespaceKind, MetricName: TotalMetric},
+			wantErr:  true,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unknown kind",
+			req:      &obi.GetMetricsRequest{Kind: "Deployment", ResourceNames: []string{"web"}, MetricName: TotalMetric},
+			wantErr:  true,
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := server.FetchData(context.Background(), test.req)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("FetchData() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				if test.wantCode != codes.OK && status.Code(err) != test.wantCode {
+					t.Errorf("FetchData() error = %v, want code %s", err, test.wantCode)
+				}
+				return
+			}
+			if len(got.Records) != 1 || got.Records[0].Value != test.want {
+				t.Errorf("FetchData() records = %v, want %s", got.Records, test.want)
+			}
+			if got.Unit != CostUnit {
+				t.Errorf("FetchData() unit = %s, want %s", got.Unit, CostUnit)
+			}
+		})
+	}
+}
+
+func TestPriceTableComplete(t *testing.T) {
+	defaultPrice := &Price{CPUCoreHour: 0.04, MemoryGiBHour: 0.005}
+	tests := []struct {
+		name       string
+		table      PriceTable
+		wantSource string
+		wantErr    bool
+	}{
+		{
+			name:       "metrics-server by default",
+			table:      PriceTable{Default: defaultPrice},
+			wantSource: "metrics-server",
+		},
+		{
+			name: "query based source",
+			table: PriceTable{
+				Usage:   Usage{Source: "prometheus", CPUQuery: "cpu{pod=\"{{.Name}}\"}", MemoryQuery: "memory{pod=\"{{.Name}}\"}"},
+				Default: defaultPrice,
+			},
+			wantSource: "prometheus",
+		},
+		{
+			name:    "query based source without queries",
+			table:   PriceTable{Usage: Usage{Source: "prometheus"}, Default: defaultPrice},
+			wantErr: true,
+		},
+		{
+			name:    "cpu query without memory query",
+			table:   PriceTable{Usage: Usage{Source: "prometheus", CPUQuery: "cpu"}, Default: defaultPrice},
+			wantErr: true,
+		},
+		{
+			name:    "no prices",
+			table:   PriceTable{},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.table.complete()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("complete() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && test.table.Usage.Source != test.wantSource {
+				t.Errorf("complete() source = %s, want %s", test.table.Usage.Source, test.wantSource)
+			}
+		})
+	}
+}
+
+func TestPriceTableMatch(t *testing.T) {
+	spot := Price{NodeSelector: map[string]string{"lifecycle": "spot"}, CPUCoreHour: 0.01}
+	large := Price{NodeSelector: map[string]string{"type": "large"}, CPUCoreHour: 0.08}
+	tests := []struct {
+		name    string
+		table   PriceTable
+		labels  map[string]string
+		want    float64
+		wantErr bool
+	}{
+		{
+			name:   "first matching price",
+			table:  PriceTable{Prices: []Price{spot, large}},
+			labels: map[string]string{"lifecycle": "spot", "type": "large"},
+			want:   0.01,
+		},
+		{
+			name:   "default price",
+			table:  PriceTable{Prices: []Price{spot}, Default: &Price{CPUCoreHour: 0.04}},
+			labels: map[string]string{"type": "large"},
+			want:   0.04,
+		},
+		{
+			name:    "no matching price",
+			table:   PriceTable{Prices: []Price{spot}},
+			labels:  map[string]string{"type": "large"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.table.Match(test.labels)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Match() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && got.CPUCoreHour != test.want {
+				t.Errorf("Match() cpu price = %f, want %f", got.CPUCoreHour, test.want)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Suite{
+		Observer: newTestServer(t),
+		Requests: []*obi.GetMetricsRequest{
+			{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: TotalMetric},
+			{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: CPUMetric},
+			{Kind: NamespaceKind, ResourceNames: []string{"default"}, MetricName: MemoryMetric},
+		},
+	}.Run(t)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cost
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// PriceTable is loaded from the file given by --cost-price-table, for example:
+//
+//	usage:
+//	  source: metrics-server
+//	prices:
+//	- nodeSelector:
+//	    node.kubernetes.io/instance-type: m5.large
+//	    node.kubernetes.io/lifecycle: spot
+//	  cpuCoreHour: 0.012
+//	  memoryGiBHour: 0.0016
+//	default:
+//	  cpuCoreHour: 0.034
+//	  memoryGiBHour: 0.0045
+//
+// The first price whose nodeSelector matches the labels of the node is used,
+// the default price is used when no price matches.
+type PriceTable struct {
+	Usage   Usage   `json:"usage"`
+	Prices  []Price `json:"prices"`
+	Default *Price  `json:"default,omitempty"`
+}
+
+// Usage describes where the cpu and memory usage comes from. The queries are
+// text/templates filled with {{.Namespace}}, {{.Name}} and {{.Kind}}, they're
+// required unless the source is metrics-server, which reports the usage
+// without a query, and must return cpu in millicores and memory in bytes.
+type Usage struct {
+	Source      string `json:"source"`
+	CPUQuery    string `json:"cpuQuery,omitempty"`
+	MemoryQuery string `json:"memoryQuery,omitempty"`
+}
+
+type Price struct {
+	NodeSelector  map[string]string `json:"nodeSelector,omitempty"`
+	CPUCoreHour   float64           `json:"cpuCoreHour"`
+	MemoryGiBHour float64           `json:"memoryGiBHour"`
+}
+
+// LoadPriceTable reads and validates the price table file.
+func LoadPriceTable(path string) (*PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := &PriceTable{}
+	if err := yaml.UnmarshalStrict(data, table); err != nil {
+		return nil, fmt.Errorf("parse price table %s error: %w", path, err)
+	}
+	if err := table.complete(); err != nil {
+		return nil, fmt.Errorf("invalid price table %s: %w", path, err)
+	}
+	return table, nil
+}
+
+// complete fills the defaults and validates the price table.
+func (t *PriceTable) complete() error {
+	if t.Usage.Source == "" {
+		t.Usage.Source = defaultUsageSource
+	}
+	if len(t.Prices) == 0 && t.Default == nil {
+		return fmt.Errorf("no prices")
+	}
+	switch {
+	case (t.Usage.CPUQuery == "") != (t.Usage.MemoryQuery == ""):
+		return fmt.Errorf("usage requires both the cpuQuery and the memoryQuery, or none of them")
+	case t.Usage.CPUQuery == "" && t.Usage.Source != defaultUsageSource:
+		return fmt.Errorf("usage source %s requires the cpuQuery and the memoryQuery, only %s reports the usage without a query",
+			t.Usage.Source, defaultUsageSource)
+	}
+	return nil
+}
+
+// Match returns the price of a node with the given labels.
+func (t *PriceTable) Match(nodeLabels map[string]string) (*Price, error) {
+	for idx := range t.Prices {
+		if labels.SelectorFromSet(t.Prices[idx].NodeSelector).Matches(labels.Set(nodeLabels)) {
+			return &t.Prices[idx], nil
+		}
+	}
+	if t.Default != nil {
+		return t.Default, nil
+	}
+	return nil, fmt.Errorf("no price matches node labels %v", nodeLabels)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package failover
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	PluginName = "failover"
+)
+
+// failoverServer forwards the request to the first of its sources, and to the
+// next one each time a source fails. The response reports the source which
+// answered.
+type failoverServer struct {
+	name    string
+	sources []string
+}
+
+func NewFailoverServer(name string, sources []string) *failoverServer {
+	return &failoverServer{name: name, sources: sources}
+}
+
+func (f *failoverServer) Name() string {
+	return f.name
+}
+
+func (f *failoverServer) Sources() []string {
+	return f.sources
+}
+
+// Capabilities merges the capabilities of the sources, the unit and the
+// description of a metric are the ones of the first source listing it, and its
+// aggregations are the ones of every source. A request is only sent to the
+// sources listing all its aggregations, see supports.
+func (f *failoverServer) Capabilities() map[string]*obi.CapabilityInfo {
+	capabilities := map[string]*obi.CapabilityInfo{}
+	for _, source := range f.sources {
+		instance, ok := resource.GetRegisters(source)
+		if !ok {
+			continue
+		}
+		for metric, capability := range instance.Capabilities() {
+			if capability == nil {
+				continue
+			}
+			merged, ok := capabilities[metric]
+			if !ok {
+				merged = proto.Clone(capability).(*obi.CapabilityInfo)
+				capabilities[metric] = merged
+				continue
+			}
+			for _, op := range capability.Aggregation {
+				if !contains(merged.Aggregation, op) {
+					merged.Aggregation = append(merged.Aggregation, op)
+				}
+			}
+		}
+	}
+	return capabilities
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe succeeds when one of the sources is reachable.
+func (f *failoverServer) Probe(ctx context.Context) error {
+	errs := make([]string, 0, len(f.sources))
+	for _, source := range f.sources {
+		instance, ok := resource.GetRegisters(source)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: not registered", source))
+			continue
+		}
+		prober, ok := instance.(resource.Prober)
+		if !ok {
+			return nil
+		}
+		err := prober.Probe(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", source, err))
+	}
+	return rpcerrors.Unavailable("no source of %s is reachable: %s", f.name, strings.Join(errs, "; "))
+}
+
+func (f *failoverServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	method := "failoverServer/FetchData"
+	klog.V(4).Infof("%s req %s\n", method, req.String())
+
+	var (
+		lastErr, skipErr error
+		failures         []string
+	)
+	for _, source := range f.sources {
+		instance, ok := resource.GetRegisters(source)
+		if !ok {
+			lastErr = rpcerrors.NotFound("source", source, "source %s isn't registered", source)
+			failures = append(failures, status.Convert(lastErr).Message())
+			continue
+		}
+		if _, ok := resource.Unwrap(instance).(*failoverServer); ok {
+			return nil, rpcerrors.InvalidArgument("source", "%s can't reference the %s source %s", f.name, PluginName, source)
+		}
+		if err := supports(instance, source, req); err != nil {
+			klog.V(4).Infof("%s %s skip source %s: %s\n", method, f.name, source, err)
+			skipErr = err
+			failures = append(failures, status.Convert(err).Message())
+			continue
+		}
+
+		response, err := f.fetch(ctx, instance, source, req)
+		if err == nil {
+			response.Source = source
+			return response, nil
+		}
+		klog.Warningf("%s %s fetch data from %s error: %s\n", method, f.name, source, err)
+		lastErr = rpcerrors.Wrap(rpcerrors.FromError(source, err), "source %s", source)
+		failures = append(failures, status.Convert(lastErr).Message())
+		// the caller is gone or the deadline of the failover is exceeded, the
+		// next sources can't answer either
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// a skipped source doesn't hide the error of a source which failed
+	if lastErr == nil {
+		lastErr = skipErr
+	}
+	if lastErr == nil {
+		return nil, rpcerrors.InvalidArgument("source", "%s has no source", f.name)
+	}
+	// the code and details are the ones of the last source which failed, or
+	// of the last skipped one when every source was skipped, the message lists
+	// the errors of all sources
+	last := status.Convert(lastErr).Proto()
+	last.Message = fmt.Sprintf("%s failed over all sources: %s", f.name, strings.Join(failures, "; "))
+	return nil, status.ErrorProto(last)
+}
+
+// supports checks that the source computes every aggregation of the request,
+// so that it returns one record per aggregation. The sources which don't list
+// them are skipped, so a request only fails over between the sources which
+// answer it the same way: with prometheus and metrics-server, max is answered
+// by prometheus only and time by metrics-server only. A source which doesn't
+// aggregate, such as metrics-server, returns a single record, it can't answer
+// several aggregations.
+func supports(instance resource.Observer, source string, req *obi.GetMetricsRequest) error {
+	supported := resource.SupportedAggregations(instance, req.MetricName)
+	if len(supported) == 0 {
+		if len(req.Aggregation) > 1 {
+			return rpcerrors.InvalidArgument("aggregation", "source %s doesn't aggregate, it can't answer aggregations %s",
+				source, strings.Join(req.Aggregation, ","))
+		}
+		return nil
+	}
+	for idx, op := range req.Aggregation {
+		if !contains(supported, op) {
+			return rpcerrors.InvalidArgument(fmt.Sprintf("aggregation[%d]", idx), "aggregation %s isn't supported by source %s", op, source)
+		}
+	}
+	return nil
+}
+
+// fetch requests one source in a span, a panic of the source is returned as an
+// error so that the next source is tried.
+func (f *failoverServer) fetch(ctx context.Context, instance resource.Observer, source string, req *obi.GetMetricsRequest) (response *obi.GetMetricsResponse, err error) {
+	defer rpcerrors.Recover("source "+source, &err)
+	ctx, span := tracing.Start(ctx, "failover.Attempt", attribute.String("arbiter.source", source))
+	sourceReq := proto.Clone(req).(*obi.GetMetricsRequest)
+	sourceReq.Source = source
+	response, err = instance.FetchData(ctx, sourceReq)
+	tracing.End(span, err)
+	return response, err
+}
+
+// Options are the failover settings of the plugin config.
+type Options struct {
+	// Sources are tried in order, a source can't be another failover.
+	Sources []string `json:"sources"`
+}
+
+// New creates a failover instance from its config, without sources in the
+// options the --failover-sources flag is used.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	opts := Options{}
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Sources) == 0 && *flags.FailoverSources != "" {
+		opts.Sources = strings.Split(*flags.FailoverSources, ",")
+	}
+	if len(opts.Sources) == 0 {
+		return nil, fmt.Errorf("%w: %s has no sources", resource.ErrNotConfigured, cfg.Name)
+	}
+	for _, source := range opts.Sources {
+		if source == "" || source == cfg.Name {
+			return nil, fmt.Errorf("invalid source '%s' of %s", source, cfg.Name)
+		}
+	}
+	return NewFailoverServer(cfg.Name, opts.Sources), nil
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
+}
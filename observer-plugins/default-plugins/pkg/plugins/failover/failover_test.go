@@ -0,0 +1,255 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package failover
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// fakeSource answers one record per aggregation, or one record when it
+// doesn't aggregate, unless it fails or hangs. Like the plugins, it rejects the
+// requests without resource and returns the error of a context which is done.
+type fakeSource struct {
+	name         string
+	aggregations []string
+	err          error
+	hang         bool
+}
+
+func (f *fakeSource) Name() string {
+	return f.name
+}
+
+func (f *fakeSource) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{"cpu": {Description: "cpu of " + f.name, Aggregation: f.aggregations}}
+}
+
+func (f *fakeSource) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	if f.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(req.ResourceNames) == 0 {
+		return nil, rpcerrors.InvalidArgument("resource_names", "%s requires a resource name", f.name)
+	}
+	response := &obi.GetMetricsResponse{Source: req.Source, ResourceName: req.ResourceNames[0], Namespace: req.Namespace}
+	for range resource.Aggregations(req, "avg") {
+		response.Records = append(response.Records, &obi.GetMetricsResponseRecord{Timestamp: time.Now().UnixMilli(), Value: "1"})
+		if len(f.aggregations) == 0 {
+			break
+		}
+	}
+	return response, nil
+}
+
+func TestFetchData(t *testing.T) {
+	down := rpcerrors.Unavailable("connection refused")
+	sources := []resource.Observer{
+		&fakeSource{name: "prometheus", aggregations: []string{"max", "min", "avg"}},
+		&fakeSource{name: "prometheus-down", aggregations: []string{"max", "min", "avg"}, err: down},
+		&fakeSource{name: "loki", aggregations: []string{"max", "avg"}},
+		&fakeSource{name: "metrics-server"},
+		&fakeSource{name: "metrics-server-time", aggregations: []string{"time"}},
+		&fakeSource{name: "broken", err: errors.New("boom")},
+		resource.WithTimeout(&fakeSource{name: "hanging", hang: true}, 50*time.Millisecond),
+		NewFailoverServer("nested", []string{"prometheus"}),
+	}
+	tests := []struct {
+		name        string
+		sources     []string
+		aggregation []string
+		wantSource  string
+		wantRecords int
+		wantCode    codes.Code
+	}{
+		{
+			name:        "first source answers",
+			sources:     []string{"prometheus", "metrics-server"},
+			aggregation: []string{"max", "min"},
+			wantSource:  "prometheus",
+			wantRecords: 2,
+		},
+		{
+			name:        "next source after a failure",
+			sources:     []string{"prometheus-down", "metrics-server"},
+			aggregation: []string{"avg"},
+			wantSource:  "metrics-server",
+			wantRecords: 1,
+		},
+		{
+			name:        "next source after a hanging one",
+			sources:     []string{"hanging", "metrics-server"},
+			wantSource:  "metrics-server",
+			wantRecords: 1,
+		},
+		{
+			name:        "a source without an aggregation is skipped",
+			sources:     []string{"prometheus-down", "loki", "prometheus"},
+			aggregation: []string{"min", "max"},
+			wantSource:  "prometheus",
+			wantRecords: 2,
+		},
+		{
+			name:        "a source which doesn't aggregate can't answer several aggregations",
+			sources:     []string{"metrics-server"},
+			aggregation: []string{"max", "min"},
+			wantCode:    codes.InvalidArgument,
+		},
+		{
+			name:        "a skipped source doesn't hide the failure",
+			sources:     []string{"prometheus-down", "metrics-server"},
+			aggregation: []string{"max", "min"},
+			wantCode:    codes.Unavailable,
+		},
+		{
+			name:        "an aggregation is routed to the sources listing it",
+			sources:     []string{"prometheus", "metrics-server-time"},
+			aggregation: []string{"time"},
+			wantSource:  "metrics-server-time",
+			wantRecords: 1,
+		},
+		{
+			name:        "an aggregation isn't routed to the sources without it",
+			sources:     []string{"prometheus-down", "metrics-server-time"},
+			aggregation: []string{"max"},
+			wantCode:    codes.Unavailable,
+		},
+		{
+			name:     "the error is the one of the last source",
+			sources:  []string{"metrics-server-missing", "prometheus-down"},
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:     "unknown error",
+			sources:  []string{"broken"},
+			wantCode: codes.Unknown,
+		},
+		{
+			name:     "nested failover",
+			sources:  []string{"nested"},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	resource.Replace(sources)
+	defer resource.Replace(nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failover := NewFailoverServer("cpu", test.sources)
+			got, err := failover.FetchData(context.Background(), &obi.GetMetricsRequest{
+				Source: "cpu", Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+				MetricName: "cpu", Aggregation: test.aggregation,
+			})
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() error = %v, want code %s", err, test.wantCode)
+			}
+			if test.wantCode != codes.OK {
+				return
+			}
+			if got.Source != test.wantSource || len(got.Records) != test.wantRecords {
+				t.Errorf("FetchData() = %d records from %s, want %d from %s", len(got.Records), got.Source, test.wantRecords, test.wantSource)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	resource.Replace([]resource.Observer{
+		&fakeSource{name: "prometheus", aggregations: []string{"max", "min", "avg"}},
+		&fakeSource{name: "loki", aggregations: []string{"max", "avg"}},
+		&fakeSource{name: "metrics-server", aggregations: []string{"time"}},
+	})
+	defer resource.Replace(nil)
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    []string
+	}{
+		{
+			name:    "aggregations of every source",
+			sources: []string{"prometheus", "metrics-server"},
+			want:    []string{"max", "min", "avg", "time"},
+		},
+		{
+			name:    "shared aggregations are listed once",
+			sources: []string{"loki", "prometheus"},
+			want:    []string{"max", "avg", "min"},
+		},
+		{
+			name:    "unknown sources are ignored",
+			sources: []string{"thanos", "metrics-server"},
+			want:    []string{"time"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NewFailoverServer("cpu", test.sources).Capabilities()
+			if !reflect.DeepEqual(got["cpu"].Aggregation, test.want) {
+				t.Errorf("Capabilities() cpu aggregations = %v, want %v", got["cpu"].Aggregation, test.want)
+			}
+		})
+	}
+}
+
+func TestFetchDataCanceled(t *testing.T) {
+	resource.Replace([]resource.Observer{
+		&fakeSource{name: "hanging", hang: true},
+		&fakeSource{name: "metrics-server"},
+	})
+	defer resource.Replace(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	failover := NewFailoverServer("cpu", []string{"hanging", "metrics-server"})
+	_, err := failover.FetchData(ctx, &obi.GetMetricsRequest{Source: "cpu", MetricName: "cpu"})
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("FetchData() error = %v, want code %s", err, codes.DeadlineExceeded)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	resource.Replace([]resource.Observer{
+		&fakeSource{name: "prometheus-down", aggregations: []string{"max", "min", "avg"}, err: rpcerrors.Unavailable("connection refused")},
+		&fakeSource{name: "prometheus", aggregations: []string{"max", "min", "avg"}},
+	})
+	defer resource.Replace(nil)
+	conformance.Suite{
+		Observer: NewFailoverServer("cpu", []string{"prometheus-down", "prometheus"}),
+		Requests: []*obi.GetMetricsRequest{
+			{Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu"},
+			{Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu", Aggregation: []string{"max", "min"}},
+		},
+	}.Run(t)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpjson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"k8s.io/client-go/transport"
+	"k8s.io/client-go/util/jsonpath"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+)
+
+// Config describes the http endpoint queried by the http-json plugin.
+type Config struct {
+	// URL is a text/template, {{.Namespace}}, {{.Name}}, {{.Kind}} and
+	// {{.MetricName}} are filled from the request. The values are escaped by
+	// pathEscape, or by queryEscape after the '?' of the url, unless the action
+	// ends with one of them.
+	URL     string
+	Headers http.Header
+	// Transport holds the auth and tls settings of the http client.
+	Transport        *transport.Config
+	Timeout          time.Duration
+	MaxResponseBytes int64
+}
+
+// urlParams is the data used to render the url template.
+type urlParams struct {
+	Namespace  string
+	Name       string
+	Kind       string
+	MetricName string
+}
+
+func (h *httpJSONServer) renderURL(params urlParams) (string, error) {
+	var buf bytes.Buffer
+	if err := h.url.Execute(&buf, params); err != nil {
+		return "", rpcerrors.InvalidArgument("query", "render url template error: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// get requests the url and decodes the json response body.
+func (h *httpJSONServer) get(ctx context.Context, target string) (interface{}, error) {
+	method := "httpJSONServer.get"
+
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range h.headers {
+		for _, value := range values {
+			httpReq.Header.Add(name, value)
+		}
+	}
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		klog.Errorf("%s request %s error: %s\n", method, target, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, h.maxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > h.maxResponseBytes {
+		return nil, fmt.Errorf("response of %s exceeds %d bytes", target, h.maxResponseBytes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rpcerrors.FromHTTPStatus(resp.StatusCode, "request %s returned status %s", target, resp.Status)
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		klog.Errorf("%s decode response of %s error: %s\n", method, target, err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// extract evaluates the jsonpath expression against data, the expression must
+// select exactly one number or numeric string.
+func extract(data interface{}, expression string) (float64, error) {
+	parser := jsonpath.New("http-json")
+	if err := parser.Parse(relaxedJSONPath(expression)); err != nil {
+		return 0, rpcerrors.InvalidArgument("query", "invalid jsonpath '%s': %s", expression, err)
+	}
+	results, err := parser.FindResults(data)
+	if err != nil {
+		return 0, fmt.Errorf("jsonpath '%s': %w", expression, err)
+	}
+
+	var values []interface{}
+	for _, result := range results {
+		for _, v := range result {
+			values = append(values, v.Interface())
+		}
+	}
+	if len(values) != 1 {
+		return 0, fmt.Errorf("jsonpath '%s' should select one value, got %d", expression, len(values))
+	}
+
+	switch v := values[0].(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("jsonpath '%s' selected non-numeric value '%s'", expression, v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("jsonpath '%s' selected non-numeric value %v", expression, v)
+	}
+}
+
+// relaxedJSONPath allows the expression to be written without the surrounding
+// braces and the leading dot, for example 'queue.depth'.
+func relaxedJSONPath(expression string) string {
+	expression = strings.TrimSpace(expression)
+	if strings.HasPrefix(expression, "{") {
+		return expression
+	}
+	if !strings.HasPrefix(expression, ".") {
+		expression = "." + expression
+	}
+	return "{" + expression + "}"
+}
+
+// urlFuncs are the escaping functions of the url template.
+var urlFuncs = template.FuncMap{
+	"pathEscape":  url.PathEscape,
+	"queryEscape": url.QueryEscape,
+}
+
+func parseURLTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, fmt.Errorf("url template is empty")
+	}
+	tmpl, err := template.New("url").Option("missingkey=error").Funcs(urlFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	escapeActions(tmpl.Tree, tmpl.Tree.Root, false)
+	return tmpl, nil
+}
+
+// escapeActions pipes the value of every action of list to pathEscape, or to
+// queryEscape once the '?' of the url is passed, so that the values of the
+// request can't add path segments or query parameters. It returns whether the
+// end of list is in the query.
+func escapeActions(tree *parse.Tree, list *parse.ListNode, inQuery bool) bool {
+	if list == nil {
+		return inQuery
+	}
+	for _, node := range list.Nodes {
+		switch node := node.(type) {
+		case *parse.TextNode:
+			inQuery = inQuery || bytes.ContainsRune(node.Text, '?')
+		case *parse.ActionNode:
+			if len(node.Pipe.Decl) > 0 || escaped(node.Pipe) {
+				continue
+			}
+			escape := "pathEscape"
+			if inQuery {
+				escape = "queryEscape"
+			}
+			node.Pipe.Cmds = append(node.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      node.Pos,
+				Args:     []parse.Node{parse.NewIdentifier(escape).SetTree(tree).SetPos(node.Pos)},
+			})
+		case *parse.IfNode:
+			inQuery = escapeBranch(tree, &node.BranchNode, inQuery)
+		case *parse.RangeNode:
+			inQuery = escapeBranch(tree, &node.BranchNode, inQuery)
+		case *parse.WithNode:
+			inQuery = escapeBranch(tree, &node.BranchNode, inQuery)
+		}
+	}
+	return inQuery
+}
+
+func escapeBranch(tree *parse.Tree, branch *parse.BranchNode, inQuery bool) bool {
+	inList := escapeActions(tree, branch.List, inQuery)
+	inElse := escapeActions(tree, branch.ElseList, inQuery)
+	return inList || inElse
+}
+
+// escaped reports whether the last command of the pipeline is an escaping
+// function.
+func escaped(pipe *parse.PipeNode) bool {
+	if len(pipe.Cmds) == 0 {
+		return false
+	}
+	args := pipe.Cmds[len(pipe.Cmds)-1].Args
+	if len(args) == 0 {
+		return false
+	}
+	identifier, ok := args[0].(*parse.IdentifierNode)
+	if !ok {
+		return false
+	}
+	_, ok = urlFuncs[identifier.Ident]
+	return ok
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpjson
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// fakeAPI is a json http api answering body with statusCode, it records the
+// urls it receives.
+type fakeAPI struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	statusCode int
+	body       string
+	header     http.Header
+	urls       []*url.URL
+}
+
+func newFakeAPI(t *testing.T, body string) *fakeAPI {
+	t.Helper()
+	api := &fakeAPI{statusCode: http.StatusOK, body: body}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.urls = append(api.urls, r.URL)
+		api.header = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(api.statusCode)
+		fmt.Fprint(w, api.body)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (a *fakeAPI) lastURL() *url.URL {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.urls) == 0 {
+		return nil
+	}
+	return a.urls[len(a.urls)-1]
+}
+
+func podRequest(name, query string) *obi.GetMetricsRequest {
+	return &obi.GetMetricsRequest{
+		Kind: "Pod", Namespace: "default", ResourceNames: []string{name}, MetricName: "queue", Query: query,
+	}
+}
+
+func TestFetchData(t *testing.T) {
+	const body = `{"queue":{"depth":12,"rate":"2.5","name":"jobs"},"workers":[{"busy":3},{"busy":5}]}`
+	tests := []struct {
+		name       string
+		query      string
+		statusCode int
+		body       string
+		maxBytes   int64
+		want       string
+		wantCode   codes.Code
+		wantErr    bool
+	}{
+		{name: "number", query: "queue.depth", want: "12.000000"},
+		{name: "jsonpath with braces", query: "{.queue.depth}", want: "12.000000"},
+		{name: "numeric string", query: ".queue.rate", want: "2.500000"},
+		{name: "array element", query: "workers[1].busy", want: "5.000000"},
+		{name: "non-numeric value", query: "queue.name", wantErr: true},
+		{name: "several values", query: "workers[*].busy", wantErr: true},
+		{name: "missing value", query: "queue.size", wantErr: true},
+		{name: "invalid jsonpath", query: "{.queue[", wantCode: codes.InvalidArgument},
+		{name: "without query", wantCode: codes.InvalidArgument},
+		{name: "invalid json", query: "queue.depth", body: "{", wantErr: true},
+		{name: "response over the size limit", query: "queue.depth", maxBytes: 16, wantErr: true},
+		{name: "bad request", query: "queue.depth", statusCode: http.StatusBadRequest, wantCode: codes.InvalidArgument},
+		{name: "unauthorized", query: "queue.depth", statusCode: http.StatusUnauthorized, wantCode: codes.PermissionDenied},
+		{name: "not found", query: "queue.depth", statusCode: http.StatusNotFound, wantCode: codes.NotFound},
+		{name: "throttled", query: "queue.depth", statusCode: http.StatusTooManyRequests, wantCode: codes.Unavailable},
+		{name: "server error", query: "queue.depth", statusCode: http.StatusServiceUnavailable, wantCode: codes.Unavailable},
+		{name: "gateway timeout", query: "queue.depth", statusCode: http.StatusGatewayTimeout, wantCode: codes.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(t, body)
+			if test.statusCode != 0 {
+				api.statusCode = test.statusCode
+			}
+			if test.body != "" {
+				api.body = test.body
+			}
+			server, err := NewHTTPJSONServer("queue", Config{
+				URL:              api.URL + "/queues/{{.Namespace}}/{{.Name}}",
+				Headers:          http.Header{"X-Tenant": []string{"arbiter"}},
+				MaxResponseBytes: test.maxBytes,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := server.FetchData(context.Background(), podRequest("web-0", test.query))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("FetchData() records = %v, want an error", got.Records)
+				}
+				return
+			}
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() error = %v, want code %s", err, test.wantCode)
+			}
+			if test.wantCode != codes.OK {
+				return
+			}
+			if len(got.Records) != 1 || got.Records[0].Value != test.want {
+				t.Errorf("FetchData() records = %v, want value %s", got.Records, test.want)
+			}
+			if got.ResourceName != "web-0" || got.Namespace != "default" || got.Source != "queue" {
+				t.Errorf("FetchData() = %s/%s from %s, want default/web-0 from queue", got.Namespace, got.ResourceName, got.Source)
+			}
+			if path := api.lastURL().Path; path != "/queues/default/web-0" {
+				t.Errorf("FetchData() requested %s, want /queues/default/web-0", path)
+			}
+			if tenant := api.header.Get("X-Tenant"); tenant != "arbiter" {
+				t.Errorf("FetchData() sent X-Tenant %q, want arbiter", tenant)
+			}
+		})
+	}
+}
+
+func TestFetchDataEscapesURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		resource  string
+		metric    string
+		wantPath  string // escaped
+		wantQuery url.Values
+	}{
+		{
+			name:      "path and query values",
+			template:  "/queues/{{.Namespace}}/{{.Name}}?metric={{.MetricName}}",
+			resource:  "web-0",
+			metric:    "queue",
+			wantPath:  "/queues/default/web-0",
+			wantQuery: url.Values{"metric": {"queue"}},
+		},
+		{
+			name:      "a value can't add path segments or a query",
+			template:  "/queues/{{.Namespace}}/{{.Name}}",
+			resource:  "../admin?drop=true",
+			wantPath:  "/queues/default/..%2Fadmin%3Fdrop=true",
+			wantQuery: url.Values{},
+		},
+		{
+			name:      "a value can't add query parameters",
+			template:  "/queues?name={{.Name}}&metric={{.MetricName}}",
+			resource:  "web-0",
+			metric:    "queue&admin=true #",
+			wantPath:  "/queues",
+			wantQuery: url.Values{"name": {"web-0"}, "metric": {"queue&admin=true #"}},
+		},
+		{
+			name:      "explicit escaping isn't doubled",
+			template:  "/queues/{{.Name | pathEscape}}?metric={{queryEscape .MetricName}}",
+			resource:  "web/0",
+			metric:    "a b",
+			wantPath:  "/queues/web%2F0",
+			wantQuery: url.Values{"metric": {"a b"}},
+		},
+		{
+			name:      "actions in conditions are escaped",
+			template:  "/queues{{if .Name}}/{{.Name}}{{end}}?{{with .MetricName}}metric={{.}}{{end}}",
+			resource:  "web/0",
+			metric:    "a&b",
+			wantPath:  "/queues/web%2F0",
+			wantQuery: url.Values{"metric": {"a&b"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(t, `{"depth":1}`)
+			server, err := NewHTTPJSONServer("queue", Config{URL: api.URL + test.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := podRequest(test.resource, "depth")
+			req.MetricName = test.metric
+			if _, err := server.FetchData(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			got := api.lastURL()
+			if path := got.EscapedPath(); path != test.wantPath {
+				t.Errorf("FetchData() requested path %q, want %q", path, test.wantPath)
+			}
+			if query := got.Query(); query.Encode() != test.wantQuery.Encode() {
+				t.Errorf("FetchData() requested query %v, want %v", query, test.wantQuery)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	api := newFakeAPI(t, `{"queue":{"depth":12}}`)
+	server, err := NewHTTPJSONServer("queue", Config{URL: api.URL + "/queues/{{.Namespace}}/{{.Name}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conformance.Suite{
+		Observer: server,
+		Requests: []*obi.GetMetricsRequest{podRequest("web-0", "queue.depth")},
+	}.Run(t)
+}
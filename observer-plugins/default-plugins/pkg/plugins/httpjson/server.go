@@ -0,0 +1,224 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpjson
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/transport"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	PluginName = "http-json"
+
+	defaultMaxResponseBytes = 1 << 20
+)
+
+// httpJSONServer reads a number from a json http api, the url comes from the
+// configured template and the value is selected by the jsonpath in req.Query.
+type httpJSONServer struct {
+	name             string
+	url              *template.Template
+	headers          http.Header
+	client           *http.Client
+	timeout          time.Duration
+	maxResponseBytes int64
+}
+
+func NewHTTPJSONServer(name string, cfg Config) (*httpJSONServer, error) {
+	url, err := parseURLTemplate(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	transportConfig := cfg.Transport
+	if transportConfig == nil {
+		transportConfig = &transport.Config{}
+	}
+	rt, err := transport.New(transportConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	maxResponseBytes := cfg.MaxResponseBytes
+	if maxResponseBytes <= 0 {
+		maxResponseBytes = defaultMaxResponseBytes
+	}
+
+	return &httpJSONServer{
+		name:             name,
+		url:              url,
+		headers:          cfg.Headers,
+		client:           &http.Client{Transport: rt},
+		timeout:          cfg.Timeout,
+		maxResponseBytes: maxResponseBytes,
+	}, nil
+}
+
+func (h *httpJSONServer) Name() string {
+	return h.name
+}
+
+func (h *httpJSONServer) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{
+		"value": {
+			Description: "request a number from a json http api, req.Query is the jsonpath of the number",
+		},
+	}
+}
+
+func (h *httpJSONServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	method := "httpJSONServer/FetchData"
+	klog.V(4).Infof("%s req %s\n", method, req.String())
+
+	params := urlParams{
+		Namespace:  req.Namespace,
+		Kind:       req.Kind,
+		MetricName: req.MetricName,
+	}
+	if len(req.ResourceNames) > 0 {
+		params.Name = req.ResourceNames[0]
+	}
+	result := &obi.GetMetricsResponse{
+		ResourceName: params.Name,
+		Namespace:    req.Namespace,
+		Unit:         req.Unit,
+		Source:       h.name,
+		Records:      []*obi.GetMetricsResponseRecord{},
+	}
+	if req.Query == "" {
+		return result, rpcerrors.InvalidArgument("query", "%s requires the jsonpath in the query", PluginName)
+	}
+
+	target, err := h.renderURL(params)
+	if err != nil {
+		return result, err
+	}
+	data, err := h.get(ctx, target)
+	if err != nil {
+		return result, err
+	}
+	value, err := extract(data, req.Query)
+	if err != nil {
+		klog.Errorf("%s extract value from %s error: %s\n", method, target, err)
+		return result, err
+	}
+
+	result.Records = append(result.Records, &obi.GetMetricsResponseRecord{
+		Timestamp: time.Now().UnixMilli(),
+		Value:     fmt.Sprintf("%f", value),
+	})
+	klog.V(5).Infof("%s request %s by '%s' result: %f\n", method, target, req.Query, value)
+	return result, nil
+}
+
+// Options are the http-json settings of the plugin config, the url template is
+// the address of the plugin config.
+type Options struct {
+	Headers          map[string]string `json:"headers,omitempty"`
+	Timeout          metav1.Duration   `json:"timeout,omitempty"`
+	MaxResponseBytes int64             `json:"maxResponseBytes,omitempty"`
+}
+
+// New creates a http-json instance from its config, the settings left empty
+// fall back to the --http-json-* flags.
+func New(pluginConfig config.PluginConfig) (resource.Observer, error) {
+	opts := Options{}
+	if err := pluginConfig.DecodeOptions(&opts); err != nil {
+		return nil, err
+	}
+
+	cfg, err := configFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	if pluginConfig.Address != "" {
+		cfg.URL = pluginConfig.Address
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("%w: %s has no url", resource.ErrNotConfigured, pluginConfig.Name)
+	}
+	for name, value := range opts.Headers {
+		cfg.Headers.Set(name, value)
+	}
+	if opts.Timeout.Duration > 0 {
+		cfg.Timeout = opts.Timeout.Duration
+	}
+	if opts.MaxResponseBytes > 0 {
+		cfg.MaxResponseBytes = opts.MaxResponseBytes
+	}
+	if pluginConfig.Auth != nil {
+		if cfg.Transport, err = pluginConfig.Auth.TransportConfig(); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Transport.Wrap(metrics.InstrumentRoundTripper(pluginConfig.Name, PluginName))
+	cfg.Transport.Wrap(tracing.RoundTripper)
+	return NewHTTPJSONServer(pluginConfig.Name, cfg)
+}
+
+// configFromFlags builds the plugin config from the --http-json-* flags.
+func configFromFlags() (Config, error) {
+	cfg := Config{
+		URL:              *flags.HTTPJSONURL,
+		Headers:          http.Header{},
+		Timeout:          *flags.HTTPJSONTimeout,
+		MaxResponseBytes: *flags.HTTPJSONMaxResponseBytes,
+		Transport: &transport.Config{
+			BearerTokenFile: *flags.HTTPJSONBearerTokenFile,
+			Username:        *flags.HTTPJSONUsername,
+			TLS: transport.TLSConfig{
+				CAFile: *flags.HTTPJSONCAFile,
+			},
+		},
+	}
+	for _, header := range *flags.HTTPJSONHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return cfg, fmt.Errorf("invalid header '%s', expect 'Name: value'", header)
+		}
+		cfg.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if *flags.HTTPJSONPasswordFile != "" {
+		password, err := os.ReadFile(*flags.HTTPJSONPasswordFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Transport.Password = strings.TrimSpace(string(password))
+	}
+	return cfg, nil
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+)
+
+const (
+	queryRangePath = "/loki/api/v1/query_range"
+	labelsPath     = "/loki/api/v1/labels"
+	orgIDHeader    = "X-Scope-OrgID"
+
+	statusSuccess = "success"
+	// resultTypeStreams is returned for log queries, only metric queries are
+	// supported.
+	resultTypeStreams = "streams"
+)
+
+// queryResponse is the body returned by the loki query_range api, it has the
+// same shape as the prometheus http api.
+type queryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// Probe checks that loki answers the labels api, which is served by loki and
+// by the gateways in front of it.
+func (l *lokiServer) Probe(ctx context.Context) error {
+	target := strings.TrimSuffix(l.address, "/") + labelsPath
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return err
+	}
+	if l.orgID != "" {
+		httpReq.Header.Set(orgIDHeader, l.orgID)
+	}
+	resp, err := l.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return rpcerrors.FromHTTPStatus(resp.StatusCode, "%s returned status %s", target, resp.Status)
+	}
+	return nil
+}
+
+// QueryRange runs the LogQL metric query over [start, end] and returns the
+// result as a prometheus model value.
+func (l *lokiServer) QueryRange(ctx context.Context, query string, start, end time.Time) (model.Value, error) {
+	ctx, span := tracing.Start(ctx, "loki.QueryRange",
+		attribute.String("arbiter.source", l.name),
+		attribute.String("loki.query", query),
+		attribute.Int64("loki.step_seconds", l.stepSeconds),
+	)
+	value, err := l.queryRange(ctx, query, start, end)
+	tracing.End(span, err)
+	return value, err
+}
+
+func (l *lokiServer) queryRange(ctx context.Context, query string, start, end time.Time) (model.Value, error) {
+	method := "lokiServer.QueryRange"
+
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	params.Set("step", strconv.FormatInt(l.stepSeconds, 10))
+	target := strings.TrimSuffix(l.address, "/") + queryRangePath + "?" + params.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if l.orgID != "" {
+		httpReq.Header.Set(orgIDHeader, l.orgID)
+	}
+
+	resp, err := l.client.Do(httpReq)
+	if err != nil {
+		klog.Errorf("%s query '%s' error: %s\n", method, query, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, l.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > l.maxBytes {
+		return nil, fmt.Errorf("response of query '%s' exceeds %d bytes", query, l.maxBytes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rpcerrors.FromHTTPStatus(resp.StatusCode, "query '%s' returned status %s: %s", query, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	result := queryResponse{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decode response of query '%s' error: %w", query, err)
+	}
+	if result.Status != statusSuccess {
+		return nil, fmt.Errorf("query '%s' failed with %s: %s", query, result.ErrorType, result.Error)
+	}
+
+	var value model.Value
+	switch result.Data.ResultType {
+	case model.ValMatrix.String():
+		matrix := model.Matrix{}
+		err = json.Unmarshal(result.Data.Result, &matrix)
+		value = matrix
+	case model.ValVector.String():
+		vector := model.Vector{}
+		err = json.Unmarshal(result.Data.Result, &vector)
+		value = vector
+	case model.ValScalar.String():
+		scalar := &model.Scalar{}
+		err = json.Unmarshal(result.Data.Result, scalar)
+		value = scalar
+	case resultTypeStreams:
+		return nil, rpcerrors.InvalidArgument("query", "query '%s' is a log query, only metric queries are supported", query)
+	default:
+		return nil, fmt.Errorf("query '%s' returned unknown result type %s", query, result.Data.ResultType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode %s result of query '%s' error: %w", result.Data.ResultType, query, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loki
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/prometheus"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakeprometheus"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const errorRate = `sum(rate({namespace="default", pod="web-0"} |= "error" [1m]))`
+
+var (
+	start = time.UnixMilli(1660000000000)
+	end   = start.Add(3 * time.Minute)
+)
+
+func matrix(values ...float64) model.Matrix {
+	stream := &model.SampleStream{Metric: model.Metric{}}
+	for idx, value := range values {
+		stream.Values = append(stream.Values, model.SamplePair{
+			Timestamp: model.TimeFromUnixNano(start.Add(time.Duration(idx) * time.Minute).UnixNano()),
+			Value:     model.SampleValue(value),
+		})
+	}
+	return model.Matrix{stream}
+}
+
+func newTestServer(t *testing.T, maxBytes int64) (*fakeprometheus.Server, *lokiServer) {
+	t.Helper()
+	fake := fakeprometheus.NewServer()
+	t.Cleanup(fake.Close)
+	return fake, NewLokiServer("loki", fake.URL, "team-a", 60, maxBytes, http.DefaultTransport)
+}
+
+func request(aggregation ...string) *obi.GetMetricsRequest {
+	return &obi.GetMetricsRequest{
+		Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "log", Query: errorRate,
+		Aggregation: aggregation, StartTime: start.UnixMilli(), EndTime: end.UnixMilli(),
+	}
+}
+
+func TestFetchData(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *obi.GetMetricsRequest
+		response fakeprometheus.Response
+		maxBytes int64
+		want     []*obi.GetMetricsResponseRecord
+		wantCode codes.Code
+		wantErr  bool
+	}{
+		{
+			name:     "default aggregation is avg",
+			req:      request(),
+			response: fakeprometheus.Response{Result: matrix(1, 5, 3)},
+			want:     []*obi.GetMetricsResponseRecord{{Timestamp: end.UnixMilli(), Value: "3.000000"}},
+		},
+		{
+			name:     "one record per aggregation in the order of the request",
+			req:      request(prometheus.MaxAction, prometheus.MinAction, prometheus.AvgAction),
+			response: fakeprometheus.Response{Result: matrix(1, 5, 3)},
+			want: []*obi.GetMetricsResponseRecord{
+				{Timestamp: start.Add(time.Minute).UnixMilli(), Value: "5.000000"},
+				{Timestamp: start.UnixMilli(), Value: "1.000000"},
+				{Timestamp: end.UnixMilli(), Value: "3.000000"},
+			},
+		},
+		{
+			name:     "vector",
+			req:      request(prometheus.MaxAction),
+			response: fakeprometheus.Response{Result: model.Vector{{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: 4}}},
+			want:     []*obi.GetMetricsResponseRecord{{Timestamp: start.UnixMilli(), Value: "4.000000"}},
+		},
+		{
+			name:     "unsupported aggregation",
+			req:      request("p99"),
+			response: fakeprometheus.Response{Result: matrix(1)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "query is required",
+			req:      &obi.GetMetricsRequest{Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid query",
+			req:      request(),
+			response: fakeprometheus.Response{ErrorType: v1.ErrBadData, Error: "parse error"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "server error",
+			req:      request(),
+			response: fakeprometheus.Response{StatusCode: http.StatusBadGateway},
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:     "failed query",
+			req:      request(),
+			response: fakeprometheus.Response{ErrorType: v1.ErrExec, Error: "failed", StatusCode: http.StatusOK},
+			wantErr:  true,
+		},
+		{
+			name:     "string result",
+			req:      request(),
+			response: fakeprometheus.Response{Result: &model.String{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: "text"}},
+			wantErr:  true,
+		},
+		{
+			name:     "response over the size limit",
+			req:      request(),
+			response: fakeprometheus.Response{Result: matrix(1, 5, 3)},
+			maxBytes: 64,
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxBytes := test.maxBytes
+			if maxBytes == 0 {
+				maxBytes = 1 << 20
+			}
+			fake, server := newTestServer(t, maxBytes)
+			fake.SetResponse(errorRate, test.response)
+
+			got, err := server.FetchData(context.Background(), test.req)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("FetchData() records = %v, want an error", got.Records)
+				}
+				return
+			}
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() error = %v, want code %s", err, test.wantCode)
+			}
+			if test.wantCode != codes.OK {
+				return
+			}
+			if !reflect.DeepEqual(got.Records, test.want) {
+				t.Errorf("FetchData() records = %v, want %v", got.Records, test.want)
+			}
+			if got.ResourceName != "web-0" || got.Namespace != "default" || got.Source != "loki" {
+				t.Errorf("FetchData() = %s/%s from %s, want default/web-0 from loki", got.Namespace, got.ResourceName, got.Source)
+			}
+			want := fakeprometheus.Request{
+				Path:  "/loki/api/v1/query_range",
+				Query: errorRate,
+				Start: strconv.FormatInt(start.UnixNano(), 10),
+				End:   strconv.FormatInt(end.UnixNano(), 10),
+				Step:  "60",
+				OrgID: "team-a",
+			}
+			if requests := fake.Requests(); len(requests) != 1 || requests[0] != want {
+				t.Errorf("requests = %+v, want %+v", requests, want)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	fake, server := newTestServer(t, 1<<20)
+	if err := server.Probe(context.Background()); err != nil {
+		t.Errorf("Probe() error = %v", err)
+	}
+	fake.SetDefaultResponse(fakeprometheus.Response{StatusCode: http.StatusServiceUnavailable})
+	if err := server.Probe(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Errorf("Probe() of a failing server error = %v, want code %s", err, codes.Unavailable)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fake, server := newTestServer(t, 1<<20)
+	fake.SetDefaultResponse(fakeprometheus.Response{Result: matrix(1, 5, 3)})
+	conformance.Suite{
+		Observer: server,
+		Requests: []*obi.GetMetricsRequest{
+			request(),
+			request(prometheus.MaxAction, prometheus.MinAction, prometheus.AvgAction),
+		},
+	}.Run(t)
+}
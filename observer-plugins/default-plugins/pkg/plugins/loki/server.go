@@ -0,0 +1,167 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loki
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/transport"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/prometheus"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	PluginName = "loki"
+)
+
+// lokiServer runs LogQL metric queries, such as
+// 'sum(rate({namespace="default", pod="web-0"} |= "error" [1m]))', against a
+// loki compatible http api.
+type lokiServer struct {
+	name        string
+	address     string
+	orgID       string
+	stepSeconds int64
+	maxBytes    int64
+	client      *http.Client
+}
+
+func NewLokiServer(name, address, orgID string, stepSeconds, maxBytes int64, rt http.RoundTripper) *lokiServer {
+	return &lokiServer{
+		name:        name,
+		address:     address,
+		orgID:       orgID,
+		stepSeconds: stepSeconds,
+		maxBytes:    maxBytes,
+		client:      &http.Client{Transport: rt},
+	}
+}
+
+func (l *lokiServer) Name() string {
+	return l.name
+}
+
+func (l *lokiServer) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{
+		"log": {
+			Description: "request the result of a LogQL metric query from loki",
+			Aggregation: []string{prometheus.MaxAction, prometheus.MinAction, prometheus.AvgAction},
+		},
+	}
+}
+
+func (l *lokiServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	method := "lokiServer/FetchData"
+	klog.V(4).Infof("%s req %s\n", method, req.String())
+
+	result := &obi.GetMetricsResponse{
+		Namespace: req.Namespace,
+		Unit:      req.Unit,
+		Source:    l.name,
+		Records:   []*obi.GetMetricsResponseRecord{},
+	}
+	if len(req.ResourceNames) > 0 {
+		result.ResourceName = req.ResourceNames[0]
+	}
+	if req.Query == "" {
+		return result, rpcerrors.InvalidArgument("query", "%s requires a LogQL query", PluginName)
+	}
+
+	ops := resource.Aggregations(req, prometheus.AvgAction)
+
+	startTime := time.UnixMilli(req.StartTime)
+	endTime := time.UnixMilli(req.EndTime)
+	value, err := l.QueryRange(ctx, req.Query, startTime, endTime)
+	if err != nil {
+		return result, err
+	}
+	data, err := prometheus.FormatRawValues(value)
+	if err != nil {
+		return result, err
+	}
+
+	// every aggregation is computed from the same samples, one record each
+	for _, op := range ops {
+		series := prometheus.DataSeries{Timestamp: endTime.UnixMilli()}
+		if !prometheus.Aggregate(op, data, &series) {
+			return result, rpcerrors.InvalidArgument("aggregation", "aggregation %s isn't supported by %s", op, PluginName)
+		}
+		result.Records = append(result.Records, &obi.GetMetricsResponseRecord{Timestamp: series.Timestamp, Value: series.Value})
+	}
+
+	klog.V(5).Infof("%s query by %s, %s result: %v\n", method, req.MetricName, req.Query, result.Records)
+	return result, nil
+}
+
+// Options are the loki settings of the plugin config.
+type Options struct {
+	OrgID            string `json:"orgID,omitempty"`
+	MaxResponseBytes int64  `json:"maxResponseBytes,omitempty"`
+}
+
+// New creates a loki instance from its config, the settings left empty fall
+// back to the --loki-* flags.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	opts := Options{OrgID: *flags.LokiOrgID}
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		return nil, err
+	}
+	if opts.MaxResponseBytes <= 0 {
+		opts.MaxResponseBytes = *flags.LokiMaxResponseBytes
+	}
+	address := cfg.Address
+	if address == "" {
+		address = *flags.LokiAddress
+	}
+	if address == "" {
+		return nil, fmt.Errorf("%w: %s has no address", resource.ErrNotConfigured, cfg.Name)
+	}
+	stepSeconds := int64(cfg.Step.Seconds())
+	if stepSeconds <= 0 {
+		stepSeconds = *flags.LokiStepSeconds
+	}
+
+	transConf := &transport.Config{}
+	if cfg.Auth != nil {
+		var err error
+		if transConf, err = cfg.Auth.TransportConfig(); err != nil {
+			return nil, err
+		}
+	}
+	transConf.Wrap(metrics.InstrumentRoundTripper(cfg.Name, PluginName))
+	transConf.Wrap(tracing.RoundTripper)
+	rt, err := transport.New(transConf)
+	if err != nil {
+		return nil, err
+	}
+	return NewLokiServer(cfg.Name, address, opts.OrgID, stepSeconds, opts.MaxResponseBytes, rt), nil
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
+}
@@ -20,19 +20,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
 	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
 	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
 	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
 )
 
 const (
+	metricAPI     = `apis/metrics.k8s.io/v1beta1`
 	podMetricAPI  = `apis/metrics.k8s.io/v1beta1/namespaces/%s/pods/%s`
 	nodeMetricAPI = `apis/metrics.k8s.io/v1beta1/nodes/%s`
 
@@ -43,20 +51,32 @@ const (
 )
 
 type metricServer struct {
+	name   string
 	client *kubernetes.Clientset
 	cfg    *rest.Config
 }
 
 // NewMetricServer for register
-func NewMetricServer(cfg *rest.Config) *metricServer {
+func NewMetricServer(name string, cfg *rest.Config) (*metricServer, error) {
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &metricServer{
+		name:   name,
 		cfg:    cfg,
-		client: kubernetes.NewForConfigOrDie(cfg),
-	}
+		client: client,
+	}, nil
+}
+
+// Probe checks that the metrics api is served by the api server.
+func (ms *metricServer) Probe(ctx context.Context) error {
+	_, err := ms.client.RESTClient().Get().AbsPath(metricAPI).DoRaw(ctx)
+	return err
 }
 
 func (ms *metricServer) Name() string {
-	return PluginName
+	return ms.name
 }
 
 func (ms *metricServer) Capabilities() map[string]*obi.CapabilityInfo {
@@ -77,23 +97,22 @@ func (ms *metricServer) Capabilities() map[string]*obi.CapabilityInfo {
 func (ms *metricServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
 	method := "metricServer/FetchData"
 
+	if err := validate(req); err != nil {
+		klog.Warningf("%s invalid request: %s\n", method, err)
+		return nil, err
+	}
 	returnObject := &obi.GetMetricsResponse{
 		ResourceName: req.ResourceNames[0],
 		Namespace:    req.Namespace,
 		Unit:         req.Unit,
-		Source:       PluginName,
-	}
-
-	if req.Kind != NodeKind && req.Kind != PodKind {
-		klog.Warningf("[Error] %s don't support kind %s\n", method, req.Kind)
-		return returnObject, nil
+		Source:       ms.name,
 	}
 
 	var calculate ResourceUsage
 	switch req.Kind {
 	case PodKind:
 		queryPath := fmt.Sprintf(podMetricAPI, req.Namespace, req.ResourceNames[0])
-		podMetricBytes, err := ms.client.RESTClient().Get().AbsPath(queryPath).DoRaw(ctx)
+		podMetricBytes, err := ms.get(ctx, req.Kind, queryPath)
 		if err != nil {
 			return returnObject, err
 		}
@@ -105,7 +124,7 @@ func (ms *metricServer) FetchData(ctx context.Context, req *obi.GetMetricsReques
 		calculate = &podMetric
 	case NodeKind:
 		queryPath := fmt.Sprintf(nodeMetricAPI, req.ResourceNames[0])
-		nodeMetricBytes, err := ms.client.RESTClient().Get().AbsPath(queryPath).DoRaw(ctx)
+		nodeMetricBytes, err := ms.get(ctx, req.Kind, queryPath)
 		if err != nil {
 			klog.Errorf("[Error] failed to get node metric from metric-server: %s\n", err)
 			return returnObject, err
@@ -117,9 +136,6 @@ func (ms *metricServer) FetchData(ctx context.Context, req *obi.GetMetricsReques
 		}
 		calculate = &nodeMetric
 
-	default:
-		klog.Errorf("[Error] don't support kind %s\n", req.Kind)
-		return &obi.GetMetricsResponse{}, fmt.Errorf("do not support kind %s", req.Kind)
 	}
 
 	klog.V(4).Infof("Query: %s\n", req.Query)
@@ -137,13 +153,52 @@ func (ms *metricServer) FetchData(ctx context.Context, req *obi.GetMetricsReques
 	return returnObject, nil
 }
 
-func init() {
-	cfg, err := clientcmd.BuildConfigFromFlags("", *flags.Kubeconfig)
-	if err == nil {
-		instance := NewMetricServer(cfg)
-		resource.Register(instance)
-		klog.Infof("Observer [%s] registration is successful", PluginName)
-	} else {
-		klog.Warningf("Observer [%s] registration failed", PluginName)
+// get requests the metrics api in a span.
+func (ms *metricServer) get(ctx context.Context, kind, path string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "metrics-server.Get",
+		attribute.String("arbiter.source", ms.name),
+		attribute.String("k8s.kind", kind),
+		attribute.String("http.target", path),
+	)
+	data, err := ms.client.RESTClient().Get().AbsPath(path).DoRaw(ctx)
+	tracing.End(span, err)
+	return data, err
+}
+
+// validate checks the request before the metrics api is called.
+func validate(req *obi.GetMetricsRequest) error {
+	if req.Kind != NodeKind && req.Kind != PodKind {
+		return rpcerrors.InvalidArgument("kind", "%s doesn't support kind %s", PluginName, req.Kind)
 	}
+	if len(req.ResourceNames) == 0 || req.ResourceNames[0] == "" {
+		return rpcerrors.InvalidArgument("resource_names", "%s requires the %s name", PluginName, strings.ToLower(req.Kind))
+	}
+	if req.Kind == PodKind && req.Namespace == "" {
+		return rpcerrors.InvalidArgument("namespace", "%s requires the namespace of the pod", PluginName)
+	}
+	if req.MetricName != string(v1.ResourceCPU) && req.MetricName != string(v1.ResourceMemory) {
+		return rpcerrors.InvalidArgument("metric_name", "%s doesn't support metric %s", PluginName, req.MetricName)
+	}
+	for idx, op := range req.Aggregation {
+		if op != metricOpt {
+			return rpcerrors.InvalidArgument(fmt.Sprintf("aggregation[%d]", idx), "aggregation %s isn't supported by %s", op, PluginName)
+		}
+	}
+	return nil
+}
+
+// New creates a metrics-server instance, the api server is reached with the
+// kubeconfig given by the flags.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	restConf, err := clientcmd.BuildConfigFromFlags("", *flags.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	restConf.Wrap(metrics.InstrumentRoundTripper(cfg.Name, PluginName))
+	restConf.Wrap(tracing.RoundTripper)
+	return NewMetricServer(cfg.Name, restConf)
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
 }
@@ -0,0 +1,189 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metricsserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakemetricsapi"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+func newTestServer(t *testing.T) (*fakemetricsapi.Server, *metricServer) {
+	t.Helper()
+	fake := fakemetricsapi.NewServer()
+	t.Cleanup(fake.Close)
+	fake.AddPod("default", "web-0", map[string]v1.ResourceList{
+		"app": {
+			v1.ResourceCPU:    resource.MustParse("100m"),
+			v1.ResourceMemory: resource.MustParse("64Mi"),
+		},
+		"sidecar": {
+			v1.ResourceCPU:    resource.MustParse("250m"),
+			v1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+	})
+	fake.AddNode("node-1", v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("1500m"),
+		v1.ResourceMemory: resource.MustParse("2Gi"),
+	})
+	server, err := NewMetricServer("metrics-server", fake.RestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, server
+}
+
+func TestFetchData(t *testing.T) {
+	tests := []struct {
+		name         string
+		req          *obi.GetMetricsRequest
+		statusCode   int
+		want         string
+		wantUnit     string
+		wantCode     codes.Code
+		wantNotFound bool
+	}{
+		{
+			name:     "pod cpu is the sum of the containers",
+			req:      &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu"},
+			want:     "350.000",
+			wantUnit: "m",
+		},
+		{
+			name:     "pod memory is the sum of the containers",
+			req:      &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "memory"},
+			want:     "83886080.000",
+			wantUnit: "byte",
+		},
+		{
+			name:     "node cpu",
+			req:      &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "cpu"},
+			want:     "1500.000",
+			wantUnit: "m",
+		},
+		{
+			name:     "node memory",
+			req:      &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "memory"},
+			want:     "2147483648.000",
+			wantUnit: "byte",
+		},
+		{
+			name:         "missing pod",
+			req:          &obi.GetMetricsRequest{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-1"}, MetricName: "cpu"},
+			wantCode:     codes.Unknown,
+			wantNotFound: true,
+		},
+		{
+			name:         "missing node",
+			req:          &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-2"}, MetricName: "cpu"},
+			wantCode:     codes.Unknown,
+			wantNotFound: true,
+		},
+		{
+			name:       "api server error",
+			req:        &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "cpu"},
+			statusCode: http.StatusServiceUnavailable,
+			wantCode:   codes.Unknown,
+		},
+		{
+			name:     "unsupported kind",
+			req:      &obi.GetMetricsRequest{Kind: "Deployment", Namespace: "default", ResourceNames: []string{"web"}, MetricName: "cpu"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "pod without namespace",
+			req:      &obi.GetMetricsRequest{Kind: PodKind, ResourceNames: []string{"web-0"}, MetricName: "cpu"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "without resource name",
+			req:      &obi.GetMetricsRequest{Kind: NodeKind, MetricName: "cpu"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unsupported metric",
+			req:      &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "gpu"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unsupported aggregation",
+			req:      &obi.GetMetricsRequest{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "cpu", Aggregation: []string{"max"}},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, server := newTestServer(t)
+			fake.SetStatusCode(test.statusCode)
+
+			got, err := server.FetchData(context.Background(), test.req)
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() error = %v, want code %s", err, test.wantCode)
+			}
+			if apierrors.IsNotFound(err) != test.wantNotFound {
+				t.Errorf("FetchData() error = %v, want not found %t", err, test.wantNotFound)
+			}
+			if test.wantCode != codes.OK {
+				return
+			}
+			if len(got.Records) != 1 || got.Records[0].Value != test.want {
+				t.Errorf("FetchData() records = %v, want value %s", got.Records, test.want)
+			}
+			if got.Unit != test.wantUnit {
+				t.Errorf("FetchData() unit = %s, want %s", got.Unit, test.wantUnit)
+			}
+			if got.ResourceName != test.req.ResourceNames[0] || got.Namespace != test.req.Namespace || got.Source != "metrics-server" {
+				t.Errorf("FetchData() = %s/%s from %s, want %s/%s from metrics-server",
+					got.Namespace, got.ResourceName, got.Source, test.req.Namespace, test.req.ResourceNames[0])
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	fake, server := newTestServer(t)
+	if err := server.Probe(context.Background()); err != nil {
+		t.Errorf("Probe() error = %v", err)
+	}
+	fake.SetStatusCode(http.StatusServiceUnavailable)
+	if err := server.Probe(context.Background()); err == nil {
+		t.Error("Probe() of a failing api server succeeded")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	_, server := newTestServer(t)
+	conformance.Suite{
+		Observer: server,
+		Requests: []*obi.GetMetricsRequest{
+			{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu"},
+			{Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "memory"},
+			{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "cpu"},
+			{Kind: NodeKind, ResourceNames: []string{"node-1"}, MetricName: "memory"},
+		},
+	}.Run(t)
+}
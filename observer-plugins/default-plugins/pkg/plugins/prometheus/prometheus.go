@@ -17,16 +17,24 @@ limitations under the License.
 package prometheus
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/client-go/transport"
 	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
 )
 
 var actionFuncs = map[string]func([]CalculateAux, *DataSeries){
@@ -36,11 +44,7 @@ var actionFuncs = map[string]func([]CalculateAux, *DataSeries){
 }
 
 func (p *prometheusServer) NewPrometheusAPI() (v1.API, error) {
-	transConf, err := p.restConf.TransportConfig()
-	if err != nil {
-		return nil, err
-	}
-	rt, err := transport.New(transConf)
+	rt, err := transport.New(p.transConf)
 	if err != nil {
 		return nil, err
 	}
@@ -56,6 +60,54 @@ func (p *prometheusServer) NewPrometheusAPI() (v1.API, error) {
 	return v1.NewAPI(client), nil
 }
 
+// Probe checks that the prometheus api answers a constant query.
+func (p *prometheusServer) Probe(ctx context.Context) error {
+	promAPI, err := p.NewPrometheusAPI()
+	if err != nil {
+		return err
+	}
+	_, _, err = promAPI.Query(ctx, "1", time.Now())
+	return err
+}
+
+// statusError converts the errors returned by the prometheus api to grpc status
+// errors, the other errors, such as network errors, are kept. client_golang
+// reports every 5xx response as ErrServer, the type sent by prometheus, such as
+// timeout for a query which exceeded its timeout, is read from the body. An
+// error after the deadline or the cancellation of ctx is reported as such.
+func statusError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	var apiErr *v1.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	errorType, message := apiErr.Type, apiErr.Error()
+	body := struct {
+		ErrorType v1.ErrorType `json:"errorType"`
+		Error     string       `json:"error"`
+	}{}
+	if errorType == v1.ErrServer && json.Unmarshal([]byte(apiErr.Detail), &body) == nil && body.ErrorType != "" {
+		errorType, message = body.ErrorType, fmt.Sprintf("%s: %s", body.ErrorType, body.Error)
+	}
+	switch errorType {
+	case v1.ErrBadData:
+		return rpcerrors.InvalidArgument("query", "%s", message)
+	case v1.ErrTimeout:
+		return status.Error(codes.DeadlineExceeded, message)
+	case v1.ErrCanceled:
+		return status.Error(codes.Canceled, message)
+	}
+	if apiErr.Type == v1.ErrServer {
+		return rpcerrors.Unavailable("%s", message)
+	}
+	return err
+}
+
 type DataSeries struct {
 	Timestamp int64
 	Value     string
@@ -66,50 +118,87 @@ type CalculateAux struct {
 	Value     float64
 }
 
-func (p *prometheusServer) Query(startTime, endTime time.Time, kind, query, op string) (DataSeries, error) {
+func (p *prometheusServer) Query(ctx context.Context, startTime, endTime time.Time, kind, query string, ops []string) ([]DataSeries, error) {
 	method := "prometheusServer.Query"
-	ans := DataSeries{Timestamp: endTime.UnixMilli()}
+	// TODO: Use kind as the raw data query, may add a 'rawData: true' property for this?
+	raw := kind != "Pod" && kind != "Node"
+	if raw && len(ops) > 1 {
+		return nil, rpcerrors.InvalidArgument("aggregation", "%s returns the raw result for kind %s, it can't answer aggregations %s",
+			PluginName, kind, strings.Join(ops, ","))
+	}
 	prometheusAPI, err := p.NewPrometheusAPI()
 	if err != nil {
 		klog.Errorf("%s try to get prometheus API erorr: %s\n", method, err)
-		return ans, err
+		return nil, err
 	}
-	result, warnings, err := prometheusAPI.QueryRange(context.TODO(), query, v1.Range{
+	ctx, span := tracing.Start(ctx, "prometheus.QueryRange",
+		attribute.String("arbiter.source", p.name),
+		attribute.String("prometheus.query", query),
+		attribute.Int64("prometheus.step_seconds", p.stepSeconds),
+	)
+	result, warnings, err := prometheusAPI.QueryRange(ctx, query, v1.Range{
 		Start: startTime,
 		End:   endTime,
 		Step:  time.Duration(p.stepSeconds * int64(time.Second)),
 	})
+	tracing.End(span, err)
 	if err != nil {
 		klog.Errorf("%s try to query '%s' error: %s\n", method, query, err)
-		return ans, err
+		return nil, statusError(ctx, err)
 	}
 	if len(warnings) > 0 {
-		klog.V(4).Infof("%s quer '%s' result with warnings %v\n", method, warnings)
+		klog.V(4).Infof("%s query '%s' result with warnings %v\n", method, query, warnings)
 	}
 
-	// TODO: Use kind as the raw data query, may add a 'rawData: true' property for this?
-	if kind == "Pod" || kind == "Node" {
-		data, err := formatRawValues(result)
+	if !raw {
+		data, err := FormatRawValues(result)
 		if err != nil {
-			return ans, err
+			return nil, err
 		}
-		if f, ok := actionFuncs[op]; ok {
-			f(data, &ans)
+		// one record per aggregation, or no record at all without a sample
+		if len(data) == 0 {
+			return nil, nil
 		}
-	} else {
-		// Handle raw data if it's not pod or node kind, just return the json data
-		jsonValue, err := json.Marshal(result)
-		if err != nil {
-			klog.Errorf("failed to marshal result to json: %s", err)
-			ans.Value = fmt.Sprintf("failed to get json value: %s " + result.String())
-		} else {
-			ans.Value = string(jsonValue)
+		// every aggregation is computed from the same samples
+		series := make([]DataSeries, len(ops))
+		for idx, op := range ops {
+			series[idx].Timestamp = endTime.UnixMilli()
+			if !Aggregate(op, data, &series[idx]) {
+				return nil, rpcerrors.InvalidArgument("aggregation", "aggregation %s isn't supported by %s", op, PluginName)
+			}
 		}
+		return series, nil
 	}
-	return ans, nil
+
+	// Handle raw data if it's not pod or node kind, just return the json data
+	if empty(result) {
+		return nil, nil
+	}
+	ans := DataSeries{Timestamp: endTime.UnixMilli()}
+	jsonValue, err := json.Marshal(result)
+	if err != nil {
+		klog.Errorf("failed to marshal result to json: %s", err)
+		ans.Value = fmt.Sprintf("failed to get json value: %s " + result.String())
+	} else {
+		ans.Value = string(jsonValue)
+	}
+	return []DataSeries{ans}, nil
 }
 
-func formatRawValues(rawValue model.Value) ([]CalculateAux, error) {
+// empty reports whether a query result has no sample.
+func empty(value model.Value) bool {
+	switch v := value.(type) {
+	case model.Matrix:
+		return len(v) == 0
+	case model.Vector:
+		return len(v) == 0
+	}
+	return value == nil
+}
+
+// FormatRawValues converts a prometheus query result to samples, only the first
+// series of a matrix is used.
+func FormatRawValues(rawValue model.Value) ([]CalculateAux, error) {
 	ans := make([]CalculateAux, 0)
 	switch rawValue.Type() {
 	case model.ValScalar:
@@ -155,7 +244,7 @@ func formatRawValues(rawValue model.Value) ([]CalculateAux, error) {
 
 		for _, sample := range vector {
 			ans = append(ans, CalculateAux{
-				Timestamp: sample.Timestamp.Time().UnixMicro(),
+				Timestamp: sample.Timestamp.Time().UnixMilli(),
 				Value:     float64(sample.Value),
 			})
 		}
@@ -168,6 +257,16 @@ func formatRawValues(rawValue model.Value) ([]CalculateAux, error) {
 	return ans, nil
 }
 
+// Aggregate reduces data to a single value by the aggregation op, it returns
+// false when the op is unknown.
+func Aggregate(op string, data []CalculateAux, result *DataSeries) bool {
+	f, ok := actionFuncs[op]
+	if ok {
+		f(data, result)
+	}
+	return ok
+}
+
 func MaxOp(data []CalculateAux, result *DataSeries) {
 	if len(data) == 0 {
 		return
@@ -0,0 +1,387 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/transport"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakeprometheus"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+var (
+	start = time.UnixMilli(1660000000000)
+	end   = start.Add(3 * time.Minute)
+)
+
+func matrix(values ...float64) model.Matrix {
+	stream := &model.SampleStream{Metric: model.Metric{"pod": "web-0"}}
+	for idx, value := range values {
+		stream.Values = append(stream.Values, model.SamplePair{
+			Timestamp: model.TimeFromUnixNano(start.Add(time.Duration(idx) * time.Minute).UnixNano()),
+			Value:     model.SampleValue(value),
+		})
+	}
+	return model.Matrix{stream}
+}
+
+func newTestServer(t *testing.T) (*fakeprometheus.Server, *prometheusServer) {
+	t.Helper()
+	fake := fakeprometheus.NewServer()
+	t.Cleanup(fake.Close)
+	return fake, NewPrometheusServer("prom", fake.URL, &transport.Config{}, 60)
+}
+
+func TestFormatRawValues(t *testing.T) {
+	ts := model.TimeFromUnixNano(start.UnixNano())
+	tests := []struct {
+		name    string
+		value   model.Value
+		want    []CalculateAux
+		wantErr bool
+	}{
+		{
+			name:  "scalar",
+			value: &model.Scalar{Timestamp: ts, Value: 1.5},
+			want:  []CalculateAux{{Timestamp: start.UnixMilli(), Value: 1.5}},
+		},
+		{
+			name: "vector",
+			value: model.Vector{
+				{Timestamp: ts, Value: 1},
+				{Timestamp: ts, Value: 2},
+			},
+			want: []CalculateAux{{Timestamp: start.UnixMilli(), Value: 1}, {Timestamp: start.UnixMilli(), Value: 2}},
+		},
+		{
+			name:  "matrix",
+			value: matrix(1, 5, 3),
+			want: []CalculateAux{
+				{Timestamp: start.UnixMilli(), Value: 1},
+				{Timestamp: start.Add(time.Minute).UnixMilli(), Value: 5},
+				{Timestamp: start.Add(2 * time.Minute).UnixMilli(), Value: 3},
+			},
+		},
+		{
+			name:  "matrix uses the first series",
+			value: append(matrix(1), matrix(7)[0]),
+			want:  []CalculateAux{{Timestamp: start.UnixMilli(), Value: 1}},
+		},
+		{
+			name:  "empty matrix",
+			value: model.Matrix{},
+			want:  []CalculateAux{},
+		},
+		{
+			name:    "string",
+			value:   &model.String{Timestamp: ts, Value: "text"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FormatRawValues(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("FormatRawValues() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("FormatRawValues() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		ops      []string
+		response fakeprometheus.Response
+		want     []DataSeries
+		wantCode codes.Code
+		// noQuery is set when the request is rejected before the query
+		noQuery bool
+	}{
+		{
+			name:     "matrix aggregations",
+			kind:     "Pod",
+			ops:      []string{MaxAction, MinAction, AvgAction},
+			response: fakeprometheus.Response{Result: matrix(1, 5, 3)},
+			want: []DataSeries{
+				{Timestamp: start.Add(time.Minute).UnixMilli(), Value: "5.000000"},
+				{Timestamp: start.UnixMilli(), Value: "1.000000"},
+				{Timestamp: end.UnixMilli(), Value: "3.000000"},
+			},
+		},
+		{
+			name:     "vector",
+			kind:     "Node",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{Result: model.Vector{{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: 4}}},
+			want:     []DataSeries{{Timestamp: start.UnixMilli(), Value: "4.000000"}},
+		},
+		{
+			name:     "scalar",
+			kind:     "Pod",
+			ops:      []string{AvgAction},
+			response: fakeprometheus.Response{Result: &model.Scalar{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: 2}},
+			want:     []DataSeries{{Timestamp: end.UnixMilli(), Value: "2.000000"}},
+		},
+		{
+			name:     "warnings are ignored",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{Result: matrix(2), Warnings: []string{"partial response"}},
+			want:     []DataSeries{{Timestamp: start.UnixMilli(), Value: "2.000000"}},
+		},
+		{
+			name:     "raw json of other kinds",
+			kind:     "Deployment",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{Result: &model.Scalar{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: 2}},
+			want:     []DataSeries{{Timestamp: end.UnixMilli(), Value: `[1660000000,"2"]`}},
+		},
+		{
+			name:     "raw json of other kinds can't be aggregated several times",
+			kind:     "Deployment",
+			ops:      []string{MaxAction, MinAction},
+			response: fakeprometheus.Response{Result: matrix(1, 5, 3)},
+			wantCode: codes.InvalidArgument,
+			noQuery:  true,
+		},
+		{
+			name:     "no record without sample",
+			kind:     "Pod",
+			ops:      []string{MaxAction, MinAction},
+			response: fakeprometheus.Response{Result: model.Matrix{}},
+		},
+		{
+			name:     "no record without sample in the vector",
+			kind:     "Node",
+			ops:      []string{AvgAction},
+			response: fakeprometheus.Response{Result: model.Vector{}},
+		},
+		{
+			name:     "no raw record without sample",
+			kind:     "Deployment",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{Result: model.Matrix{}},
+		},
+		{
+			name:     "string result",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{Result: &model.String{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: "text"}},
+			wantCode: codes.Unknown,
+		},
+		{
+			name:     "unknown aggregation",
+			kind:     "Pod",
+			ops:      []string{"p99"},
+			response: fakeprometheus.Response{Result: matrix(1)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "bad data",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{ErrorType: v1.ErrBadData, Error: "parse error"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "query timeout",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{ErrorType: v1.ErrTimeout, Error: "query timed out"},
+			wantCode: codes.DeadlineExceeded,
+		},
+		{
+			name:     "query canceled",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{ErrorType: v1.ErrCanceled, Error: "query canceled"},
+			wantCode: codes.Canceled,
+		},
+		{
+			name:     "server error with a body",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{ErrorType: v1.ErrExec, Error: "storage failure", StatusCode: http.StatusInternalServerError},
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:     "server error",
+			kind:     "Pod",
+			ops:      []string{MaxAction},
+			response: fakeprometheus.Response{StatusCode: http.StatusBadGateway},
+			wantCode: codes.Unavailable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, server := newTestServer(t)
+			fake.SetResponse("up", test.response)
+
+			got, err := server.Query(context.Background(), start, end, test.kind, "up", test.ops)
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("Query() error = %v, want code %s", err, test.wantCode)
+			}
+			if test.wantCode == codes.OK && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Query() = %v, want %v", got, test.want)
+			}
+			requests := fake.Requests()
+			if test.noQuery {
+				if len(requests) != 0 {
+					t.Errorf("requests = %+v, want none", requests)
+				}
+				return
+			}
+			if len(requests) != 1 || requests[0].Path != "/api/v1/query_range" || requests[0].Step != "60" {
+				t.Errorf("requests = %+v, want a single query_range with step 60", requests)
+			}
+		})
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		wantCode codes.Code
+	}{
+		{
+			name:     "canceled",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			wantCode: codes.Canceled,
+		},
+		{
+			name: "deadline exceeded",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			},
+			wantCode: codes.DeadlineExceeded,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, server := newTestServer(t)
+			fake.SetResponse("up", fakeprometheus.Response{Result: matrix(1)})
+			ctx, cancel := test.ctx()
+			cancel()
+
+			_, err := server.Query(ctx, start, end, "Pod", "up", []string{MaxAction})
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("Query() error = %v, want code %s", err, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestFetchData(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *obi.GetMetricsRequest
+		want     []*obi.GetMetricsResponseRecord
+		wantCode codes.Code
+	}{
+		{
+			name: "default aggregation is avg",
+			req:  &obi.GetMetricsRequest{Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu", Query: "up"},
+			want: []*obi.GetMetricsResponseRecord{{Timestamp: end.UnixMilli(), Value: "3.000000"}},
+		},
+		{
+			name: "one record per aggregation",
+			req: &obi.GetMetricsRequest{Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu", Query: "up",
+				Aggregation: []string{MinAction, MaxAction}},
+			want: []*obi.GetMetricsResponseRecord{
+				{Timestamp: start.UnixMilli(), Value: "1.000000"},
+				{Timestamp: start.Add(time.Minute).UnixMilli(), Value: "5.000000"},
+			},
+		},
+		{
+			name: "raw result of other kinds with several aggregations",
+			req: &obi.GetMetricsRequest{Kind: "Deployment", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu", Query: "up",
+				Aggregation: []string{MinAction, MaxAction}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "query is required",
+			req:      &obi.GetMetricsRequest{Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu"},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, server := newTestServer(t)
+			fake.SetResponse("up", fakeprometheus.Response{Result: matrix(1, 5, 3)})
+			test.req.StartTime = start.UnixMilli()
+			test.req.EndTime = end.UnixMilli()
+
+			got, err := server.FetchData(context.Background(), test.req)
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() error = %v, want code %s", err, test.wantCode)
+			}
+			if got.ResourceName != "web-0" || got.Namespace != "default" {
+				t.Errorf("FetchData() resource %s/%s, want default/web-0", got.Namespace, got.ResourceName)
+			}
+			if test.wantCode == codes.OK && !reflect.DeepEqual(got.Records, test.want) {
+				t.Errorf("FetchData() records = %v, want %v", got.Records, test.want)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	fake, server := newTestServer(t)
+	if err := server.Probe(context.Background()); err != nil {
+		t.Errorf("Probe() error = %v", err)
+	}
+	fake.SetDefaultResponse(fakeprometheus.Response{StatusCode: http.StatusServiceUnavailable})
+	if err := server.Probe(context.Background()); err == nil {
+		t.Error("Probe() of a failing server succeeded")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fake, server := newTestServer(t)
+	fake.SetDefaultResponse(fakeprometheus.Response{Result: matrix(1, 5, 3)})
+	conformance.Suite{
+		Observer: server,
+		Requests: []*obi.GetMetricsRequest{
+			{
+				Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu", Query: "up",
+				StartTime: start.UnixMilli(), EndTime: end.UnixMilli(),
+			},
+			{
+				Kind: "Node", ResourceNames: []string{"node-1"}, MetricName: "memory", Query: "up",
+				Aggregation: []string{MaxAction, MinAction, AvgAction},
+				StartTime:   start.UnixMilli(), EndTime: end.UnixMilli(),
+			},
+		},
+	}.Run(t)
+}
@@ -17,14 +17,19 @@ limitations under the License.
 package prometheus
 
 import (
+	"context"
+	"fmt"
 	"time"
 
-	"golang.org/x/net/context"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
 	"k8s.io/klog/v2"
 
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
 	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
 	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
 	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
 )
@@ -40,23 +45,25 @@ const (
 // impl obi interface
 type prometheusServer struct {
 	obi.UnimplementedServerServer
+	name        string
 	address     string
-	restConf    *rest.Config
+	transConf   *transport.Config
 	stepSeconds int64
 }
 
-func NewPrometheusServer(address string, restConf *rest.Config, stepSeconds int64) *prometheusServer {
+func NewPrometheusServer(name, address string, transConf *transport.Config, stepSeconds int64) *prometheusServer {
 	method := "NewPrometheusServer"
-	klog.V(4).Infof("%s stepSecond: %d\n", method, stepSeconds)
+	klog.V(4).Infof("%s %s stepSecond: %d\n", method, name, stepSeconds)
 	return &prometheusServer{
+		name:        name,
 		address:     address,
-		restConf:    restConf,
+		transConf:   transConf,
 		stepSeconds: stepSeconds,
 	}
 }
 
 func (p *prometheusServer) Name() string {
-	return PluginName
+	return p.name
 }
 
 func (p *prometheusServer) Capabilities() map[string]*obi.CapabilityInfo {
@@ -94,18 +101,22 @@ func (p *prometheusServer) FetchData(ctx context.Context, req *obi.GetMetricsReq
 		Records:      []*obi.GetMetricsResponseRecord{},
 	}
 
-	// use avgerage as the default aggregation action
-	op := AvgAction
-	if len(req.Aggregation) > 0 {
-		op = req.Aggregation[0]
+	if req.Query == "" {
+		return result, rpcerrors.InvalidArgument("query", "%s requires a PromQL query", PluginName)
 	}
-	metricData, err := p.Query(startTime, endTime, req.Kind, req.Query, op)
+
+	// use avgerage as the default aggregation action
+	ops := resource.Aggregations(req, AvgAction)
+	metricData, err := p.Query(ctx, startTime, endTime, req.Kind, req.Query, ops)
 	if err != nil {
 		klog.Errorf("%s query error: %s\n", method, err)
 		return result, err
 	}
-	// only return the latest record
-	result.Records = append(result.Records, &obi.GetMetricsResponseRecord{Timestamp: metricData.Timestamp, Value: metricData.Value})
+	// only return the latest record of each aggregation, in the order of the
+	// requested aggregations
+	for _, data := range metricData {
+		result.Records = append(result.Records, &obi.GetMetricsResponseRecord{Timestamp: data.Timestamp, Value: data.Value})
+	}
 
 	klog.Infof("query by metric '%s', query '%s' successfully", req.MetricName, req.Query)
 	klog.V(5).Infof("%s query by %s, %s result: %v\n", method, req.MetricName, req.Query, metricData)
@@ -113,13 +124,43 @@ func (p *prometheusServer) FetchData(ctx context.Context, req *obi.GetMetricsReq
 	return result, nil
 }
 
-func init() {
-	cfg, err := clientcmd.BuildConfigFromFlags("", *flags.Kubeconfig)
-	if err == nil {
-		instance := NewPrometheusServer(*flags.Address, cfg, *flags.StepSeconds)
-		resource.Register(instance)
-		klog.Infof("Observer [%s] registration is successful", PluginName)
+// New creates a prometheus instance from its config, the settings left empty
+// fall back to the flags. Without auth settings the credentials of the
+// kubeconfig are used.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	address := cfg.Address
+	if address == "" {
+		address = *flags.Address
+	}
+	if address == "" {
+		return nil, fmt.Errorf("%w: %s has no address", resource.ErrNotConfigured, cfg.Name)
+	}
+	stepSeconds := int64(cfg.Step.Seconds())
+	if stepSeconds <= 0 {
+		stepSeconds = *flags.StepSeconds
+	}
+
+	var (
+		transConf *transport.Config
+		err       error
+	)
+	if cfg.Auth != nil {
+		transConf, err = cfg.Auth.TransportConfig()
 	} else {
-		klog.Warningf("Observer [%s] registration failed", PluginName)
+		restConf, restErr := clientcmd.BuildConfigFromFlags("", *flags.Kubeconfig)
+		if restErr != nil {
+			return nil, restErr
+		}
+		transConf, err = restConf.TransportConfig()
+	}
+	if err != nil {
+		return nil, err
 	}
+	transConf.Wrap(metrics.InstrumentRoundTripper(cfg.Name, PluginName))
+	transConf.Wrap(tracing.RoundTripper)
+	return NewPrometheusServer(cfg.Name, address, transConf, stepSeconds), nil
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
 }
@@ -18,29 +18,105 @@ package resource
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"k8s.io/klog/v2"
 
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
 	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
 )
 
 var (
-	once         sync.Once
-	mustRegister map[string]Observer
+	// registry holds a map[string]Observer that is never modified once stored,
+	// it's replaced as a whole so that readers don't need a lock and in-flight
+	// requests keep the instances they got.
+	registry   atomic.Value
+	registerMu sync.Mutex
+
+	factories = map[string]Factory{}
 )
 
+func init() {
+	registry.Store(map[string]Observer{})
+}
+
+// Factory creates an observer instance from its config.
+type Factory func(config.PluginConfig) (Observer, error)
+
+// ErrNotConfigured is returned by a factory when a setting that the plugin can't
+// work without, such as the backend address, is missing.
+var ErrNotConfigured = errors.New("plugin isn't configured")
+
+// RegisterFactory registers the factory of a plugin type, it's called from the
+// init function of the plugin package.
+func RegisterFactory(pluginType string, factory Factory) {
+	if _, ok := factories[pluginType]; ok {
+		klog.Warningf("Observer type %s already exists", pluginType)
+	}
+	factories[pluginType] = factory
+}
+
+// Types returns the registered plugin types in order.
+func Types() []string {
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewObserver creates an observer instance by the factory of its type.
+func NewObserver(cfg config.PluginConfig) (Observer, error) {
+	factory, ok := factories[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin type %s", cfg.Type)
+	}
+	return factory(cfg)
+}
+
 func Register(instance Observer) {
-	once.Do(func() {
-		mustRegister = make(map[string]Observer)
-	})
+	registerMu.Lock()
+	defer registerMu.Unlock()
 
+	current := Registered()
 	name := instance.Name()
-	if _, ok := mustRegister[name]; ok {
+	if _, ok := current[name]; ok {
 		klog.Warningf("Observer %s already exists", name)
 	}
 
-	mustRegister[name] = instance
+	next := make(map[string]Observer, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	next[name] = instance
+	registry.Store(next)
+}
+
+// Replace swaps all registered instances for the given ones at once.
+func Replace(instances []Observer) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	next := make(map[string]Observer, len(instances))
+	for _, instance := range instances {
+		if _, ok := next[instance.Name()]; ok {
+			klog.Warningf("Observer %s already exists", instance.Name())
+		}
+		next[instance.Name()] = instance
+	}
+	registry.Store(next)
+}
+
+// Registered returns the registered instances by name, the map must not be
+// modified.
+func Registered() map[string]Observer {
+	return registry.Load().(map[string]Observer)
 }
 
 type Observer interface {
@@ -49,18 +125,99 @@ type Observer interface {
 	Capabilities() map[string]*obi.CapabilityInfo
 }
 
+// Prober is implemented by observers that can check the connectivity to their
+// backend, such as prometheus or the api server.
+type Prober interface {
+	Probe(context.Context) error
+}
+
+// Dependent is implemented by observers forwarding the requests to other
+// sources, such as composite and failover, they have no backend of their own.
+// They're ready when one of their sources is, or always when their sources are
+// named by each request.
+type Dependent interface {
+	Sources() []string
+}
+
+// HasBackend reports whether the observer queries a backend of its own, unlike
+// the Dependent observers.
+func HasBackend(instance Observer) bool {
+	_, ok := Unwrap(instance).(Dependent)
+	return !ok
+}
+
 func GetRegisters(name string) (Observer, bool) {
-	v, ok := mustRegister[name]
+	v, ok := Registered()[name]
 	return v, ok
 }
 
 func Resources() []string {
-	pluginNames := make([]string, len(mustRegister))
+	current := Registered()
+	pluginNames := make([]string, len(current))
 	i := 0
 
-	for k := range mustRegister {
+	for k := range current {
 		pluginNames[i] = k
 		i++
 	}
 	return pluginNames
 }
+
+// LatestValue returns the value of the newest record of the response.
+func LatestValue(response *obi.GetMetricsResponse) (float64, error) {
+	if response == nil || len(response.Records) == 0 {
+		return 0, fmt.Errorf("no records returned")
+	}
+	latest := response.Records[0]
+	for _, record := range response.Records[1:] {
+		if record.Timestamp >= latest.Timestamp {
+			latest = record
+		}
+	}
+	value, err := strconv.ParseFloat(latest.Value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("record value '%s' isn't a number", latest.Value)
+	}
+	return value, nil
+}
+
+// AggregationHeader is the grpc response header listing the aggregation of each
+// record, in the order of the records. The records of GetMetricsResponse can't
+// carry their aggregation, the record i is the one of the aggregation i of the
+// request.
+const AggregationHeader = "arbiter-aggregation"
+
+// Aggregations returns the aggregations requested by req, or defaultOp when
+// none is requested. The observers computing several aggregations return one
+// record per aggregation in this order, or no record at all.
+func Aggregations(req *obi.GetMetricsRequest, defaultOp string) []string {
+	if len(req.Aggregation) == 0 {
+		return []string{defaultOp}
+	}
+	return req.Aggregation
+}
+
+// SupportedAggregations returns the aggregations listed by the capability of
+// the metric, or by all capabilities when the metric isn't one of them. It's
+// empty when the observer doesn't aggregate.
+func SupportedAggregations(instance Observer, metricName string) []string {
+	capabilities := instance.Capabilities()
+	if capability, ok := capabilities[metricName]; ok && capability != nil {
+		return capability.Aggregation
+	}
+	seen := map[string]struct{}{}
+	supported := []string{}
+	for _, capability := range capabilities {
+		if capability == nil {
+			continue
+		}
+		for _, op := range capability.Aggregation {
+			if _, ok := seen[op]; !ok {
+				seen[op] = struct{}{}
+				supported = append(supported, op)
+			}
+		}
+	}
+	sort.Strings(supported)
+	return supported
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resource
+
+import (
+	"context"
+	"time"
+
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// Wrapper is implemented by observers decorating another observer, such as the
+// timeout observer.
+type Wrapper interface {
+	Unwrap() Observer
+}
+
+// Unwrap returns the innermost observer, it's used to check the type of the
+// plugin behind decorators.
+func Unwrap(instance Observer) Observer {
+	for {
+		wrapper, ok := instance.(Wrapper)
+		if !ok {
+			return instance
+		}
+		instance = wrapper.Unwrap()
+	}
+}
+
+type timeoutObserver struct {
+	Observer
+	timeout time.Duration
+}
+
+// WithTimeout bounds every FetchData and Probe call of the observer by the
+// timeout, the deadline of the request context is kept when it's earlier.
+func WithTimeout(instance Observer, timeout time.Duration) Observer {
+	if timeout <= 0 {
+		return instance
+	}
+	return &timeoutObserver{Observer: instance, timeout: timeout}
+}
+
+func (t *timeoutObserver) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Observer.FetchData(ctx, req)
+}
+
+// Probe calls the probe of the observer, observers without probe are always
+// reachable.
+func (t *timeoutObserver) Probe(ctx context.Context) error {
+	prober, ok := t.Observer.(Prober)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return prober.Probe(ctx)
+}
+
+func (t *timeoutObserver) Unwrap() Observer {
+	return t.Observer
+}
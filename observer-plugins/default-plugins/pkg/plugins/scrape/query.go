@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scrape
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	queryPort   = "port"
+	queryPath   = "path"
+	queryScheme = "scheme"
+	queryMetric = "metric"
+	queryLabel  = "label"
+	queryRate   = "rate"
+
+	defaultPath   = "/metrics"
+	defaultScheme = "http"
+)
+
+// scrapeQuery is the parsed form of GetMetricsRequest.Query. The query uses
+// the url query encoding, for example:
+//
+//	port=8080&path=/metrics&metric=http_requests_total&label=code=200&rate=true
+//
+// port and metric are required, label can be repeated and every label must
+// match for a series to be selected.
+type scrapeQuery struct {
+	port   int
+	path   string
+	scheme string
+	metric string
+	labels map[string]string
+	rate   bool
+}
+
+func parseQuery(raw string) (*scrapeQuery, error) {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scrape query '%s': %w", raw, err)
+	}
+
+	q := &scrapeQuery{
+		path:   defaultPath,
+		scheme: defaultScheme,
+		metric: values.Get(queryMetric),
+		labels: map[string]string{},
+	}
+	if q.metric == "" {
+		return nil, fmt.Errorf("scrape query '%s' doesn't specify the metric", raw)
+	}
+
+	port := values.Get(queryPort)
+	if port == "" {
+		return nil, fmt.Errorf("scrape query '%s' doesn't specify the port", raw)
+	}
+	if q.port, err = strconv.Atoi(port); err != nil || q.port <= 0 || q.port > 65535 {
+		return nil, fmt.Errorf("scrape query '%s' has invalid port '%s'", raw, port)
+	}
+
+	if path := values.Get(queryPath); path != "" {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		q.path = path
+	}
+	if scheme := values.Get(queryScheme); scheme != "" {
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("scrape query '%s' has unsupported scheme '%s'", raw, scheme)
+		}
+		q.scheme = scheme
+	}
+	if rate := values.Get(queryRate); rate != "" {
+		if q.rate, err = strconv.ParseBool(rate); err != nil {
+			return nil, fmt.Errorf("scrape query '%s' has invalid rate '%s'", raw, rate)
+		}
+	}
+
+	for _, label := range values[queryLabel] {
+		name, value, ok := strings.Cut(label, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("scrape query '%s' has invalid label matcher '%s'", raw, label)
+		}
+		q.labels[name] = value
+	}
+	return q, nil
+}
+
+// key identifies the series selected by the query, it's used to remember the
+// previous scrape when the rate is requested.
+func (q *scrapeQuery) key() string {
+	names := make([]string, 0, len(q.labels))
+	for name := range q.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make([]string, 0, len(names))
+	for _, name := range names {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", name, q.labels[name]))
+	}
+	return fmt.Sprintf("%s://:%d%s/%s{%s}", q.scheme, q.port, q.path, q.metric, strings.Join(matchers, ","))
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+)
+
+// Sample is a single value taken from a scraped metric family.
+type Sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// scrape fetches the metrics endpoint of the pod and returns the value of every
+// series of the query's metric family whose labels match the query.
+func (s *scrapeServer) scrape(ctx context.Context, podIP string, q *scrapeQuery) ([]float64, error) {
+	method := "scrapeServer.scrape"
+	target := fmt.Sprintf("%s://%s%s", q.scheme, net.JoinHostPort(podIP, strconv.Itoa(q.port)), q.path)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	// only the text exposition format is parsed.
+	httpReq.Header.Set("Accept", string(expfmt.FmtText))
+
+	resp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		klog.Errorf("%s scrape %s error: %s\n", method, target, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, rpcerrors.FromHTTPStatus(resp.StatusCode, "scrape %s returned status %s", target, resp.Status)
+	}
+
+	body := io.LimitReader(resp.Body, s.maxBytes+1)
+	counter := &countingReader{r: body}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(counter)
+	if counter.n > s.maxBytes {
+		return nil, fmt.Errorf("scrape %s response exceeds %d bytes", target, s.maxBytes)
+	}
+	if err != nil {
+		klog.Errorf("%s parse response of %s error: %s\n", method, target, err)
+		return nil, err
+	}
+
+	family, ok := families[q.metric]
+	if !ok {
+		return nil, rpcerrors.NotFound("metric", q.metric, "metric family %s not found in %s", q.metric, target)
+	}
+	klog.V(5).Infof("%s metric family %s has %d series\n", method, q.metric, len(family.Metric))
+
+	values := make([]float64, 0, len(family.Metric))
+	for _, metric := range family.Metric {
+		if !matchLabels(metric, q.labels) {
+			continue
+		}
+		value, err := metricValue(family.GetType(), metric)
+		if err != nil {
+			return nil, fmt.Errorf("metric family %s: %w", q.metric, err)
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return nil, rpcerrors.NotFound("metric", q.metric, "no series of metric family %s matches labels %v", q.metric, q.labels)
+	}
+	return values, nil
+}
+
+func matchLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range metric.GetLabel() {
+		value, ok := labels[pair.GetName()]
+		if !ok {
+			continue
+		}
+		if value != pair.GetValue() {
+			return false
+		}
+		matched++
+	}
+	return matched == len(labels)
+}
+
+func metricValue(metricType dto.MetricType, metric *dto.Metric) (float64, error) {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return metric.GetCounter().GetValue(), nil
+	case dto.MetricType_GAUGE:
+		return metric.GetGauge().GetValue(), nil
+	case dto.MetricType_UNTYPED:
+		return metric.GetUntyped().GetValue(), nil
+	default:
+		return 0, fmt.Errorf("metric type %s isn't supported", metricType)
+	}
+}
+
+// rate returns the per-second increase between the previous and current sample
+// of the series identified by key, and remembers the current sample. The second
+// return value is false when there is no usable previous sample yet, a sample
+// older than the sample ttl isn't used.
+func (s *scrapeServer) rate(key string, current Sample) (float64, bool) {
+	s.mu.Lock()
+	s.evict(current.Timestamp)
+	previous, ok := s.lastSamples[key]
+	s.lastSamples[key] = current
+	s.mu.Unlock()
+
+	if !ok || current.Timestamp <= previous.Timestamp || current.Timestamp-previous.Timestamp > s.sampleTTL.Milliseconds() {
+		return 0, false
+	}
+	increase := current.Value - previous.Value
+	if increase < 0 {
+		// counter reset, the current value is the increase since the reset.
+		increase = current.Value
+	}
+	seconds := float64(current.Timestamp-previous.Timestamp) / float64(time.Second/time.Millisecond)
+	return increase / seconds, true
+}
+
+// evict drops the samples older than the sample ttl, so that the series of
+// deleted pods don't stay in memory. The samples are swept at most once per
+// ttl, it must be called with the lock held.
+func (s *scrapeServer) evict(now int64) {
+	ttl := s.sampleTTL.Milliseconds()
+	if now-s.lastEvict < ttl {
+		return
+	}
+	s.lastEvict = now
+	for key, sample := range s.lastSamples {
+		if now-sample.Timestamp > ttl {
+			delete(s.lastSamples, key)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
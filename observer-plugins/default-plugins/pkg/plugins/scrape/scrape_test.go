@@ -0,0 +1,402 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk/conformance"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const exposition = `# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 30
+http_requests_total{code="200",method="post"} 10
+http_requests_total{code="500",method="get"} 2
+# HELP queue_length The length of the queue.
+# TYPE queue_length gauge
+queue_length{queue="a"} 4
+queue_length{queue="b"} 8
+# HELP build_info The build summary.
+# TYPE build_info summary
+build_info_sum 1
+build_info_count 1
+`
+
+// newTestServer returns a scrape server reading the pod default/web-0, whose
+// metrics endpoint is an httptest server answering body with statusCode.
+func newTestServer(t *testing.T, statusCode int, body string) (*scrapeServer, int) {
+	t.Helper()
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != defaultPath {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(statusCode)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(endpoint.Close)
+	host, port, err := net.SplitHostPort(endpoint.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0"},
+		Status:     v1.PodStatus{PodIP: host},
+	}, &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pending-0"},
+	})
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewScrapeServer("scrape", client, time.Second, 1<<20, time.Minute), portNumber
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    *scrapeQuery
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			raw:  "port=8080&metric=up",
+			want: &scrapeQuery{port: 8080, path: defaultPath, scheme: defaultScheme, metric: "up", labels: map[string]string{}},
+		},
+		{
+			name: "all fields",
+			raw:  "port=8443&path=stats&scheme=https&metric=http_requests_total&label=code=200&label=method=get&rate=true",
+			want: &scrapeQuery{port: 8443, path: "/stats", scheme: "https", metric: "http_requests_total",
+				labels: map[string]string{"code": "200", "method": "get"}, rate: true},
+		},
+		{name: "without metric", raw: "port=8080", wantErr: true},
+		{name: "without port", raw: "metric=up", wantErr: true},
+		{name: "invalid port", raw: "port=70000&metric=up", wantErr: true},
+		{name: "unsupported scheme", raw: "port=8080&metric=up&scheme=ftp", wantErr: true},
+		{name: "invalid rate", raw: "port=8080&metric=up&rate=often", wantErr: true},
+		{name: "invalid label", raw: "port=8080&metric=up&label=code", wantErr: true},
+		{name: "invalid encoding", raw: "port=8080&metric=%zz", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseQuery(test.raw)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseQuery() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseQuery() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		op      string
+		want    float64
+		wantErr bool
+	}{
+		{op: SumAction, want: 12},
+		{op: AvgAction, want: 4},
+		{op: MaxAction, want: 6},
+		{op: MinAction, want: 2},
+		{op: "p99", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.op, func(t *testing.T) {
+			got, err := aggregate(test.op, []float64{4, 2, 6})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("aggregate() error = %v, wantErr %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("aggregate() = %f, want %f", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFetchData(t *testing.T) {
+	tests := []struct {
+		name        string
+		kind        string
+		pod         string
+		query       string
+		aggregation []string
+		statusCode  int
+		body        string
+		maxBytes    int64
+		want        []string
+		wantCode    codes.Code
+		wantErr     bool
+	}{
+		{
+			name:  "counter series are summed by default",
+			query: "metric=http_requests_total",
+			want:  []string{"42.000000"},
+		},
+		{
+			name:  "label matchers select the series",
+			query: "metric=http_requests_total&label=code=200",
+			want:  []string{"40.000000"},
+		},
+		{
+			name:  "every label must match",
+			query: "metric=http_requests_total&label=code=200&label=method=post",
+			want:  []string{"10.000000"},
+		},
+		{
+			name:        "one record per aggregation in the order of the request",
+			query:       "metric=queue_length",
+			aggregation: []string{MaxAction, MinAction, AvgAction},
+			want:        []string{"8.000000", "4.000000", "6.000000"},
+		},
+		{
+			name:     "missing metric family",
+			query:    "metric=missing",
+			wantCode: codes.NotFound,
+		},
+		{
+			name:     "no series matches the labels",
+			query:    "metric=http_requests_total&label=code=404",
+			wantCode: codes.NotFound,
+		},
+		{
+			name:    "unsupported metric type",
+			query:   "metric=build_info",
+			wantErr: true,
+		},
+		{
+			name:       "endpoint error",
+			query:      "metric=queue_length",
+			statusCode: http.StatusServiceUnavailable,
+			wantCode:   codes.Unavailable,
+		},
+		{
+			name:    "invalid exposition",
+			query:   "metric=queue_length",
+			body:    "queue_length{queue=\"a\" 4\n",
+			wantErr: true,
+		},
+		{
+			name:     "response over the size limit",
+			query:    "metric=queue_length",
+			maxBytes: 64,
+			wantErr:  true,
+		},
+		{
+			name:     "unsupported kind",
+			kind:     "Node",
+			query:    "metric=queue_length",
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid query",
+			query:    "label=queue=a",
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:        "unsupported aggregation",
+			query:       "metric=queue_length",
+			aggregation: []string{"p99"},
+			wantCode:    codes.InvalidArgument,
+		},
+		{
+			name:    "pod without ip",
+			pod:     "pending-0",
+			query:   "metric=queue_length",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statusCode, body := http.StatusOK, exposition
+			if test.statusCode != 0 {
+				statusCode = test.statusCode
+			}
+			if test.body != "" {
+				body = test.body
+			}
+			server, port := newTestServer(t, statusCode, body)
+			if test.maxBytes != 0 {
+				server.maxBytes = test.maxBytes
+			}
+			kind, pod := PodKind, "web-0"
+			if test.kind != "" {
+				kind = test.kind
+			}
+			if test.pod != "" {
+				pod = test.pod
+			}
+			query := test.query
+			if strings.Contains(query, "metric=") {
+				query = fmt.Sprintf("port=%d&%s", port, query)
+			}
+
+			got, err := server.FetchData(context.Background(), &obi.GetMetricsRequest{
+				Kind: kind, Namespace: "default", ResourceNames: []string{pod}, Query: query, Aggregation: test.aggregation,
+			})
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("FetchData() records = %v, want an error", got.Records)
+				}
+				return
+			}
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("FetchData() error = %v, want code %s", err, test.wantCode)
+			}
+			if test.wantCode != codes.OK {
+				return
+			}
+			values := make([]string, 0, len(got.Records))
+			for _, record := range got.Records {
+				values = append(values, record.Value)
+			}
+			if !reflect.DeepEqual(values, test.want) {
+				t.Errorf("FetchData() values = %v, want %v", values, test.want)
+			}
+			if got.ResourceName != pod || got.Source != "scrape" {
+				t.Errorf("FetchData() = %s from %s, want %s from scrape", got.ResourceName, got.Source, pod)
+			}
+		})
+	}
+}
+
+func TestFetchDataRate(t *testing.T) {
+	server, port := newTestServer(t, http.StatusOK, exposition)
+	req := &obi.GetMetricsRequest{
+		Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"},
+		Query: fmt.Sprintf("port=%d&metric=http_requests_total&rate=true", port),
+	}
+	got, err := server.FetchData(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 0 {
+		t.Errorf("FetchData() of the first scrape = %v, want no record", got.Records)
+	}
+	if len(server.lastSamples) != 1 {
+		t.Errorf("FetchData() remembered %d samples, want 1", len(server.lastSamples))
+	}
+}
+
+func TestRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous *Sample
+		current  Sample
+		want     float64
+		wantOK   bool
+	}{
+		{
+			name:    "no previous sample",
+			current: Sample{Timestamp: 10000, Value: 5},
+		},
+		{
+			name:     "increase per second",
+			previous: &Sample{Timestamp: 10000, Value: 5},
+			current:  Sample{Timestamp: 20000, Value: 25},
+			want:     2,
+			wantOK:   true,
+		},
+		{
+			name:     "counter reset",
+			previous: &Sample{Timestamp: 10000, Value: 50},
+			current:  Sample{Timestamp: 15000, Value: 10},
+			want:     2,
+			wantOK:   true,
+		},
+		{
+			name:     "same timestamp",
+			previous: &Sample{Timestamp: 10000, Value: 5},
+			current:  Sample{Timestamp: 10000, Value: 6},
+		},
+		{
+			name:     "previous sample older than the ttl",
+			previous: &Sample{Timestamp: 10000, Value: 5},
+			current:  Sample{Timestamp: 10000 + time.Hour.Milliseconds(), Value: 25},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewScrapeServer("scrape", nil, time.Second, 1<<20, time.Minute)
+			if test.previous != nil {
+				server.rate("series", *test.previous)
+			}
+			got, ok := server.rate("series", test.current)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("rate() = %f, %t, want %f, %t", got, ok, test.want, test.wantOK)
+			}
+			if server.lastSamples["series"] != test.current {
+				t.Errorf("rate() remembered %v, want %v", server.lastSamples["series"], test.current)
+			}
+		})
+	}
+}
+
+func TestRateEvictsStaleSamples(t *testing.T) {
+	server := NewScrapeServer("scrape", nil, time.Second, 1<<20, time.Minute)
+	start := time.Now().UnixMilli()
+	for i := 0; i < 100; i++ {
+		server.rate(fmt.Sprintf("default/web-%d", i), Sample{Timestamp: start, Value: 1})
+	}
+	server.rate("default/web-0", Sample{Timestamp: start + 30*time.Second.Milliseconds(), Value: 2})
+	if len(server.lastSamples) != 100 {
+		t.Fatalf("rate() kept %d samples within the ttl, want 100", len(server.lastSamples))
+	}
+
+	server.rate("default/web-100", Sample{Timestamp: start + 2*time.Minute.Milliseconds(), Value: 1})
+	want := map[string]Sample{"default/web-100": {Timestamp: start + 2*time.Minute.Milliseconds(), Value: 1}}
+	if !reflect.DeepEqual(server.lastSamples, want) {
+		t.Errorf("rate() kept %v after the ttl, want %v", server.lastSamples, want)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	server, port := newTestServer(t, http.StatusOK, exposition)
+	conformance.Suite{
+		Observer: server,
+		Requests: []*obi.GetMetricsRequest{
+			{
+				Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "metric",
+				Query: fmt.Sprintf("port=%d&metric=http_requests_total", port),
+			},
+			{
+				Kind: PodKind, Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "metric",
+				Query:       fmt.Sprintf("port=%d&metric=queue_length", port),
+				Aggregation: []string{MaxAction, MinAction, AvgAction},
+			},
+		},
+	}.Run(t)
+}
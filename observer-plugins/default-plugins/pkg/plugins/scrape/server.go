@@ -0,0 +1,239 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/config"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/flags"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+const (
+	PluginName = "scrape"
+	PodKind    = "Pod"
+	SumAction  = "sum"
+	MaxAction  = "max"
+	MinAction  = "min"
+	AvgAction  = "avg"
+)
+
+// scrapeServer reads metrics directly from the prometheus exposition endpoint
+// of a pod, it's useful when the workload isn't scraped by any prometheus.
+type scrapeServer struct {
+	name       string
+	client     kubernetes.Interface
+	httpClient *http.Client
+	timeout    time.Duration
+	maxBytes   int64
+	sampleTTL  time.Duration
+
+	mu          sync.Mutex
+	lastSamples map[string]Sample
+	lastEvict   int64
+}
+
+func NewScrapeServer(name string, client kubernetes.Interface, timeout time.Duration, maxBytes int64, sampleTTL time.Duration) *scrapeServer {
+	return &scrapeServer{
+		name:        name,
+		client:      client,
+		httpClient:  &http.Client{},
+		timeout:     timeout,
+		maxBytes:    maxBytes,
+		sampleTTL:   sampleTTL,
+		lastSamples: map[string]Sample{},
+	}
+}
+
+func (s *scrapeServer) Name() string {
+	return s.name
+}
+
+// Probe checks that the api server is reachable.
+func (s *scrapeServer) Probe(ctx context.Context) error {
+	return s.client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+func (s *scrapeServer) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{
+		"metric": {
+			Description: "scrape a metric family from the prometheus endpoint of a pod",
+			Aggregation: []string{SumAction, MaxAction, MinAction, AvgAction},
+		},
+	}
+}
+
+func (s *scrapeServer) FetchData(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	method := "scrapeServer/FetchData"
+	klog.V(4).Infof("%s req %s\n", method, req.String())
+
+	result := &obi.GetMetricsResponse{
+		Namespace: req.Namespace,
+		Unit:      req.Unit,
+		Source:    s.name,
+		Records:   []*obi.GetMetricsResponseRecord{},
+	}
+	if req.Kind != PodKind {
+		return result, rpcerrors.InvalidArgument("kind", "%s only supports kind %s, got %s", PluginName, PodKind, req.Kind)
+	}
+	if len(req.ResourceNames) == 0 {
+		return result, rpcerrors.InvalidArgument("resource_names", "%s requires the pod name", PluginName)
+	}
+	result.ResourceName = req.ResourceNames[0]
+
+	q, err := parseQuery(req.Query)
+	if err != nil {
+		return result, rpcerrors.InvalidArgument("query", "%s", err)
+	}
+
+	pod, err := s.client.CoreV1().Pods(req.Namespace).Get(ctx, result.ResourceName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("%s get pod %s/%s error: %s\n", method, req.Namespace, result.ResourceName, err)
+		return result, err
+	}
+	if pod.Status.PodIP == "" {
+		return result, fmt.Errorf("pod %s/%s has no IP yet", req.Namespace, result.ResourceName)
+	}
+
+	now := time.Now()
+	values, err := s.scrape(ctx, pod.Status.PodIP, q)
+	if err != nil {
+		return result, err
+	}
+
+	// every aggregation is computed from the same scrape, one record each
+	ops := resource.Aggregations(req, SumAction)
+	records := make([]*obi.GetMetricsResponseRecord, 0, len(ops))
+	ready := true
+	for _, op := range ops {
+		value, err := aggregate(op, values)
+		if err != nil {
+			return result, err
+		}
+
+		current := Sample{Timestamp: now.UnixMilli(), Value: value}
+		if q.rate {
+			key := fmt.Sprintf("%s/%s/%s/%s", req.Namespace, result.ResourceName, op, q.key())
+			rate, ok := s.rate(key, current)
+			if !ok {
+				klog.V(4).Infof("%s no previous sample of %s, rate is available on the next scrape\n", method, key)
+				ready = false
+				continue
+			}
+			current.Value = rate
+		}
+		records = append(records, &obi.GetMetricsResponseRecord{
+			Timestamp: current.Timestamp,
+			Value:     fmt.Sprintf("%f", current.Value),
+		})
+	}
+	// the records are all returned or none, so that they match the order of
+	// the aggregations
+	if !ready {
+		return result, nil
+	}
+
+	result.Records = records
+	klog.V(5).Infof("%s scrape pod %s/%s by '%s' result: %v\n", method, req.Namespace, result.ResourceName, req.Query, records)
+	return result, nil
+}
+
+// aggregate reduces the values of all matched series to a single value.
+func aggregate(op string, values []float64) (float64, error) {
+	ans := values[0]
+	switch op {
+	case SumAction, AvgAction:
+		for _, v := range values[1:] {
+			ans += v
+		}
+		if op == AvgAction {
+			ans /= float64(len(values))
+		}
+	case MaxAction:
+		for _, v := range values[1:] {
+			if v > ans {
+				ans = v
+			}
+		}
+	case MinAction:
+		for _, v := range values[1:] {
+			if v < ans {
+				ans = v
+			}
+		}
+	default:
+		return 0, rpcerrors.InvalidArgument("aggregation", "aggregation %s isn't supported by %s", op, PluginName)
+	}
+	return ans, nil
+}
+
+// Options are the scrape settings of the plugin config.
+type Options struct {
+	Timeout   metav1.Duration `json:"timeout,omitempty"`
+	MaxBytes  int64           `json:"maxBytes,omitempty"`
+	SampleTTL metav1.Duration `json:"sampleTTL,omitempty"`
+}
+
+// New creates a scrape instance from its config, the options left empty fall
+// back to the flags.
+func New(cfg config.PluginConfig) (resource.Observer, error) {
+	opts := Options{}
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		return nil, err
+	}
+	if opts.Timeout.Duration <= 0 {
+		opts.Timeout.Duration = *flags.ScrapeTimeout
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = *flags.ScrapeMaxBytes
+	}
+	if opts.SampleTTL.Duration <= 0 {
+		opts.SampleTTL.Duration = *flags.ScrapeSampleTTL
+	}
+
+	restConf, err := clientcmd.BuildConfigFromFlags("", *flags.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	restConf.Wrap(metrics.InstrumentRoundTripper(cfg.Name, "kube-apiserver"))
+	restConf.Wrap(tracing.RoundTripper)
+	client, err := kubernetes.NewForConfig(restConf)
+	if err != nil {
+		return nil, err
+	}
+	s := NewScrapeServer(cfg.Name, client, opts.Timeout.Duration, opts.MaxBytes, opts.SampleTTL.Duration)
+	s.httpClient.Transport = tracing.RoundTripper(metrics.InstrumentRoundTripper(cfg.Name, "pod")(http.DefaultTransport))
+	return s, nil
+}
+
+func init() {
+	resource.RegisterFactory(PluginName, New)
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conformance checks that an observer behaves like the arbiter
+// expects, a plugin runs it from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Suite{
+//			Observer: NewMyObserver("my-source"),
+//			Requests: []*obi.GetMetricsRequest{{
+//				Kind:          "Pod",
+//				Namespace:     "default",
+//				ResourceNames: []string{"web-0"},
+//				MetricName:    "cpu",
+//			}},
+//		}.Run(t)
+//	}
+//
+// The requests must be answered by the backend of the observer, such as a
+// fake server started by the test.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// DefaultTimeout bounds every call of the suite when Suite.Timeout is zero.
+const DefaultTimeout = 10 * time.Second
+
+// unknownAggregation is an aggregation which no observer supports.
+const unknownAggregation = "conformance-unknown"
+
+// Suite is the conformance suite of an observer.
+type Suite struct {
+	// Observer is the instance under test.
+	Observer resource.Observer
+	// Requests are valid requests of the observer, each one must be answered
+	// with at least one record.
+	Requests []*obi.GetMetricsRequest
+	// Timeout bounds every call, it defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Run runs every check of the suite as a subtest of t.
+func (s Suite) Run(t *testing.T) {
+	t.Helper()
+	if s.Observer == nil {
+		t.Fatal("conformance suite has no observer")
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+	t.Run("Capabilities", s.testCapabilities)
+	t.Run("Responses", s.testResponses)
+	t.Run("EmptyRequest", s.testEmptyRequest)
+	t.Run("UnknownAggregation", s.testUnknownAggregation)
+	t.Run("Canceled", s.testCanceled)
+	t.Run("DeadlineExceeded", s.testDeadlineExceeded)
+}
+
+// testCapabilities checks that the observer has a name and that every
+// capability is described with unique aggregations.
+func (s Suite) testCapabilities(t *testing.T) {
+	if s.Observer.Name() == "" {
+		t.Error("observer has no name")
+	}
+	capabilities := s.Observer.Capabilities()
+	if len(capabilities) == 0 {
+		t.Error("observer has no capability")
+	}
+	for metric, capability := range capabilities {
+		if metric == "" {
+			t.Error("capability has no metric name")
+		}
+		if capability == nil {
+			t.Errorf("capability %s is nil", metric)
+			continue
+		}
+		if capability.Description == "" {
+			t.Errorf("capability %s has no description", metric)
+		}
+		seen := map[string]bool{}
+		for _, op := range capability.Aggregation {
+			if op == "" {
+				t.Errorf("capability %s has an empty aggregation", metric)
+			}
+			if seen[op] {
+				t.Errorf("capability %s lists aggregation %s twice", metric, op)
+			}
+			seen[op] = true
+		}
+	}
+}
+
+// testResponses checks the responses of the valid requests against the
+// requests and the capabilities.
+func (s Suite) testResponses(t *testing.T) {
+	if len(s.Requests) == 0 {
+		t.Skip("no request to check")
+	}
+	for idx, req := range s.Requests {
+		req := req
+		t.Run(fmt.Sprintf("%d-%s", idx, req.MetricName), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+			defer cancel()
+			response, err := s.fetch(ctx, req)
+			if err != nil {
+				t.Fatalf("fetch %s: %s", req, err)
+			}
+			if response == nil {
+				t.Fatalf("fetch %s: nil response", req)
+			}
+			s.checkResponse(t, req, response)
+		})
+	}
+}
+
+func (s Suite) checkResponse(t *testing.T, req *obi.GetMetricsRequest, response *obi.GetMetricsResponse) {
+	if len(req.ResourceNames) > 0 && response.ResourceName != req.ResourceNames[0] {
+		t.Errorf("response resource name %q, request %q", response.ResourceName, req.ResourceNames[0])
+	}
+	if response.Namespace != req.Namespace {
+		t.Errorf("response namespace %q, request %q", response.Namespace, req.Namespace)
+	}
+	if len(response.Records) == 0 {
+		t.Error("response has no record")
+	}
+	for idx, record := range response.Records {
+		if record == nil {
+			t.Errorf("record %d is nil", idx)
+			continue
+		}
+		if record.Timestamp <= 0 {
+			t.Errorf("record %d has timestamp %d", idx, record.Timestamp)
+		}
+		if _, err := strconv.ParseFloat(record.Value, 64); err != nil {
+			t.Errorf("record %d value %q isn't a number", idx, record.Value)
+		}
+	}
+
+	capability := s.Observer.Capabilities()[req.MetricName]
+	if capability == nil {
+		return
+	}
+	if response.Unit != "" && capability.MetricUnit != "" && response.Unit != capability.MetricUnit && response.Unit != req.Unit {
+		t.Errorf("response unit %q, capability %q, request %q", response.Unit, capability.MetricUnit, req.Unit)
+	}
+	// one record per aggregation is returned when all of them are supported
+	if len(req.Aggregation) > 1 && supportsAll(capability, req.Aggregation) && len(response.Records) != len(req.Aggregation) {
+		t.Errorf("%d records for aggregations %v", len(response.Records), req.Aggregation)
+	}
+}
+
+// testEmptyRequest checks that an empty request is rejected as InvalidArgument
+// instead of panicking or reaching the backend with missing fields.
+func (s Suite) testEmptyRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	_, err := s.fetch(ctx, &obi.GetMetricsRequest{})
+	if err == nil {
+		t.Fatal("empty request isn't rejected")
+	}
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("empty request error code %s, want %s: %s", code, codes.InvalidArgument, err)
+	}
+}
+
+// testUnknownAggregation checks that an aggregation which no capability lists
+// is rejected as InvalidArgument by the observers which aggregate. The other
+// observers may ignore it, but they mustn't fail otherwise.
+func (s Suite) testUnknownAggregation(t *testing.T) {
+	if len(s.Requests) == 0 {
+		t.Skip("no request to check")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	req := proto.Clone(s.Requests[0]).(*obi.GetMetricsRequest)
+	req.Aggregation = []string{unknownAggregation}
+	_, err := s.fetch(ctx, req)
+	code := status.Code(err)
+	if len(resource.SupportedAggregations(s.Observer, req.MetricName)) > 0 && code != codes.InvalidArgument {
+		t.Errorf("aggregation %s error code %s, want %s: %v", unknownAggregation, code, codes.InvalidArgument, err)
+	}
+	if code != codes.OK && code != codes.InvalidArgument {
+		t.Errorf("aggregation %s error code %s, want %s or none: %s", unknownAggregation, code, codes.InvalidArgument, err)
+	}
+}
+
+// testCanceled checks that a request of a canceled context returns an error.
+func (s Suite) testCanceled(t *testing.T) {
+	if len(s.Requests) == 0 {
+		t.Skip("no request to check")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.checkContextError(t, ctx, codes.Canceled, context.Canceled)
+}
+
+// testDeadlineExceeded checks that a request of an expired context returns an
+// error.
+func (s Suite) testDeadlineExceeded(t *testing.T) {
+	if len(s.Requests) == 0 {
+		t.Skip("no request to check")
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	s.checkContextError(t, ctx, codes.DeadlineExceeded, context.DeadlineExceeded)
+}
+
+func (s Suite) checkContextError(t *testing.T, ctx context.Context, code codes.Code, ctxErr error) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.fetch(ctx, s.Requests[0])
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("request isn't stopped by %s", ctxErr)
+		}
+		if !errors.Is(err, ctxErr) && status.Code(err) != code {
+			t.Errorf("error %q is neither %s nor code %s", err, ctxErr, code)
+		}
+	case <-time.After(s.Timeout):
+		t.Fatalf("request isn't stopped by %s within %s", ctxErr, s.Timeout)
+	}
+}
+
+// fetch calls the observer with a copy of req, a panic is reported as an
+// error of the test.
+func (s Suite) fetch(ctx context.Context, req *obi.GetMetricsRequest) (response *obi.GetMetricsResponse, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("observer panicked: %v", r)
+		}
+	}()
+	req = proto.Clone(req).(*obi.GetMetricsRequest)
+	if req.Source == "" {
+		req.Source = s.Observer.Name()
+	}
+	return s.Observer.FetchData(ctx, req)
+}
+
+func supportsAll(capability *obi.CapabilityInfo, ops []string) bool {
+	for _, op := range ops {
+		found := false
+		for _, supported := range capability.Aggregation {
+			if op == supported {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk
+
+import (
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+)
+
+// Observer is implemented by the plugins, every instance is served under its
+// name, which is the source of the requests.
+type Observer = resource.Observer
+
+// Prober is implemented by the observers which can check the connectivity to
+// their backend, the health service reports their result.
+type Prober = resource.Prober
+
+// Register adds an observer to the served ones, an observer with the same name
+// is replaced.
+func Register(instance Observer) {
+	resource.Register(instance)
+}
+
+// Replace swaps all served observers for the given ones at once, requests in
+// flight finish with the observers they started with.
+func Replace(instances []Observer) {
+	resource.Replace(instances)
+}
+
+// Registered returns the served observers by name, the map must not be
+// modified.
+func Registered() map[string]Observer {
+	return resource.Registered()
+}
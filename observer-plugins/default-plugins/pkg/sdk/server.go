@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/lifecycle"
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/common/tracing"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/health"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// flushTimeout bounds the export of the pending spans on shutdown.
+const flushTimeout = 5 * time.Second
+
+// Server serves the registered observers.
+type Server struct {
+	opts    *Options
+	server  *grpc.Server
+	checker *health.Checker
+}
+
+// NewServer creates the grpc server of the registered observers with the
+// health service. The requests are traced, measured, and a panic of a handler
+// is returned as an Internal error.
+func NewServer(opts *Options, serverOpts ...grpc.ServerOption) (*Server, error) {
+	listenOpts, err := opts.Listen.ServerOptions()
+	if err != nil {
+		return nil, err
+	}
+	interceptors := grpc.ChainUnaryInterceptor(
+		tracing.UnaryServerInterceptor(),
+		metrics.UnaryServerInterceptor,
+		rpcerrors.UnaryServerRecoveryInterceptor,
+	)
+	server := grpc.NewServer(append(append(listenOpts, interceptors), serverOpts...)...)
+	obi.RegisterServerServer(server, NewService())
+	checker := health.NewChecker(opts.HealthCheckInterval, opts.ProbeTimeout)
+	checker.Register(server)
+	return &Server{opts: opts, server: server, checker: checker}, nil
+}
+
+// GRPCServer returns the grpc server, other services can be registered on it
+// before Run.
+func (s *Server) GRPCServer() *grpc.Server {
+	return s.server
+}
+
+// Run serves until ctx is done, then drains the requests in flight.
+func (s *Server) Run(ctx context.Context) error {
+	shutdownTracing, err := tracing.Setup(ctx, s.opts.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			klog.Errorf("flush traces error: %s\n", err)
+		}
+	}()
+
+	if s.opts.MetricsAddress != "" {
+		go func() {
+			if err := lifecycle.ServeMetrics(ctx, s.opts.MetricsAddress, metrics.Registry); err != nil {
+				klog.Fatalln(err)
+			}
+		}()
+	}
+	go s.checker.Run(ctx)
+
+	listener, err := s.opts.Listen.Listen()
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s started on %s ...\n", s.opts.Name, &s.opts.Listen)
+	if err := lifecycle.Serve(ctx, s.server, listener, s.opts.DrainTimeout); err != nil {
+		return err
+	}
+	klog.Infof("%s stopped\n", s.opts.Name)
+	return nil
+}
+
+// Main runs a plugin server and exits on errors. With opts.Probe it checks the
+// health of the running server and exits. Otherwise setup is called to
+// register the observers, then the server runs until SIGTERM or SIGINT.
+func Main(opts *Options, setup func(ctx context.Context) error) {
+	defer klog.Flush()
+	if err := opts.Listen.Validate(); err != nil {
+		klog.Fatalln(err)
+	}
+	if opts.Probe {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ProbeTimeout)
+		defer cancel()
+		if err := lifecycle.Probe(ctx, &opts.Listen, opts.ProbeService); err != nil {
+			klog.Errorln(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx := lifecycle.SetupSignalContext()
+	if setup != nil {
+		if err := setup(ctx); err != nil {
+			klog.Fatalln(err)
+		}
+	}
+	server, err := NewServer(opts)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+	if err := server.Run(ctx); err != nil {
+		klog.Fatalln(err)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/metrics"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+// behavingObserver answers, fails or panics depending on its name.
+type behavingObserver string
+
+func (b behavingObserver) Name() string { return string(b) }
+
+func (behavingObserver) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{"cpu": {Description: "cpu"}}
+}
+
+func (b behavingObserver) FetchData(context.Context, *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	switch b {
+	case "server-panic":
+		panic("nil map")
+	case "server-down":
+		return nil, rpcerrors.Unavailable("connection refused")
+	}
+	return &obi.GetMetricsResponse{Records: []*obi.GetMetricsResponseRecord{{Value: "1"}}}, nil
+}
+
+// errorCount returns the request errors of source with code.
+func errorCount(t *testing.T, source string, code codes.Code) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "arbiter_observer_request_errors_total" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["method"] == "GetMetrics" && labels["source"] == source && labels["code"] == code.String() {
+				return metric.Counter.GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// TestNewServerInterceptors checks the order of the interceptors: the
+// recovery turns a panic into an error before it's measured and recorded
+// on the span of the request.
+func TestNewServerInterceptors(t *testing.T) {
+	provider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(provider)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	resource.Replace([]resource.Observer{
+		behavingObserver("server-ok"), behavingObserver("server-down"), behavingObserver("server-panic"),
+	})
+	defer resource.Replace(nil)
+
+	server, err := sdk.NewServer(sdk.NewOptions("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.GRPCServer().Serve(listener) }()
+	defer server.GRPCServer().Stop()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := obi.NewServerClient(conn)
+
+	tests := []struct {
+		source     string
+		wantCode   codes.Code
+		wantStatus otelcodes.Code
+	}{
+		{source: "server-ok", wantCode: codes.OK, wantStatus: otelcodes.Unset},
+		{source: "server-down", wantCode: codes.Unavailable, wantStatus: otelcodes.Error},
+		{source: "server-panic", wantCode: codes.Internal, wantStatus: otelcodes.Error},
+	}
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			errors := errorCount(t, test.source, test.wantCode)
+			_, err := client.GetMetrics(context.Background(), &obi.GetMetricsRequest{
+				Source: test.source, Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"}, MetricName: "cpu",
+			})
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("GetMetrics() error = %v, want code %s", err, test.wantCode)
+			}
+
+			wantErrors := errors
+			if test.wantCode != codes.OK {
+				wantErrors++
+			}
+			if got := errorCount(t, test.source, test.wantCode); got != wantErrors {
+				t.Errorf("request errors = %v, want %v", got, wantErrors)
+			}
+			spans := recorder.Ended()
+			if len(spans) == 0 {
+				t.Fatal("no span ended")
+			}
+			if got := spans[len(spans)-1]; got.Name() != "obi.v1.Server/GetMetrics" || got.Status().Code != test.wantStatus {
+				t.Errorf("span %s status = %v, want obi.v1.Server/GetMetrics with %s", got.Name(), got.Status(), test.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/kube-arbiter/arbiter-plugins/common/rpcerrors"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+type service struct {
+	obi.UnimplementedServerServer
+}
+
+// NewService returns the obi server of the registered observers. It validates
+// the requests, converts the errors of the observers to grpc status errors and
+// reports the aggregation of the records.
+func NewService() obi.ServerServer {
+	return &service{}
+}
+
+func (s *service) GetPluginNames(ctx context.Context, req *obi.GetPluginNameRequest) (*obi.GetPluginNameResponse, error) {
+	return &obi.GetPluginNameResponse{
+		Names: resource.Resources(),
+	}, nil
+}
+
+func (s *service) PluginCapabilities(ctx context.Context, req *obi.PluginCapabilitiesRequest) (*obi.PluginCapabilitiesResponse, error) {
+	result := &obi.PluginCapabilitiesResponse{
+		Capabilities: map[string]*obi.PluginCapability{},
+	}
+	for plugin, i := range resource.Registered() {
+		result.Capabilities[plugin] = &obi.PluginCapability{}
+		result.Capabilities[plugin].Capability = i.Capabilities()
+	}
+
+	return result, nil
+}
+
+func (s *service) GetMetrics(ctx context.Context, req *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	klog.Infof("GetMetrics with req: %#v\n", req.String())
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("arbiter.source", req.Source),
+		attribute.String("arbiter.metric", req.MetricName),
+		attribute.String("k8s.kind", req.Kind),
+	)
+	instance, err := validate(req)
+	if err != nil {
+		klog.Warningf("GetMetrics invalid request: %s\n", err)
+		return nil, err
+	}
+
+	response, err := instance.FetchData(ctx, req)
+	if err != nil {
+		klog.Errorf("GetMetrics fetch data %s from %s error: %s\n", req.MetricName, req.Source, err)
+		return nil, rpcerrors.FromError(req.Source, err)
+	}
+	if response.Source == "" {
+		response.Source = req.Source
+	}
+	// the aggregations are the ones of the source which answered, such as the
+	// source a failover fell back to
+	answered := instance
+	if response.Source != req.Source {
+		if source, ok := resource.GetRegisters(response.Source); ok {
+			answered = source
+		}
+	}
+	if len(req.Aggregation) > 0 && len(resource.SupportedAggregations(answered, req.MetricName)) > 0 {
+		// the record of each aggregation is only known by its position, a
+		// source returning another number of records can't be trusted
+		if n := len(response.Records); n > 0 && n != len(req.Aggregation) {
+			klog.Errorf("GetMetrics %s returned %d records for aggregations %v\n", response.Source, n, req.Aggregation)
+			return nil, status.Errorf(codes.Internal, "source %s returned %d records for %d aggregations", response.Source, n, len(req.Aggregation))
+		}
+		header := metadata.Pairs(resource.AggregationHeader, strings.Join(req.Aggregation, ","))
+		if err := grpc.SetHeader(ctx, header); err != nil {
+			klog.Warningf("GetMetrics set %s header error: %s\n", resource.AggregationHeader, err)
+		}
+	}
+	return response, nil
+}
+
+// validate checks the fields used by every plugin and returns the instance of
+// the source, the plugins check the fields specific to them.
+func validate(req *obi.GetMetricsRequest) (resource.Observer, error) {
+	if req.Source == "" {
+		return nil, rpcerrors.InvalidArgument("source", "source is required")
+	}
+	instance, ok := resource.GetRegisters(req.Source)
+	if !ok {
+		return nil, rpcerrors.NotFound("source", req.Source, "source %s isn't registered", req.Source)
+	}
+	if req.StartTime < 0 || req.EndTime < 0 {
+		return nil, rpcerrors.InvalidArgument("start_time", "start_time and end_time can't be negative")
+	}
+	if req.EndTime > 0 && req.StartTime > req.EndTime {
+		return nil, rpcerrors.InvalidArgument("end_time", "end_time %d is before start_time %d", req.EndTime, req.StartTime)
+	}
+	for idx, name := range req.ResourceNames {
+		if name == "" {
+			return nil, rpcerrors.InvalidArgument(fmt.Sprintf("resource_names[%d]", idx), "resource name can't be empty")
+		}
+	}
+	if err := validateAggregation(instance, req); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// validateAggregation checks that the capabilities of the source list every
+// requested aggregation, the sources which don't aggregate aren't checked.
+func validateAggregation(instance resource.Observer, req *obi.GetMetricsRequest) error {
+	supported := resource.SupportedAggregations(instance, req.MetricName)
+	if len(supported) == 0 {
+		return nil
+	}
+	for idx, op := range req.Aggregation {
+		if !contains(supported, op) {
+			return rpcerrors.InvalidArgument(fmt.Sprintf("aggregation[%d]", idx), "aggregation %s isn't supported by source %s, supported: %s",
+				op, req.Source, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
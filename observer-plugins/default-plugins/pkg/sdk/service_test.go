@@ -0,0 +1,270 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sdk_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/transport"
+
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/failover"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/loki"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/prometheus"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/resource"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/plugins/scrape"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/sdk"
+	"github.com/kube-arbiter/arbiter-plugins/observer-plugins/default-plugins/pkg/testing/fakeprometheus"
+	obi "github.com/kube-arbiter/arbiter/pkg/proto/lib/observer"
+)
+
+var start = time.UnixMilli(1660000000000)
+
+// newClient serves the registered observers on an in-memory listener.
+func newClient(t *testing.T) obi.ServerClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	obi.RegisterServerServer(server, sdk.NewService())
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return obi.NewServerClient(conn)
+}
+
+// registerSources registers a prometheus, a loki and a scrape source whose
+// samples are 1, 5 and 3, it returns the port of the scraped pod.
+func registerSources(t *testing.T, extra ...resource.Observer) string {
+	t.Helper()
+	samples := &model.SampleStream{Metric: model.Metric{}}
+	for idx, value := range []float64{1, 5, 3} {
+		samples.Values = append(samples.Values, model.SamplePair{
+			Timestamp: model.TimeFromUnixNano(start.Add(time.Duration(idx) * time.Minute).UnixNano()),
+			Value:     model.SampleValue(value),
+		})
+	}
+	backend := fakeprometheus.NewServer()
+	t.Cleanup(backend.Close)
+	backend.SetDefaultResponse(fakeprometheus.Response{Result: model.Matrix{samples}})
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE queue_length gauge\nqueue_length{queue=\"a\"} 1\nqueue_length{queue=\"b\"} 5\nqueue_length{queue=\"c\"} 3\n")
+	}))
+	t.Cleanup(endpoint.Close)
+	host, port, err := net.SplitHostPort(endpoint.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0"},
+		Status:     v1.PodStatus{PodIP: host},
+	})
+
+	resource.Replace(append([]resource.Observer{
+		prometheus.NewPrometheusServer("prometheus", backend.URL, &transport.Config{}, 60),
+		loki.NewLokiServer("loki", backend.URL, "", 60, 1<<20, http.DefaultTransport),
+		scrape.NewScrapeServer("scrape", client, time.Second, 1<<20, time.Minute),
+	}, extra...))
+	t.Cleanup(func() { resource.Replace(nil) })
+	return port
+}
+
+// shortObserver aggregates but returns a single record.
+type shortObserver struct{}
+
+func (shortObserver) Name() string { return "short" }
+
+func (shortObserver) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{"cpu": {Aggregation: []string{"max", "min"}}}
+}
+
+func (shortObserver) FetchData(context.Context, *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	return &obi.GetMetricsResponse{Records: []*obi.GetMetricsResponseRecord{{Value: "1"}}}, nil
+}
+
+func TestGetMetricsAggregations(t *testing.T) {
+	port := registerSources(t, shortObserver{})
+	client := newClient(t)
+
+	sources := []struct {
+		source string
+		metric string
+		query  string
+	}{
+		{source: "prometheus", metric: "cpu", query: "up"},
+		{source: "loki", metric: "log", query: `sum(rate({pod="web-0"}[1m]))`},
+		{source: "scrape", metric: "metric", query: "metric=queue_length&port=" + port},
+	}
+	tests := []struct {
+		name        string
+		aggregation []string
+		want        []string
+		wantCode    codes.Code
+	}{
+		{
+			name:        "one record per aggregation in the order of the request",
+			aggregation: []string{"max", "min", "avg"},
+			want:        []string{"5.000000", "1.000000", "3.000000"},
+		},
+		{
+			name:        "another order",
+			aggregation: []string{"min", "max"},
+			want:        []string{"1.000000", "5.000000"},
+		},
+		{
+			name:        "unsupported aggregation",
+			aggregation: []string{"max", "p99"},
+			wantCode:    codes.InvalidArgument,
+		},
+	}
+	for _, source := range sources {
+		for _, test := range tests {
+			t.Run(source.source+"/"+test.name, func(t *testing.T) {
+				var header metadata.MD
+				got, err := client.GetMetrics(context.Background(), &obi.GetMetricsRequest{
+					Source: source.source, Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+					MetricName: source.metric, Query: source.query, Aggregation: test.aggregation,
+					StartTime: start.UnixMilli(), EndTime: start.Add(2 * time.Minute).UnixMilli(),
+				}, grpc.Header(&header))
+				if code := status.Code(err); code != test.wantCode {
+					t.Fatalf("GetMetrics() error = %v, want code %s", err, test.wantCode)
+				}
+				if test.wantCode != codes.OK {
+					return
+				}
+				values := make([]string, 0, len(got.Records))
+				for _, record := range got.Records {
+					values = append(values, record.Value)
+				}
+				if !reflect.DeepEqual(values, test.want) {
+					t.Errorf("GetMetrics() values = %v, want %v", values, test.want)
+				}
+				if tags := header.Get(resource.AggregationHeader); !reflect.DeepEqual(tags, []string{strings.Join(test.aggregation, ",")}) {
+					t.Errorf("GetMetrics() %s header = %v, want %v", resource.AggregationHeader, tags, test.aggregation)
+				}
+			})
+		}
+	}
+
+	t.Run("a source returning fewer records", func(t *testing.T) {
+		_, err := client.GetMetrics(context.Background(), &obi.GetMetricsRequest{
+			Source: "short", Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+			MetricName: "cpu", Aggregation: []string{"max", "min"},
+		})
+		if code := status.Code(err); code != codes.Internal {
+			t.Errorf("GetMetrics() error = %v, want code %s", err, codes.Internal)
+		}
+	})
+}
+
+// plainObserver doesn't aggregate, it returns a single record.
+type plainObserver struct{}
+
+func (plainObserver) Name() string { return "plain" }
+
+func (plainObserver) Capabilities() map[string]*obi.CapabilityInfo {
+	return map[string]*obi.CapabilityInfo{"cpu": {}}
+}
+
+func (plainObserver) FetchData(context.Context, *obi.GetMetricsRequest) (*obi.GetMetricsResponse, error) {
+	return &obi.GetMetricsResponse{Records: []*obi.GetMetricsResponseRecord{{Value: "2"}}}, nil
+}
+
+func TestGetMetricsFailoverHeader(t *testing.T) {
+	down := fakeprometheus.NewServer()
+	down.Close()
+	registerSources(t,
+		prometheus.NewPrometheusServer("prometheus-down", down.URL, &transport.Config{}, 60),
+		plainObserver{},
+		failover.NewFailoverServer("to-prometheus", []string{"prometheus-down", "prometheus"}),
+		failover.NewFailoverServer("to-plain", []string{"prometheus-down", "plain"}),
+	)
+	client := newClient(t)
+
+	tests := []struct {
+		name        string
+		source      string
+		aggregation []string
+		wantSource  string
+		want        []string
+		wantHeader  []string
+	}{
+		{
+			name:        "the source which answered aggregates",
+			source:      "to-prometheus",
+			aggregation: []string{"max", "min"},
+			wantSource:  "prometheus",
+			want:        []string{"5.000000", "1.000000"},
+			wantHeader:  []string{"max,min"},
+		},
+		{
+			name:        "the source which answered doesn't aggregate",
+			source:      "to-plain",
+			aggregation: []string{"max"},
+			wantSource:  "plain",
+			want:        []string{"2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header metadata.MD
+			got, err := client.GetMetrics(context.Background(), &obi.GetMetricsRequest{
+				Source: test.source, Kind: "Pod", Namespace: "default", ResourceNames: []string{"web-0"},
+				MetricName: "cpu", Query: "up", Aggregation: test.aggregation,
+				StartTime: start.UnixMilli(), EndTime: start.Add(2 * time.Minute).UnixMilli(),
+			}, grpc.Header(&header))
+			if err != nil {
+				t.Fatalf("GetMetrics() error = %v", err)
+			}
+			values := make([]string, 0, len(got.Records))
+			for _, record := range got.Records {
+				values = append(values, record.Value)
+			}
+			if got.Source != test.wantSource || !reflect.DeepEqual(values, test.want) {
+				t.Errorf("GetMetrics() = %v from %s, want %v from %s", values, got.Source, test.want, test.wantSource)
+			}
+			if tags := header.Get(resource.AggregationHeader); !reflect.DeepEqual(tags, test.wantHeader) {
+				t.Errorf("GetMetrics() %s header = %v, want %v", resource.AggregationHeader, tags, test.wantHeader)
+			}
+		})
+	}
+}
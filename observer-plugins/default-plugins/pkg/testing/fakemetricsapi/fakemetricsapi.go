@@ -0,0 +1,195 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakemetricsapi is an httptest server serving the pods and nodes of
+// the aggregated metrics.k8s.io api, for the tests of the plugins reading the
+// metrics server.
+package fakemetricsapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	groupVersion = "metrics.k8s.io/v1beta1"
+	apiPath      = "/apis/" + groupVersion
+)
+
+// PodMetrics is the usage of a pod in the metrics api.
+type PodMetrics struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Timestamp         metav1.Time        `json:"timestamp"`
+	Window            metav1.Duration    `json:"window"`
+	Containers        []ContainerMetrics `json:"containers"`
+}
+
+// ContainerMetrics is the usage of a container of a pod.
+type ContainerMetrics struct {
+	Name  string          `json:"name"`
+	Usage v1.ResourceList `json:"usage"`
+}
+
+// NodeMetrics is the usage of a node in the metrics api.
+type NodeMetrics struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Timestamp         metav1.Time     `json:"timestamp"`
+	Window            metav1.Duration `json:"window"`
+	Usage             v1.ResourceList `json:"usage"`
+}
+
+// Server is a fake api server with the metrics api, the unknown pods and nodes
+// are answered with NotFound.
+type Server struct {
+	*httptest.Server
+
+	lock       sync.Mutex
+	pods       map[string]PodMetrics
+	nodes      map[string]NodeMetrics
+	statusCode int
+	requests   []string
+}
+
+// NewServer starts a server without metrics, the caller closes it.
+func NewServer() *Server {
+	s := &Server{pods: map[string]PodMetrics{}, nodes: map[string]NodeMetrics{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// RestConfig returns the config of a client of the server.
+func (s *Server) RestConfig() *rest.Config {
+	return &rest.Config{Host: s.URL}
+}
+
+// AddPod sets the usage of the containers of a pod, by container name.
+func (s *Server) AddPod(namespace, name string, containers map[string]v1.ResourceList) {
+	pod := PodMetrics{
+		TypeMeta:   metav1.TypeMeta{Kind: "PodMetrics", APIVersion: groupVersion},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Timestamp:  metav1.NewTime(time.Now()),
+		Window:     metav1.Duration{Duration: 30 * time.Second},
+		Containers: []ContainerMetrics{},
+	}
+	for container, usage := range containers {
+		pod.Containers = append(pod.Containers, ContainerMetrics{Name: container, Usage: usage})
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pods[namespace+"/"+name] = pod
+}
+
+// AddNode sets the usage of a node.
+func (s *Server) AddNode(name string, usage v1.ResourceList) {
+	node := NodeMetrics{
+		TypeMeta:   metav1.TypeMeta{Kind: "NodeMetrics", APIVersion: groupVersion},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Timestamp:  metav1.NewTime(time.Now()),
+		Window:     metav1.Duration{Duration: 30 * time.Second},
+		Usage:      usage,
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nodes[name] = node
+}
+
+// SetStatusCode makes every request fail with the http status, 0 restores the
+// answers.
+func (s *Server) SetStatusCode(statusCode int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusCode = statusCode
+}
+
+// Requests returns the paths requested so far.
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.URL.Path)
+
+	if s.statusCode != 0 {
+		writeStatus(w, apierrors.NewGenericServerResponse(s.statusCode, r.Method, schema.GroupResource{}, "", "fake failure", 0, false))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeStatus(w, apierrors.NewMethodNotSupported(schema.GroupResource{Group: "metrics.k8s.io"}, r.Method))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPath), "/"), "/")
+	switch {
+	case !strings.HasPrefix(r.URL.Path, apiPath):
+		writeStatus(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+	case len(parts) == 1 && parts[0] == "":
+		writeJSON(w, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: groupVersion,
+			APIResources: []metav1.APIResource{
+				{Name: "nodes", Kind: "NodeMetrics", Verbs: []string{"get", "list"}},
+				{Name: "pods", Kind: "PodMetrics", Namespaced: true, Verbs: []string{"get", "list"}},
+			},
+		})
+	case len(parts) == 2 && parts[0] == "nodes":
+		node, ok := s.nodes[parts[1]]
+		if !ok {
+			writeStatus(w, apierrors.NewNotFound(schema.GroupResource{Group: "metrics.k8s.io", Resource: "nodes"}, parts[1]))
+			return
+		}
+		writeJSON(w, &node)
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "pods":
+		pod, ok := s.pods[parts[1]+"/"+parts[3]]
+		if !ok {
+			writeStatus(w, apierrors.NewNotFound(schema.GroupResource{Group: "metrics.k8s.io", Resource: "pods"}, parts[3]))
+			return
+		}
+		writeJSON(w, &pod)
+	default:
+		writeStatus(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(object)
+}
+
+// writeStatus answers a metav1.Status as the api server does, so that the
+// clients see the api error.
+func writeStatus(w http.ResponseWriter, err *apierrors.StatusError) {
+	status := err.Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	_ = json.NewEncoder(w).Encode(&status)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2022 The Arbiter Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakeprometheus is an httptest server answering the prometheus http
+// api with scripted results, warnings and errors, for the tests of the
+// plugins querying prometheus. It answers the loki api as well, which has the
+// same shape.
+package fakeprometheus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Response is the scripted answer of a query.
+type Response struct {
+	// Result is returned when ErrorType is empty, such as a model.Matrix,
+	// model.Vector, *model.Scalar or *model.String.
+	Result model.Value
+	// Warnings are returned with the result or the error.
+	Warnings []string
+	// ErrorType and Error make the query fail as prometheus does, with the
+	// http status prometheus uses for the type.
+	ErrorType v1.ErrorType
+	Error     string
+	// StatusCode overrides the http status, a 5xx status without ErrorType
+	// answers an empty body as a failing proxy does.
+	StatusCode int
+}
+
+// Request is a query received by the server.
+type Request struct {
+	Path  string
+	Query string
+	Start string
+	End   string
+	Step  string
+	Time  string
+	// OrgID is the loki tenant of the X-Scope-OrgID header.
+	OrgID string
+}
+
+// Server is a fake prometheus, the responses are scripted by query.
+type Server struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	responses map[string]Response
+	fallback  *Response
+	requests  []Request
+}
+
+// NewServer starts a server answering every query with an empty vector, the
+// caller closes it.
+func NewServer() *Server {
+	s := &Server{responses: map[string]Response{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", s.handle)
+	mux.HandleFunc("/api/v1/query_range", s.handle)
+	mux.HandleFunc("/loki/api/v1/query", s.handle)
+	mux.HandleFunc("/loki/api/v1/query_range", s.handle)
+	mux.HandleFunc("/loki/api/v1/labels", s.handleLabels)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetResponse scripts the response of query.
+func (s *Server) SetResponse(query string, response Response) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.responses[query] = response
+}
+
+// SetDefaultResponse scripts the response of the queries without a response
+// of their own.
+func (s *Server) SetDefaultResponse(response Response) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fallback = &response
+}
+
+// Requests returns the queries received so far.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// apiResponse is the envelope of the prometheus http api.
+type apiResponse struct {
+	Status    string       `json:"status"`
+	Data      *queryData   `json:"data,omitempty"`
+	ErrorType v1.ErrorType `json:"errorType,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Warnings  []string     `json:"warnings,omitempty"`
+}
+
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := Request{
+		Path:  r.URL.Path,
+		Query: r.Form.Get("query"),
+		Start: r.Form.Get("start"),
+		End:   r.Form.Get("end"),
+		Step:  r.Form.Get("step"),
+		Time:  r.Form.Get("time"),
+		OrgID: r.Header.Get("X-Scope-OrgID"),
+	}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, request)
+	response, ok := s.responses[request.Query]
+	if !ok && s.fallback != nil {
+		response, ok = *s.fallback, true
+	}
+	s.lock.Unlock()
+	if !ok {
+		response = Response{Result: model.Vector{}}
+	}
+
+	statusCode := response.StatusCode
+	body := apiResponse{Status: "success", Warnings: response.Warnings}
+	if response.ErrorType != "" {
+		body = apiResponse{Status: "error", ErrorType: response.ErrorType, Error: response.Error, Warnings: response.Warnings}
+		if statusCode == 0 {
+			statusCode = errorStatusCode(response.ErrorType)
+		}
+	} else if statusCode >= http.StatusInternalServerError {
+		w.WriteHeader(statusCode)
+		return
+	} else {
+		body.Data = &queryData{ResultType: response.Result.Type(), Result: response.Result}
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// handleLabels answers the loki labels api, which the loki plugin probes, with
+// the status code of the default response.
+func (s *Server) handleLabels(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	fallback := s.fallback
+	s.lock.Unlock()
+	if fallback != nil && fallback.StatusCode != 0 {
+		w.WriteHeader(fallback.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+}
+
+// errorStatusCode returns the http status prometheus answers with an error of
+// the type.
+func errorStatusCode(errorType v1.ErrorType) int {
+	switch errorType {
+	case v1.ErrBadData:
+		return http.StatusBadRequest
+	case v1.ErrExec:
+		return http.StatusUnprocessableEntity
+	case v1.ErrCanceled, v1.ErrTimeout:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}